@@ -1,6 +1,6 @@
 module github.com/opentelekomcloud-infra/simple-exquisite-webserver
 
-go 1.13
+go 1.15
 
 require (
 	github.com/google/go-cmp v0.3.1
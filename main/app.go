@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
@@ -20,74 +26,197 @@ import (
 //App struct
 type App struct {
 	Router           *mux.Router
-	DB               *sql.DB
+	Store            EntityStore
 	DataGenerationWg sync.WaitGroup
+
+	cache   CacheConfig
+	schemas schemaRegistry
+	seeding *seedProgress
+	metrics *Metrics
+
+	pingTimeout time.Duration
+	draining    int32 // accessed atomically
+	adminToken  string
 }
 
-func generateRandomInitData(db *sql.DB, config *Configuration, waitGroup *sync.WaitGroup) {
+func generateRandomInitData(store EntityStore, config *Configuration, progress *seedProgress, waitGroup *sync.WaitGroup) {
 	defer waitGroup.Done()
-	if config.Debug || config.Postgres == nil || config.Postgres.Initial == nil {
-		log.Println("No initial data will be generated")
+	initial := config.InitialData()
+	if initial == nil {
+		logger.Info("No initial data will be generated")
 		return
 	}
 
-	initial := config.Postgres.Initial
-	ents := GenerateSomeEntities(initial.Count, initial.Size)
-	err := AddEntities(db, ents)
+	err := loadInitialData(context.Background(), store, initial, progress)
 	if err != nil {
-		log.Println("Can't fill database with initial data")
+		logger.Error("Can't fill database with initial data", "error", err)
 	}
+	progress.finish(err)
 }
 
 //Initialize func: init server according configuration structure
-func (a *App) Initialize(config *Configuration) {
-	if !config.Debug {
-		if config.Postgres == nil {
-			log.Panic("No postgres configuration is given, but debug mode is disabled")
-		}
-		var PgDbURL = config.Postgres.DbURL
-		dbURLSliced := strings.Split(PgDbURL, ":")
-		host := dbURLSliced[0]
-		port, err := strconv.Atoi(dbURLSliced[1])
-		if err != nil {
-			log.Fatal(err)
-		}
-		createErr := CreatePostgreDBIfNotExist(config.Postgres.Database, host, port, config.Postgres.Username, config.Postgres.Password)
-		if createErr != nil {
-			log.Fatalf("Error during db creation: %v", createErr)
+//
+// If PostgreSQL is unavailable and `degraded_start` is enabled, server starts without database
+// and connects to it in background, responding with 503 to entity requests until connected
+func (a *App) Initialize(config *Configuration) error {
+	a.Router = mux.NewRouter()
+	a.metrics = NewMetrics()
+	a.InitializeRoutes()
+	if config.Cache != nil {
+		a.cache = *config.Cache
+	}
+	if config.Health != nil {
+		a.pingTimeout = config.Health.PingTimeout
+	}
+	if config.Admin != nil {
+		a.adminToken = config.Admin.Token
+	}
+	for collection, path := range config.Schemas {
+		if err := a.loadSchema(collection, path); err != nil {
+			return err
 		}
-		connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-			host, port, config.Postgres.Username, config.Postgres.Password, config.Postgres.Database)
-		a.DB, err = sql.Open("postgres", connectionString)
-		if err != nil {
-			log.Fatal(err)
+	}
+
+	a.seeding = newSeedProgress(config.InitialData())
+
+	store, err := NewEntityStore(config)
+	if err != nil {
+		if config.StorageBackend() != BackendPostgres || config.Postgres == nil || !config.Postgres.DegradedStart {
+			return err
 		}
-		CreateTable(a.DB)
-	} else {
-		a.DB = nil
+		logger.Warn("Starting in degraded mode", "error", err)
+		deferred := &DeferredStore{}
+		a.Store = deferred
+		a.DataGenerationWg.Add(1)
+		go ConnectPostgresStoreInBackground(config.Postgres, deferred, func() {
+			generateRandomInitData(deferred, config, a.seeding, &a.DataGenerationWg)
+		})
+		return nil
 	}
+	a.Store = store
 	a.DataGenerationWg.Add(1)
-	go generateRandomInitData(a.DB, config, &a.DataGenerationWg)
-	a.Router = mux.NewRouter()
-	a.InitializeRoutes()
+	go generateRandomInitData(a.Store, config, a.seeding, &a.DataGenerationWg)
+	return nil
+}
+
+// Ready checks if server is ready to serve entity requests
+//
+// If `wait_for_seeding` is configured, server is not ready until initial data is loaded
+func (a *App) Ready() bool {
+	return a.CheckReadiness(context.Background()).Status == StatusReady
 }
 
 //Run server
 func (a *App) Run(addr string) {
-	log.Fatal(http.ListenAndServe(addr, a.Router))
+	err := http.ListenAndServe(addr, a.Router)
+	if closeErr := a.Close(); closeErr != nil {
+		logger.Error("Can't close storage", "error", closeErr)
+	}
+	logger.Fatal("Server stopped", "error", err)
 }
 
+// Close releases storage resources: storage files of `file` backend or connection pools of PostgreSQL
+func (a *App) Close() error {
+	if closer, ok := a.Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+const routeCollection = "/collections/{collection}"
+
 const routeUUID4 = "/entity/{id:[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}}"
 
 //InitializeRoutes - init routes for api requests
 func (a *App) InitializeRoutes() {
 	a.Router.Use(addServerHeaderMiddle)
+	a.Router.Use(requestIDMiddle)
+	a.Router.Use(tracingMiddle)
+	a.Router.Use(accessLogMiddle)
+	a.Router.Use(a.metricsMiddle)
+	a.Router.Use(readPreferenceMiddle)
 	a.Router.HandleFunc("/", a.Ok).Methods("GET")
+	a.Router.HandleFunc("/healthz", a.Liveness).Methods("GET")
+	a.Router.HandleFunc("/readyz", a.Readiness).Methods("GET")
+	a.Router.HandleFunc("/admin/drain", a.adminOnly(a.StartDrain)).Methods("PUT")
+	a.Router.HandleFunc("/admin/drain", a.adminOnly(a.StopDrain)).Methods("DELETE")
+	a.Router.HandleFunc("/admin/seed", a.adminOnly(a.GetSeedingStatus)).Methods("GET")
+	a.Router.HandleFunc("/metrics", a.GetMetrics).Methods("GET")
 	a.Router.HandleFunc("/entities", a.GetEntities).Methods("GET")
+	a.Router.HandleFunc("/entities", a.DeleteEntities).Methods("DELETE")
+	a.Router.HandleFunc("/entities/bulk", a.BulkCreateEntities).Methods("POST")
+	a.Router.HandleFunc("/entities/search", a.SearchEntities).Methods("GET")
 	a.Router.HandleFunc("/entity", a.CreateEntity).Methods("POST")
 	a.Router.HandleFunc(routeUUID4, a.GetEntity).Methods("GET")
 	a.Router.HandleFunc(routeUUID4, a.UpdateEntity).Methods("PUT")
+	a.Router.HandleFunc(routeUUID4, a.PatchEntity).Methods("PATCH")
 	a.Router.HandleFunc(routeUUID4, a.DeleteEntity).Methods("DELETE")
+
+	a.Router.HandleFunc("/collections", a.GetCollections).Methods("GET")
+	a.Router.HandleFunc("/collections", a.adminOnly(a.CreateCollection)).Methods("POST")
+	a.Router.HandleFunc(routeCollection, a.adminOnly(a.DropCollection)).Methods("DELETE")
+	a.Router.HandleFunc(routeCollection+"/schema", a.GetSchema).Methods("GET")
+	a.Router.HandleFunc(routeCollection+"/schema", a.adminOnly(a.SetSchema)).Methods("PUT")
+	a.Router.HandleFunc(routeCollection+"/schema", a.adminOnly(a.DeleteSchema)).Methods("DELETE")
+	a.Router.HandleFunc(routeCollection+"/entities", a.GetEntities).Methods("GET")
+	a.Router.HandleFunc(routeCollection+"/entities", a.DeleteEntities).Methods("DELETE")
+	a.Router.HandleFunc(routeCollection+"/entities/bulk", a.BulkCreateEntities).Methods("POST")
+	a.Router.HandleFunc(routeCollection+"/entities/search", a.SearchEntities).Methods("GET")
+	a.Router.HandleFunc(routeCollection+"/entity", a.CreateEntity).Methods("POST")
+	a.Router.HandleFunc(routeCollection+routeUUID4, a.GetEntity).Methods("GET")
+	a.Router.HandleFunc(routeCollection+routeUUID4, a.UpdateEntity).Methods("PUT")
+	a.Router.HandleFunc(routeCollection+routeUUID4, a.PatchEntity).Methods("PATCH")
+	a.Router.HandleFunc(routeCollection+routeUUID4, a.DeleteEntity).Methods("DELETE")
+}
+
+var (
+	// ErrAdminDisabled is returned by admin routes if no admin token is configured
+	ErrAdminDisabled = errors.New("admin routes are disabled, admin token is not configured")
+	// ErrAdminUnauthorized is returned by admin routes for requests without valid admin token
+	ErrAdminUnauthorized = errors.New("invalid admin token")
+)
+
+// adminOnly allows requests to administrative route only with configured admin token
+func (a *App) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.adminToken == "" {
+			respondWithError(w, http.StatusForbidden, ErrAdminDisabled)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondWithError(w, http.StatusUnauthorized, ErrAdminUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// collectionName returns name of collection selected by the route
+func collectionName(r *http.Request) string {
+	if name, ok := mux.Vars(r)["collection"]; ok {
+		return name
+	}
+	return DefaultCollection
+}
+
+// entityStore returns store of collection selected by the route, routes without collection use default store
+func (a *App) entityStore(r *http.Request) (EntityStore, error) {
+	name := collectionName(r)
+	if name == DefaultCollection {
+		return a.metrics.instrument(a.Store, name), nil
+	}
+	collections, err := a.collectionStore()
+	if err != nil {
+		return nil, err
+	}
+	store, err := collections.Collection(r.Context(), name)
+	if err != nil {
+		return nil, err
+	}
+	return a.metrics.instrument(store, name), nil
 }
 
 func addServerHeaderMiddle(h http.Handler) http.Handler {
@@ -98,15 +227,113 @@ func addServerHeaderMiddle(h http.Handler) http.Handler {
 	})
 }
 
-func logerr(_ int, err error) {
-	if err != nil {
-		log.Printf("Write failed: %v", err)
+// requestRoute returns route template matched by request, or request path if no route is matched
+func requestRoute(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return routeLabel(template)
+		}
 	}
+	return r.URL.Path
 }
 
+// metricsMiddle records count, latency and response size of requests by route
+func (a *App) metricsMiddle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.metrics == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		route := requestRoute(r)
+		a.metrics.inFlight.add(1, route)
+		defer a.metrics.inFlight.add(-1, route)
+
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		a.metrics.requests.add(1, r.Method, route, strconv.Itoa(recorder.status))
+		a.metrics.requestDuration.observe(time.Since(started).Seconds(), r.Method, route)
+		a.metrics.responseSize.observe(float64(recorder.bytes), r.Method, route)
+	})
+}
+
+// accessLogMiddle logs every request with its route, status, response size and latency
+//
+// Errors responded with are added to the record, which is logged with warn level for client errors
+// and error level for server errors
+func accessLogMiddle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		fields := []interface{}{
+			"method", r.Method,
+			"route", requestRoute(r),
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"latency_ms", float64(time.Since(started).Microseconds()) / 1000,
+			"remote_addr", r.RemoteAddr,
+		}
+		log := requestLogger(r.Context())
+		if recorder.err != nil {
+			fields = append(fields, "error", recorder.err)
+		}
+		switch {
+		case recorder.status >= http.StatusInternalServerError:
+			log.Error("request", fields...)
+		case recorder.err != nil:
+			log.Warn("request", fields...)
+		default:
+			log.Info("request", fields...)
+		}
+	})
+}
+
+// HeaderReadFromPrimary forces reading from primary database instead of replicas if set to `true`
+const HeaderReadFromPrimary = "X-Read-From-Primary"
+
+func readPreferenceMiddle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primary, _ := strconv.ParseBool(r.Header.Get(HeaderReadFromPrimary)); primary {
+			r = r.WithContext(WithPrimaryRead(r.Context()))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeBody writes response body, failed write is reported to access log like response errors
+func writeBody(w http.ResponseWriter, body []byte) {
+	if _, err := w.Write(body); err != nil {
+		logResponseError(w, fmt.Errorf("write failed: %w", err))
+	}
+}
+
+// respondWithError responds with JSON error, the error is added to access log record
+//
+// Request ID is added to the response, so client can report it along with the error
 func respondWithError(w http.ResponseWriter, code int, err error) {
-	log.Print(err)
-	respondWithJSON(w, code, map[string]string{"error": err.Error()})
+	logResponseError(w, err)
+	body := map[string]string{"error": err.Error()}
+	if id := w.Header().Get(HeaderRequestID); id != "" {
+		body["request_id"] = id
+	}
+	respondWithJSON(w, code, body)
+}
+
+// logResponseError passes error to access log, it's logged immediately if access log is not used
+func logResponseError(w http.ResponseWriter, err error) {
+	if recorder, ok := w.(errorRecorder); ok {
+		recorder.recordError(err)
+		return
+	}
+	logger.Warn("Responding with error", "error", err)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -114,13 +341,105 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	logerr(w.Write(response))
+	writeBody(w, response)
+}
+
+// storeErrorCode selects response code for storage, patch and bulk errors
+func storeErrorCode(err error) int {
+	var schemaErr *SchemaError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrStoreUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrEntityTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrStoreFull), errors.Is(err, ErrTooManyCollections):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrCollectionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrCollectionExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidCollectionName), errors.Is(err, ErrDefaultCollection):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrCollectionsUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrUnsupportedPatch):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrInvalidPatch):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrPatchFailed):
+		return http.StatusConflict
+	case errors.Is(err, ErrPatchResult), errors.As(err, &schemaErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrEntityExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrBulkAborted):
+		return http.StatusFailedDependency
+	case errors.Is(err, ErrUnsupportedBulk):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrTooManyBulkItems), errors.Is(err, ErrBulkTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidBulkItem), errors.Is(err, ErrDuplicateBulkItem):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// respondWithStoreError responds with error returned by entity store
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		logResponseError(w, err)
+		body := map[string]interface{}{
+			"error":      "entity doesn't match collection schema",
+			"violations": schemaErr.Violations,
+		}
+		if id := w.Header().Get(HeaderRequestID); id != "" {
+			body["request_id"] = id
+		}
+		respondWithJSON(w, http.StatusUnprocessableEntity, body)
+		return
+	}
+	code := storeErrorCode(err)
+	if err == sql.ErrNoRows {
+		err = errors.New("entity not found")
+	}
+	respondWithError(w, code, err)
 }
 
 //Ok answer for root calls
 func (a *App) Ok(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
-	logerr(w.Write(randomByteSlice(10, "OK", "0123456789abcdef")))
+	writeBody(w, randomByteSlice(10, "OK", "0123456789abcdef"))
+}
+
+// Readiness responds with results of readiness checks, 503 is returned until all of them pass
+func (a *App) Readiness(w http.ResponseWriter, r *http.Request) {
+	report := a.CheckReadiness(r.Context())
+	code := http.StatusOK
+	if report.Status != StatusReady {
+		code = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, report)
+}
+
+// GetMetrics responds with metrics in Prometheus text format
+func (a *App) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if a.metrics != nil {
+		a.metrics.Write(&buf, a.Store)
+	}
+	w.Header().Set("Content-Type", MetricsContentType)
+	writeBody(w, buf.Bytes())
+}
+
+// GetSeedingStatus responds with progress of initial data loading
+func (a *App) GetSeedingStatus(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, a.seeding.Status())
 }
 
 //GetEntity by Uuid
@@ -128,14 +447,20 @@ func (a *App) GetEntity(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
 	e := Entity{Uuid: id}
-	if err := e.getEntity(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, errors.New("entity not found"))
-		default:
-			respondWithError(w, http.StatusInternalServerError, err)
-		}
+	if err := store.Get(r.Context(), &e); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	setCacheControl(w, a.cache.Entity)
+	setValidators(w, &e)
+	if notModified(r, &e) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 	respondWithJSON(w, http.StatusOK, e)
@@ -143,7 +468,7 @@ func (a *App) GetEntity(w http.ResponseWriter, r *http.Request) {
 
 const DefaultEntityListSize = 1000
 
-//GetEntities Return list of entities, 1000 by default
+//GetEntities Return page of entities, 1000 by default
 func (a *App) GetEntities(w http.ResponseWriter, r *http.Request) {
 	count := DefaultEntityListSize
 	cStr := r.URL.Query().Get("count")
@@ -154,67 +479,500 @@ func (a *App) GetEntities(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	filter := r.URL.Query().Get("filter")
-	entities, err := getEntities(a.DB, count, filter)
+	query := r.URL.Query()
+	filter, err := parseFilter(query)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts := ListOptions{
+		Count:  count,
+		Filter: *filter,
+		Sort:   query.Get("sort"),
+		Order:  query.Get("order"),
+		Cursor: query.Get("cursor"),
+	}
+	if err := opts.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	page, err := store.List(r.Context(), opts)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	setCacheControl(w, a.cache.Entities)
+	respondWithJSON(w, http.StatusOK, page)
+}
 
+// SearchEntities returns entities containing all words of `q` parameter, most relevant first
+func (a *App) SearchEntities(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		respondWithError(w, http.StatusBadRequest, errors.New("search query `q` is required"))
+		return
+	}
+	count, _ := strconv.Atoi(query.Get("count"))
+	if count < 1 {
+		count = DefaultEntityListSize
+	}
+
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	results, err := store.Search(r.Context(), q, count)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err)
+		respondWithStoreError(w, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, entities)
+	setCacheControl(w, a.cache.Entities)
+	respondWithJSON(w, http.StatusOK, map[string][]SearchResult{"results": results})
+}
+
+// parseFilter reads entity filter from `filter`, `match`, `ignore_case` and `uuid_prefix` query parameters
+func parseFilter(query url.Values) (*EntityFilter, error) {
+	filter := &EntityFilter{
+		Value:      query.Get("filter"),
+		Match:      query.Get("match"),
+		UUIDPrefix: query.Get("uuid_prefix"),
+	}
+	if ignoreCase := query.Get("ignore_case"); ignoreCase != "" {
+		var err error
+		if filter.IgnoreCase, err = strconv.ParseBool(ignoreCase); err != nil {
+			return nil, fmt.Errorf("invalid ignore_case value: %s", ignoreCase)
+		}
+	}
+	for _, where := range query["where"] {
+		condition, err := ParseFieldCondition(where)
+		if err != nil {
+			return nil, err
+		}
+		filter.Where = append(filter.Where, condition)
+	}
+	return filter, filter.Validate()
 }
 
 //CreateEntity - with guid generator for Uuid's
 func (a *App) CreateEntity(w http.ResponseWriter, r *http.Request) {
 	var e Entity
-	e.Uuid = uuid.NewV4().String()
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&e); err != nil {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &e)
+	}
+	if err != nil {
 		respondWithError(w, http.StatusBadRequest, errors.New("invalid request payload"))
 		return
 	}
 	defer func() { _ = r.Body.Close() }()
+	e.Uuid = uuid.NewV4().String()
 
-	if err := e.createEntity(a.DB); err != nil {
-		log.Print(err)
-		respondWithError(w, http.StatusInternalServerError, err)
+	if err := a.schemas.validatePayload(collectionName(r), body); err != nil {
+		respondWithStoreError(w, err)
 		return
 	}
 
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if err := store.Create(r.Context(), &e); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	setValidators(w, &e)
 	respondWithJSON(w, http.StatusCreated, e)
 }
 
-//UpdateEntity by Uuid
+//UpdateEntity by Uuid, `If-Match` header makes update conditional
 func (a *App) UpdateEntity(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	data := Entity{vars["id"], ""}
+	data := Entity{}
 
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&data); err != nil {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &data)
+	}
+	if err != nil {
 		respondWithError(w, http.StatusBadRequest, errors.New("invalid request payload"))
 		return
 	}
 	defer func() { _ = r.Body.Close() }()
+	data.Uuid = vars["id"]
 
-	if err := data.updateEntity(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err)
+	if err := a.schemas.validatePayload(collectionName(r), body); err != nil {
+		respondWithStoreError(w, err)
 		return
 	}
 
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	ifVersion, err := ifMatchVersion(r.Context(), r, store, data.Uuid)
+	if err == nil {
+		err = store.Update(r.Context(), &data, ifVersion)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	setValidators(w, &data)
 	respondWithJSON(w, http.StatusOK, data)
 }
 
-//DeleteEntity by Uuid
+//PatchEntity by Uuid using JSON merge patch or JSON patch, `If-Match` header makes patch conditional
+func (a *App) PatchEntity(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errors.New("invalid request payload"))
+		return
+	}
+	defer func() { _ = r.Body.Close() }()
+
+	patch, err := parsePatch(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		if errors.Is(err, ErrUnsupportedPatch) {
+			w.Header().Set("Accept-Patch", MergePatchType+", "+JSONPatchType)
+		}
+		respondWithStoreError(w, err)
+		return
+	}
+
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	e := Entity{Uuid: vars["id"]}
+	ifVersion, err := ifMatchVersion(r.Context(), r, store, e.Uuid)
+	if err == nil {
+		err = store.Modify(r.Context(), &e, ifVersion, func(e *Entity) error {
+			if err := patchEntity(e, patch); err != nil {
+				return err
+			}
+			return a.schemas.validateEntity(collectionName(r), e)
+		})
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	setValidators(w, &e)
+	respondWithJSON(w, http.StatusOK, e)
+}
+
+//DeleteEntity by Uuid, `If-Match` header makes deletion conditional
 func (a *App) DeleteEntity(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
 	e := Entity{Uuid: id}
-	if err := e.deleteEntity(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err)
+	ifVersion, err := ifMatchVersion(r.Context(), r, store, id)
+	if err == nil {
+		err = store.Delete(r.Context(), &e, ifVersion)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+//BulkCreateEntities creates entities given as JSON array or NDJSON, `upsert=true` replaces existing entities
+//
+// In atomic mode nothing is stored if any entity fails, in `best_effort` mode all valid entities are stored.
+// Response contains result of every entity
+func (a *App) BulkCreateEntities(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseBulkOptions(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	items, errs, err := readBulkItems(w, r)
+	defer func() { _ = r.Body.Close() }()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	collection := collectionName(r)
+	entities := make([]Entity, len(items))
+	uuids := make([]string, len(items))
+	seen := make(map[string]bool, len(items))
+	for i, item := range items {
+		if errs[i] == nil {
+			errs[i] = parseBulkEntity(item, &entities[i], seen)
+		}
+		if errs[i] == nil {
+			errs[i] = a.schemas.validatePayload(collection, item)
+		}
+		uuids[i] = entities[i].Uuid
+	}
+
+	if !opts.Atomic || !abortBulk(errs) {
+		var valid []int
+		var batch []Entity
+		for i := range entities {
+			if errs[i] == nil {
+				valid = append(valid, i)
+				batch = append(batch, entities[i])
+			}
+		}
+		store, err := a.entityStore(r)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		batchErrs, err := store.BulkCreate(r.Context(), batch, opts)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		for j, i := range valid {
+			entities[i], errs[i] = batch[j], batchErrs[j]
+		}
+		if opts.Atomic {
+			abortBulk(errs)
+		}
+	}
+
+	report := newBulkReport(opts, uuids, errs, func(i int) BulkResult {
+		status := http.StatusOK
+		if entities[i].Version == 1 {
+			status = http.StatusCreated
+		}
+		return BulkResult{Status: status, Version: entities[i].Version}
+	})
+	respondWithJSON(w, report.statusCode(), report)
+}
+
+//DeleteEntities removes entities listed in `ids` of request body or all entities matching filter parameters
+func (a *App) DeleteEntities(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts, err := parseBulkOptions(query)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	var request struct {
+		IDs []string `json:"ids"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		if err = json.Unmarshal(body, &request); err == nil && len(request.IDs) == 0 {
+			err = errors.New("ids must not be empty")
+		}
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Errorf("invalid request payload: %v", err))
+		return
+	}
+	defer func() { _ = r.Body.Close() }()
+
+	store, err := a.entityStore(r)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	if request.IDs == nil {
+		filter, err := parseFilter(query)
+		if err == nil && filter.Value == "" && filter.UUIDPrefix == "" && len(filter.Where) == 0 {
+			err = errors.New("ids or filter are required")
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err)
+			return
+		}
+		count, err := store.DeleteMatching(r.Context(), *filter)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]int64{"deleted": count})
+		return
+	}
+
+	if len(request.IDs) > MaxBulkItems {
+		respondWithStoreError(w, ErrTooManyBulkItems)
+		return
+	}
+	errs := make([]error, len(request.IDs))
+	var ids []string
+	var valid []int
+	seen := make(map[string]bool, len(request.IDs))
+	for i, id := range request.IDs {
+		if seen[id] {
+			errs[i] = ErrDuplicateBulkItem
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+		valid = append(valid, i)
+	}
+	if !opts.Atomic || !abortBulk(errs) {
+		batchErrs, err := store.BulkDelete(r.Context(), ids, opts)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		for j, i := range valid {
+			errs[i] = batchErrs[j]
+		}
+		if opts.Atomic {
+			abortBulk(errs)
+		}
+	}
+
+	report := newBulkReport(opts, request.IDs, errs, func(int) BulkResult {
+		return BulkResult{Status: http.StatusOK}
+	})
+	respondWithJSON(w, report.statusCode(), report)
+}
+
+func (a *App) collectionStore() (CollectionStore, error) {
+	collections, ok := a.Store.(CollectionStore)
+	if !ok {
+		return nil, ErrCollectionsUnsupported
+	}
+	return collections, nil
+}
+
+//GetCollections returns names of all collections
+func (a *App) GetCollections(w http.ResponseWriter, r *http.Request) {
+	collections, err := a.collectionStore()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	names, err := collections.Collections(r.Context())
+	if err != nil {
+		respondWithStoreError(w, err)
 		return
 	}
+	respondWithJSON(w, http.StatusOK, map[string][]string{"collections": names})
+}
 
+//CreateCollection with name given as `name` field of request body
+func (a *App) CreateCollection(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, errors.New("invalid request payload"))
+		return
+	}
+	defer func() { _ = r.Body.Close() }()
+
+	collections, err := a.collectionStore()
+	if err == nil {
+		err = collections.CreateCollection(r.Context(), body.Name)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, map[string]string{"name": body.Name})
+}
+
+//DropCollection with all its entities, schema set for the collection is removed
+func (a *App) DropCollection(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["collection"]
+	collections, err := a.collectionStore()
+	if err == nil {
+		err = collections.DropCollection(r.Context(), name)
+	}
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	a.schemas.reset(name)
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// loadSchema reads JSON Schema of collection from file
+func (a *App) loadSchema(collection string, path string) error {
+	if err := ValidateCollectionName(collection); err != nil {
+		return fmt.Errorf("schema of %s: %v", collection, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can't read schema of %s: %v", collection, err)
+	}
+	schema, err := ParseJSONSchema(data)
+	if err != nil {
+		return fmt.Errorf("schema of %s: %v", collection, err)
+	}
+	a.schemas.configure(collection, schema)
+	return nil
+}
+
+//GetSchema returns JSON Schema of collection entities
+func (a *App) GetSchema(w http.ResponseWriter, r *http.Request) {
+	schema := a.schemas.get(collectionName(r))
+	if schema == nil {
+		respondWithError(w, http.StatusNotFound, errors.New("collection has no schema"))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, schema)
+}
+
+//SetSchema replaces JSON Schema of existing collection entities, schema is not persisted
+func (a *App) SetSchema(w http.ResponseWriter, r *http.Request) {
+	name := collectionName(r)
+	if err := ValidateCollectionName(name); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if _, err := a.entityStore(r); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errors.New("invalid request payload"))
+		return
+	}
+	defer func() { _ = r.Body.Close() }()
+
+	schema, err := ParseJSONSchema(body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.schemas.set(name, schema)
+	respondWithJSON(w, http.StatusOK, schema)
+}
+
+//DeleteSchema disables validation of existing collection entities
+func (a *App) DeleteSchema(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.entityStore(r); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	a.schemas.set(collectionName(r), nil)
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
@@ -6,13 +6,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
 	"github.com/twinj/uuid"
@@ -25,8 +29,22 @@ type entity struct {
 	Data string
 }
 
+type entityPage struct {
+	Entities []*entity
+	Total    int
+	Next     string
+}
+
 func clearTable() {
-	main.FakeDataStorage = map[string]main.Entity{}
+	a.Store = main.NewFakeStore()
+}
+
+const adminToken = "test-admin-token"
+
+// asAdmin authorizes request to admin route
+func asAdmin(req *http.Request) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	return req
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
@@ -54,7 +72,7 @@ func addEntities(count int) {
 	}
 
 	for i := 0; i < count; i++ {
-		err := main.FakeNew(&main.Entity{
+		err := a.Store.Create(ctx, &main.Entity{
 			Uuid: uuid.NewV4().String(),
 			Data: "Data " + strconv.Itoa(i),
 		})
@@ -77,6 +95,7 @@ func TestMain(m *testing.M) {
 		}
 	}
 	config.Debug = true
+	config.Admin = &main.AdminConfig{Token: adminToken}
 	a.Initialize(config)
 
 	code := m.Run()
@@ -143,9 +162,10 @@ func TestApp_UpdateEntity(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/entities", nil)
 	response := executeRequest(req)
 
-	var originalEntity []*entity
-	var err = json.Unmarshal(response.Body.Bytes(), &originalEntity)
+	var page entityPage
+	var err = json.Unmarshal(response.Body.Bytes(), &page)
 	checkErr(err)
+	originalEntity := page.Entities
 
 	single := *originalEntity[0]
 	payload := []byte(`{"data": "test data - updated"}`)
@@ -176,9 +196,10 @@ func TestApp_DeleteEntity(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/entities", nil)
 	response := executeRequest(req)
 
-	var originalEntity []*entity
-	var err = json.Unmarshal(response.Body.Bytes(), &originalEntity)
+	var page entityPage
+	var err = json.Unmarshal(response.Body.Bytes(), &page)
 	checkErr(err)
+	originalEntity := page.Entities
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
@@ -194,6 +215,314 @@ func TestApp_DeleteEntity(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
+func TestApp_ConditionalUpdate(t *testing.T) {
+	clearTable()
+	e := &main.Entity{Uuid: uuid.NewV4().String(), Data: "original"}
+	checkErr(a.Store.Create(ctx, e))
+	route := fmt.Sprintf("/entity/%s", e.Uuid)
+
+	req, _ := http.NewRequest("GET", route, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	etag := response.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("Expected ETag \"1\", got %s", etag)
+	}
+
+	req, _ = http.NewRequest("PUT", route, bytes.NewBufferString(`{"data": "first"}`))
+	req.Header.Set("If-Match", etag)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if newTag := response.Header().Get("ETag"); newTag != `"2"` {
+		t.Errorf("Expected ETag \"2\" after update, got %s", newTag)
+	}
+
+	// stale version is rejected
+	req, _ = http.NewRequest("PUT", route, bytes.NewBufferString(`{"data": "second"}`))
+	req.Header.Set("If-Match", etag)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusPreconditionFailed, response.Code)
+
+	req, _ = http.NewRequest("DELETE", route, nil)
+	req.Header.Set("If-Match", etag)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusPreconditionFailed, response.Code)
+
+	stored := &main.Entity{Uuid: e.Uuid}
+	checkErr(a.Store.Get(ctx, stored))
+	if stored.Data != "first" {
+		t.Errorf("Expected data to stay 'first', got '%s'", stored.Data)
+	}
+
+	req, _ = http.NewRequest("DELETE", route, nil)
+	req.Header.Set("If-Match", `"1", "2"`)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestApp_MissingEntityModification(t *testing.T) {
+	clearTable()
+	route := fmt.Sprintf("/entity/%s", uuid.NewV4())
+
+	req, _ := http.NewRequest("PUT", route, bytes.NewBufferString(`{"data": "data"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("DELETE", route, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestApp_ConditionalGet(t *testing.T) {
+	clearTable()
+	e := &main.Entity{Uuid: uuid.NewV4().String(), Data: "cached"}
+	checkErr(a.Store.Create(ctx, e))
+	route := fmt.Sprintf("/entity/%s", e.Uuid)
+
+	req, _ := http.NewRequest("GET", route, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	etag := response.Header().Get("ETag")
+	lastModified := response.Header().Get("Last-Modified")
+	if _, err := http.ParseTime(lastModified); err != nil {
+		t.Fatalf("Invalid Last-Modified header: %s", lastModified)
+	}
+
+	cases := map[string]struct {
+		header string
+		value  string
+		code   int
+	}{
+		"Same ETag":          {"If-None-Match", etag, http.StatusNotModified},
+		"Weak ETag":          {"If-None-Match", "W/" + etag, http.StatusNotModified},
+		"Any ETag":           {"If-None-Match", "*", http.StatusNotModified},
+		"Other ETag":         {"If-None-Match", `"0"`, http.StatusOK},
+		"Not modified since": {"If-Modified-Since", lastModified, http.StatusNotModified},
+		"Modified since": {
+			"If-Modified-Since", e.UpdatedAt.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", route, nil)
+			req.Header.Set(c.header, c.value)
+			response := executeRequest(req)
+			checkResponseCode(t, c.code, response.Code)
+			if c.code == http.StatusNotModified && response.Body.Len() != 0 {
+				t.Errorf("Expected empty body of 304 response, got %s", response.Body.String())
+			}
+		})
+	}
+}
+
+func TestApp_PatchEntity(t *testing.T) {
+	clearTable()
+	e := &main.Entity{Uuid: uuid.NewV4().String(), Data: "original"}
+	checkErr(a.Store.Create(ctx, e))
+	route := fmt.Sprintf("/entity/%s", e.Uuid)
+
+	cases := []struct {
+		name        string
+		contentType string
+		patch       string
+		code        int
+		data        string
+	}{
+		{"Merge patch", main.MergePatchType, `{"data": "merged"}`, http.StatusOK, "merged"},
+		{"Merge patch ignoring missing fields", main.MergePatchType, `{}`, http.StatusOK, "merged"},
+		{"JSON patch", main.JSONPatchType,
+			`[{"op": "test", "path": "/data", "value": "merged"}, {"op": "replace", "path": "/data", "value": "patched"}]`,
+			http.StatusOK, "patched"},
+		{"Failed test", main.JSONPatchType,
+			`[{"op": "test", "path": "/data", "value": "merged"}, {"op": "replace", "path": "/data", "value": "x"}]`,
+			http.StatusConflict, "patched"},
+		{"Missing path", main.JSONPatchType, `[{"op": "remove", "path": "/missing"}]`, http.StatusConflict, "patched"},
+		{"Unknown operation", main.JSONPatchType, `[{"op": "drop", "path": "/data"}]`, http.StatusBadRequest, "patched"},
+		{"Invalid document", main.MergePatchType, `{"data": `, http.StatusBadRequest, "patched"},
+		{"Read-only field", main.MergePatchType, `{"uuid": "other"}`, http.StatusUnprocessableEntity, "patched"},
+		{"Unknown field", main.JSONPatchType, `[{"op": "add", "path": "/extra", "value": 1}]`,
+			http.StatusUnprocessableEntity, "patched"},
+		{"Unsupported type", "application/json", `{"data": "json"}`, http.StatusUnsupportedMediaType, "patched"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest("PATCH", route, bytes.NewBufferString(c.patch))
+			req.Header.Set("Content-Type", c.contentType)
+			response := executeRequest(req)
+			checkResponseCode(t, c.code, response.Code)
+
+			stored := &main.Entity{Uuid: e.Uuid}
+			checkErr(a.Store.Get(ctx, stored))
+			if stored.Data != c.data {
+				t.Errorf("Expected data '%s', got '%s'", c.data, stored.Data)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest("PATCH", route, bytes.NewBufferString(`{"data": "stale"}`))
+	req.Header.Set("Content-Type", main.MergePatchType)
+	req.Header.Set("If-Match", `"1"`)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusPreconditionFailed, response.Code)
+
+	req, _ = http.NewRequest("PATCH", fmt.Sprintf("/entity/%s", uuid.NewV4()), bytes.NewBufferString(`{}`))
+	req.Header.Set("Content-Type", main.MergePatchType)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestApp_Collections(t *testing.T) {
+	clearTable()
+	addEntities(1)
+
+	req, _ := http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "suite_one"}`))
+	response := executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "suite_one"}`))
+	response = executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "Drop Table"}`))
+	response = executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	// collection isn't created on demand
+	req, _ = http.NewRequest("POST", "/collections/suite_two/entity", bytes.NewBufferString(`{"data": "two"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+	req, _ = http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "suite_two"}`))
+	checkResponseCode(t, http.StatusCreated, executeRequest(asAdmin(req)).Code)
+	req, _ = http.NewRequest("POST", "/collections/suite_two/entity", bytes.NewBufferString(`{"data": "two"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created entity
+	checkErr(json.Unmarshal(response.Body.Bytes(), &created))
+
+	req, _ = http.NewRequest("GET", "/collections", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var collections map[string][]string
+	checkErr(json.Unmarshal(response.Body.Bytes(), &collections))
+	if strings.Join(collections["collections"], ",") != "entity,suite_one,suite_two" {
+		t.Errorf("Unexpected collections: %v", collections["collections"])
+	}
+
+	totals := map[string]int{
+		"/entities":                         1,
+		"/collections/entity/entities":      1,
+		"/collections/suite_one/entities":   0,
+		"/collections/suite_two/entities":   1,
+		"/collections/suite_three/entities": -1,
+	}
+	for route, total := range totals {
+		req, _ = http.NewRequest("GET", route, nil)
+		response = executeRequest(req)
+		if total < 0 {
+			checkResponseCode(t, http.StatusNotFound, response.Code)
+			continue
+		}
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var page entityPage
+		checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+		if page.Total != total {
+			t.Errorf("Expected %d entities at %s, got %d", total, route, page.Total)
+		}
+	}
+
+	entityRoute := "/collections/suite_two/entity/" + created.Uuid
+	req, _ = http.NewRequest("GET", entityRoute, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	req, _ = http.NewRequest("GET", "/entity/"+created.Uuid, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/collections/entity", nil)
+	response = executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/collections/suite_two", nil)
+	response = executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	req, _ = http.NewRequest("GET", entityRoute, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestApp_CollectionSchema(t *testing.T) {
+	clearTable()
+	schema := `{"type": "object", "additionalProperties": false, "required": ["document"],
+		"properties": {"data": {"type": "string"}, "document": {"type": "object", "required": ["status"]}}}`
+	req, _ := http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "validated"}`))
+	executeRequest(asAdmin(req))
+	req, _ = http.NewRequest("PUT", "/collections/validated/schema", bytes.NewBufferString(schema))
+	response := executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	defer func() {
+		req, _ := http.NewRequest("DELETE", "/collections/validated", nil)
+		executeRequest(asAdmin(req))
+	}()
+
+	req, _ = http.NewRequest("PUT", "/collections/validated/schema", bytes.NewBufferString(`{"type": 1}`))
+	response = executeRequest(asAdmin(req))
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("POST", "/collections/validated/entity", bytes.NewBufferString(`{"data": "x", "extra": 1}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	var body struct {
+		Error      string
+		Violations []main.SchemaViolation
+	}
+	checkErr(json.Unmarshal(response.Body.Bytes(), &body))
+	if len(body.Violations) != 2 || body.Violations[0].Path != "/" || body.Violations[1].Path != "/extra" {
+		t.Errorf("Unexpected violations: %v", body.Violations)
+	}
+
+	req, _ = http.NewRequest("POST", "/collections/validated/entity",
+		bytes.NewBufferString(`{"data": "x", "document": {"status": "new"}}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created entity
+	checkErr(json.Unmarshal(response.Body.Bytes(), &created))
+	route := "/collections/validated/entity/" + created.Uuid
+
+	req, _ = http.NewRequest("PUT", route, bytes.NewBufferString(`{"data": "x", "document": {}}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("PATCH", route, bytes.NewBufferString(`{"document": {"status": null}}`))
+	req.Header.Set("Content-Type", main.MergePatchType)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("PATCH", route, bytes.NewBufferString(`{"document": {"status": "old"}}`))
+	req.Header.Set("Content-Type", main.MergePatchType)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// other collections are not validated
+	req, _ = http.NewRequest("POST", "/entity", bytes.NewBufferString(`{"data": "x", "extra": 1}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/collections/missing/schema", bytes.NewBufferString(schema))
+	checkResponseCode(t, http.StatusNotFound, executeRequest(asAdmin(req)).Code)
+	req, _ = http.NewRequest("GET", "/collections/missing/schema", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	// recreated collection doesn't inherit schema of the dropped one
+	req, _ = http.NewRequest("DELETE", "/collections/validated", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(asAdmin(req)).Code)
+	req, _ = http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "validated"}`))
+	checkResponseCode(t, http.StatusCreated, executeRequest(asAdmin(req)).Code)
+	req, _ = http.NewRequest("GET", "/collections/validated/schema", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	req, _ = http.NewRequest("POST", "/collections/validated/entity", bytes.NewBufferString(`{"data": "x", "extra": 1}`))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+}
+
 func TestApp_BulkDataGeneration(t *testing.T) {
 	count := 10000
 	size := 13
@@ -218,7 +547,7 @@ func addSomeEntity(data ...string) error {
 		dataS = main.RandomString(15, "MYDATA", okSet)
 	}
 
-	return main.FakeNew(&main.Entity{
+	return a.Store.Create(ctx, &main.Entity{
 		Uuid: uuid.NewV4().String(),
 		Data: dataS,
 	})
@@ -232,8 +561,9 @@ func TestApp_GetEntitiesCount(t *testing.T) {
 	randCount := rand.Intn(max) + 1
 	r, _ := http.NewRequest("GET", fmt.Sprintf("/entities?count=%d", randCount), nil)
 	response := executeRequest(r)
-	var entities []*entity
-	_ = json.Unmarshal(response.Body.Bytes(), &entities)
+	var page entityPage
+	_ = json.Unmarshal(response.Body.Bytes(), &page)
+	entities := page.Entities
 	if len(entities) != randCount {
 		t.Error("Count is not limiting GetEntities")
 	}
@@ -249,9 +579,10 @@ func TestApp_GetEntitiesFilter(t *testing.T) {
 	addEntities(max)
 	r, _ := http.NewRequest("GET", fmt.Sprintf("/entities?filter=%s*", prefix), nil)
 	response := executeRequest(r)
-	var entities []*entity
+	var page entityPage
 	bts := response.Body.Bytes()
-	_ = json.Unmarshal(bts, &entities)
+	_ = json.Unmarshal(bts, &page)
+	entities := page.Entities
 	if len(entities) != max {
 		t.Error("Filter is not limiting GetEntities")
 	}
@@ -261,6 +592,329 @@ func TestApp_GetEntitiesFilter(t *testing.T) {
 		}
 	}
 }
+func TestApp_GetEntitiesPagination(t *testing.T) {
+	for _, sorting := range []string{"uuid", "data"} {
+		for _, order := range []string{"asc", "desc"} {
+			t.Run(sorting+" "+order, func(t *testing.T) {
+				clearTable()
+				total := 25
+				addEntities(total)
+
+				seen := map[string]bool{}
+				var previous *entity
+				next := ""
+				for pages := 0; pages == 0 || next != ""; pages++ {
+					if pages > total {
+						t.Fatal("Pagination doesn't end")
+					}
+					url := fmt.Sprintf("/entities?count=10&sort=%s&order=%s&cursor=%s", sorting, order, next)
+					r, _ := http.NewRequest("GET", url, nil)
+					response := executeRequest(r)
+					checkResponseCode(t, http.StatusOK, response.Code)
+					var page entityPage
+					checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+					if page.Total != total {
+						t.Errorf("Expected total %d, got %d", total, page.Total)
+					}
+					for _, ent := range page.Entities {
+						if seen[ent.Uuid] {
+							t.Errorf("Entity %s is returned twice", ent.Uuid)
+						}
+						seen[ent.Uuid] = true
+						if previous != nil {
+							prevKey, key := previous.Uuid, ent.Uuid
+							if sorting == "data" {
+								prevKey, key = previous.Data, ent.Data
+							}
+							if (order == "asc" && prevKey > key) || (order == "desc" && prevKey < key) {
+								t.Errorf("Entities are not sorted by %s %s: %s before %s", sorting, order, prevKey, key)
+							}
+						}
+						previous = ent
+					}
+					next = page.Next
+				}
+				if len(seen) != total {
+					t.Errorf("Expected %d entities walking all pages, got %d", total, len(seen))
+				}
+			})
+		}
+	}
+}
+
+func TestApp_GetEntitiesLargeDataCursor(t *testing.T) {
+	clearTable()
+	prefix := strings.Repeat("x", 20000)
+	for _, suffix := range []string{"a", "b", "c", "d", "e"} {
+		checkErr(addSomeEntity(prefix + suffix))
+	}
+
+	getPage := func(cursor string) entityPage {
+		r, _ := http.NewRequest("GET", "/entities?count=2&sort=data&cursor="+cursor, nil)
+		response := executeRequest(r)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var page entityPage
+		checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+		return page
+	}
+	suffixes := func(page entityPage) (result string) {
+		for _, ent := range page.Entities {
+			result += strings.TrimPrefix(ent.Data, prefix)
+		}
+		return
+	}
+
+	first := getPage("")
+	if len(first.Next) > 1024 {
+		t.Errorf("Cursor of large data is too long: %d bytes", len(first.Next))
+	}
+	second := getPage(first.Next)
+	if suffixes(first)+suffixes(second) != "abcd" {
+		t.Errorf("Unexpected pages %q and %q", suffixes(first), suffixes(second))
+	}
+
+	// cursor entity is removed, so pages start after the cut key: entities may repeat, but none is skipped
+	checkErr(a.Store.Delete(ctx, &main.Entity{Uuid: second.Entities[1].Uuid}, 0))
+	rest := ""
+	for next, pages := second.Next, 0; next != "" && pages < 5; pages++ {
+		page := getPage(next)
+		rest += suffixes(page)
+		next = page.Next
+	}
+	if !strings.HasSuffix(rest, "ce") {
+		t.Errorf("Unexpected pages after removed cursor entity: %q", rest)
+	}
+}
+
+func TestApp_GetEntitiesInvalidCursor(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/entities?cursor=invalid", nil)
+	response := executeRequest(r)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestApp_GetEntitiesFilterModes(t *testing.T) {
+	clearTable()
+	for _, data := range []string{"Alpha beta", "alpha_gamma", "beta alpha", "50% done", "ALPHA"} {
+		checkErr(addSomeEntity(data))
+	}
+	cases := map[string]int{
+		"filter=alpha*":                              1,
+		"filter=alpha*&ignore_case=true":             3,
+		"filter=alpha&match=prefix":                  1,
+		"filter=alpha&match=prefix&ignore_case=1":    3,
+		"filter=alpha&match=suffix":                  1,
+		"filter=alpha&match=contains":                2,
+		"filter=ALPHA&match=exact":                   1,
+		"filter=alpha&match=exact&ignore_case=true":  1,
+		"filter=_&match=contains":                    1,
+		"filter=%25&match=contains":                  1,
+		"filter=%25":                                 0,
+		"filter=^[ab][a-z]%2B &match=regex":          1,
+		"filter=^a.*a$&match=regex&ignore_case=true": 3,
+	}
+	for query, expected := range cases {
+		t.Run(query, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/entities?"+query, nil)
+			response := executeRequest(r)
+			checkResponseCode(t, http.StatusOK, response.Code)
+			var page entityPage
+			checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+			if len(page.Entities) != expected {
+				t.Errorf("Expected %d entities, got %d", expected, len(page.Entities))
+			}
+		})
+	}
+	for _, query := range []string{"ignore_case=yes", "match=glob", "filter=[a-&match=regex"} {
+		r, _ := http.NewRequest("GET", "/entities?"+query, nil)
+		response := executeRequest(r)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+func TestApp_GetEntitiesUUIDPrefix(t *testing.T) {
+	clearTable()
+	addEntities(20)
+	r, _ := http.NewRequest("GET", "/entities?count=1", nil)
+	response := executeRequest(r)
+	var page entityPage
+	checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+	prefix := page.Entities[0].Uuid[:8]
+
+	r, _ = http.NewRequest("GET", "/entities?uuid_prefix="+prefix, nil)
+	response = executeRequest(r)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+	if len(page.Entities) != 1 || !strings.HasPrefix(page.Entities[0].Uuid, prefix) {
+		t.Errorf("Expected single entity with uuid prefix %s, got %v", prefix, page.Entities)
+	}
+
+	r, _ = http.NewRequest("GET", "/entities?uuid_prefix=xyz'", nil)
+	response = executeRequest(r)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+type searchResult struct {
+	Uuid string
+	Data string
+	Rank float64
+}
+
+type searchResults struct {
+	Results []searchResult
+}
+
+// TestApp_GetEntitiesWhere checks field conditions on every backend without PostgreSQL,
+// expected results follow semantics of PostgreSQL JSONB operators
+func TestApp_GetEntitiesWhere(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+	fileStore, err := main.NewFileStore(cfg)
+	checkErr(err)
+	defer func() { _ = fileStore.Close() }()
+	stores := map[string]main.EntityStore{"memory": main.NewFakeStore(), "file": fileStore}
+	defer clearTable()
+
+	documents := []string{
+		`{"status": "active", "count": 5, "tags": ["a", "b"]}`,
+		`{"status": "active", "count": 15, "owner": {"name": "bob"}}`,
+		`{"status": "disabled", "count": 10.5, "owner": null}`,
+		`{"status": 1, "big": 9007199254740993}`,
+		``,
+	}
+	cases := map[string]int{
+		"status:eq:active":                  2,
+		`status:eq:"active"`:                2,
+		"status:eq:1":                       1,
+		"status:ne:active":                  3,
+		"count:gt:5":                        2,
+		"count:gte:5":                       3,
+		"count:lt:10.5":                     1,
+		"count:lte:1e2":                     3,
+		"count:eq:5.0":                      1,
+		"status:lt:b":                       2,
+		"owner:exists":                      2,
+		"owner.name:eq:bob":                 1,
+		"tags.1:eq:b":                       1,
+		"tags.-1:eq:b":                      1,
+		"tags.-2:eq:a":                      1,
+		"tags.-3:exists":                    0,
+		"tags.x:exists":                     0,
+		"missing:exists":                    0,
+		"status:eq:active&where=count:gt:6": 1,
+		// numbers are compared exactly, both for equality and ordering
+		"big:eq:9007199254740993":     1,
+		"big:eq:9.007199254740993e15": 1,
+		"big:eq:9007199254740992":     0,
+		"big:ne:9007199254740992":     5,
+		"big:gt:9007199254740992":     1,
+		"big:lte:9007199254740992":    0,
+	}
+	for backend, store := range stores {
+		a.Store = store
+		for _, doc := range documents {
+			checkErr(a.Store.Create(ctx, &main.Entity{
+				Uuid: uuid.NewV4().String(), Data: "data", Document: json.RawMessage(doc),
+			}))
+		}
+		for where, expected := range cases {
+			t.Run(backend+" "+where, func(t *testing.T) {
+				r, _ := http.NewRequest("GET", "/entities?where="+where, nil)
+				response := executeRequest(r)
+				checkResponseCode(t, http.StatusOK, response.Code)
+				var page entityPage
+				checkErr(json.Unmarshal(response.Body.Bytes(), &page))
+				if page.Total != expected {
+					t.Errorf("Expected %d entities, got %d", expected, page.Total)
+				}
+			})
+		}
+	}
+
+	for _, where := range []string{"status", "status:like:a", "count:gt:true", "status:eq", ":eq:a", "a..b:exists"} {
+		r, _ := http.NewRequest("GET", "/entities?where="+where, nil)
+		response := executeRequest(r)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code 400 for %s, got %d", where, response.Code)
+		}
+	}
+}
+
+func TestApp_SearchEntities(t *testing.T) {
+	clearTable()
+	for _, data := range []string{"quick brown fox", "Lazy dog, quick fox! Fox?", "brown dog", "quick-brown"} {
+		checkErr(addSomeEntity(data))
+	}
+	cases := map[string][]string{
+		"fox":            {"Lazy dog, quick fox! Fox?", "quick brown fox"},
+		"QUICK brown":    {"quick brown fox", "quick-brown"},
+		"dog&count=1":    nil,
+		"cat":            {},
+		"brown+dog+fox?": {},
+	}
+	for query, expected := range cases {
+		t.Run(query, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/entities/search?q="+query, nil)
+			response := executeRequest(r)
+			checkResponseCode(t, http.StatusOK, response.Code)
+			var res searchResults
+			checkErr(json.Unmarshal(response.Body.Bytes(), &res))
+			if expected == nil {
+				if len(res.Results) != 1 {
+					t.Errorf("Expected single result, got %d", len(res.Results))
+				}
+				return
+			}
+			found := make([]string, 0, len(res.Results))
+			for i, r := range res.Results {
+				found = append(found, r.Data)
+				if i > 0 && res.Results[i-1].Rank < r.Rank {
+					t.Errorf("Results are not sorted by rank: %v", res.Results)
+				}
+			}
+			sort.Strings(found)
+			sort.Strings(expected)
+			if strings.Join(found, "|") != strings.Join(expected, "|") {
+				t.Errorf("Expected %v, got %v", expected, found)
+			}
+		})
+	}
+
+	r, _ := http.NewRequest("GET", "/entities/search", nil)
+	response := executeRequest(r)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestApp_SearchRanking(t *testing.T) {
+	clearTable()
+	for _, data := range []string{"quick brown fox", "fox and fox", "quick red brown dog", "brown dog and quick"} {
+		checkErr(addSomeEntity(data))
+	}
+	// ranks returned by PostgreSQL ts_rank for the same data
+	cases := map[string][]searchResult{
+		"fox": {{Data: "fox and fox", Rank: 0.0759909}, {Data: "quick brown fox", Rank: 0.0607927}},
+		"quick brown": {
+			{Data: "quick brown fox", Rank: 0.0991032},
+			{Data: "quick red brown dog", Rank: 0.0985009},
+			{Data: "brown dog and quick", Rank: 0.0973585},
+		},
+	}
+	for query, expected := range cases {
+		r, _ := http.NewRequest("GET", "/entities/search?q="+url.QueryEscape(query), nil)
+		response := executeRequest(r)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var res searchResults
+		checkErr(json.Unmarshal(response.Body.Bytes(), &res))
+		if len(res.Results) != len(expected) {
+			t.Fatalf("Expected %d results of %q, got %v", len(expected), query, res.Results)
+		}
+		for i, result := range res.Results {
+			if result.Data != expected[i].Data || math.Abs(result.Rank-expected[i].Rank) > 1e-6 {
+				t.Errorf("Expected result %d of %q to be %+v, got %+v", i, query, expected[i], result)
+			}
+		}
+	}
+}
+
 func prepareDebugConfigToFile(path string, data []byte) {
 	err := ioutil.WriteFile(path, data, 0644)
 	checkErr(err)
@@ -281,7 +935,7 @@ func TestApp_InitializeWithDebug(t *testing.T) {
 			prepareDebugConfigToFile(path, data)
 			config, err := main.LoadConfiguration(path)
 			checkErr(err)
-			if b.DB != nil {
+			if b.Store != nil {
 				t.Error("Database is used with debug = True")
 			}
 			b.Initialize(config) // check that there is no exception
@@ -289,3 +943,384 @@ func TestApp_InitializeWithDebug(t *testing.T) {
 		})
 	}
 }
+
+func TestApp_DegradedStart(t *testing.T) {
+	b := main.App{}
+	config := &main.Configuration{
+		Postgres: &main.PostgresConfig{
+			DbURL:         "localhost:1",
+			Database:      "entities",
+			RetryInterval: time.Hour,
+			DegradedStart: true,
+		},
+	}
+	if err := b.Initialize(config); err != nil {
+		t.Fatalf("Server is not started in degraded mode: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusServiceUnavailable, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/entities", nil)
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusServiceUnavailable, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+}
+
+func TestApp_CacheControl(t *testing.T) {
+	b := main.App{}
+	config := &main.Configuration{
+		Debug: true,
+		Cache: &main.CacheConfig{Entity: "public, max-age=60", Entities: "no-cache"},
+	}
+	checkErr(b.Initialize(config))
+	b.DataGenerationWg.Wait()
+	e := &main.Entity{Uuid: uuid.NewV4().String(), Data: "cached"}
+	checkErr(b.Store.Create(ctx, e))
+
+	expected := map[string]string{
+		"/entity/" + e.Uuid: "public, max-age=60",
+		"/entities":         "no-cache",
+	}
+	for route, value := range expected {
+		req, _ := http.NewRequest("GET", route, nil)
+		rr := httptest.NewRecorder()
+		b.Router.ServeHTTP(rr, req)
+		checkResponseCode(t, http.StatusOK, rr.Code)
+		if actual := rr.Header().Get("Cache-Control"); actual != value {
+			t.Errorf("Expected Cache-Control of %s to be '%s', got '%s'", route, value, actual)
+		}
+	}
+}
+
+type bulkReport struct {
+	Mode      string
+	Succeeded int
+	Failed    int
+	Results   []struct {
+		Index   int
+		Uuid    string
+		Status  int
+		Version int64
+		Error   string
+	}
+}
+
+func executeBulkRequest(t *testing.T, method, route, contentType, body string, expected int) bulkReport {
+	req, _ := http.NewRequest(method, route, bytes.NewBufferString(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, expected, response.Code)
+	var report bulkReport
+	checkErr(json.Unmarshal(response.Body.Bytes(), &report))
+	return report
+}
+
+func TestApp_BulkCreateEntities(t *testing.T) {
+	clearTable()
+	existing := uuid.NewV4().String()
+	checkErr(a.Store.Create(ctx, &main.Entity{Uuid: existing, Data: "existing"}))
+
+	body := fmt.Sprintf(`[{"data": "one"}, {"uuid": "%s", "data": "two"}]`, existing)
+	report := executeBulkRequest(t, "POST", "/entities/bulk", "", body, http.StatusMultiStatus)
+	statuses := []int{http.StatusFailedDependency, http.StatusConflict}
+	for i, result := range report.Results {
+		if result.Status != statuses[i] {
+			t.Errorf("Expected status %d of item %d, got %+v", statuses[i], i, result)
+		}
+	}
+	page, _ := a.Store.List(ctx, main.ListOptions{})
+	if report.Mode != main.BulkAtomic || report.Failed != 2 || page.Total != 1 {
+		t.Errorf("Failed atomic bulk request changed store: %+v, %d entities", report, page.Total)
+	}
+
+	body = fmt.Sprintf("{\"data\": \"one\"}\n\n{\"uuid\": \"%s\", \"data\": \"two\"}\nnot json\n", existing)
+	report = executeBulkRequest(t, "POST", "/entities/bulk?mode=best_effort&upsert=true", main.NDJSONType, body,
+		http.StatusMultiStatus)
+	statuses = []int{http.StatusCreated, http.StatusOK, http.StatusBadRequest}
+	for i, result := range report.Results {
+		if result.Status != statuses[i] {
+			t.Errorf("Expected status %d of item %d, got %+v", statuses[i], i, result)
+		}
+	}
+	stored := &main.Entity{Uuid: existing}
+	checkErr(a.Store.Get(ctx, stored))
+	if report.Succeeded != 2 || stored.Data != "two" || stored.Version != 2 || report.Results[1].Version != 2 {
+		t.Errorf("Unexpected best-effort bulk result: %+v, stored %+v", report, stored)
+	}
+
+	body = `[{"data": "a"}, {"data": "b"}]`
+	req, _ := http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "bulk_suite"}`))
+	executeRequest(asAdmin(req))
+	report = executeBulkRequest(t, "POST", "/collections/bulk_suite/entities/bulk", "application/json", body,
+		http.StatusOK)
+	if report.Succeeded != 2 || report.Results[0].Uuid == "" {
+		t.Errorf("Unexpected bulk result: %+v", report)
+	}
+
+	req, _ = http.NewRequest("POST", "/entities/bulk", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "text/plain")
+	checkResponseCode(t, http.StatusUnsupportedMediaType, executeRequest(req).Code)
+	req, _ = http.NewRequest("POST", "/entities/bulk?mode=all", bytes.NewBufferString(body))
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+func TestApp_BulkRequestLimits(t *testing.T) {
+	clearTable()
+
+	// reading stops at the first item over the limit, so invalid tail isn't reached
+	body := "[" + strings.Repeat(`{"data": "x"}, `, main.MaxBulkItems+1) + "not json"
+	req, _ := http.NewRequest("POST", "/entities/bulk", strings.NewReader(body))
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, executeRequest(req).Code)
+
+	item := `{"data": "` + strings.Repeat("x", 1<<20) + `"}`
+	bodies := map[string]string{
+		"application/json": "[" + strings.Repeat(item+",", main.MaxBulkBodySize>>20) + item + "]",
+		main.NDJSONType:    strings.Repeat(item+"\n", main.MaxBulkBodySize>>20+1),
+	}
+	for contentType, body := range bodies {
+		req, _ = http.NewRequest("POST", "/entities/bulk", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		checkResponseCode(t, http.StatusRequestEntityTooLarge, executeRequest(req).Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/entities/bulk", strings.NewReader(`{"data": "x"}`))
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+	page, _ := a.Store.List(ctx, main.ListOptions{})
+	if page.Total != 0 {
+		t.Errorf("Rejected bulk requests changed store: %d entities", page.Total)
+	}
+}
+
+func TestApp_DeleteEntities(t *testing.T) {
+	clearTable()
+	for _, data := range []string{"keep 1", "drop 1", "drop 2", "keep 2"} {
+		checkErr(addSomeEntity(data))
+	}
+	page, _ := a.Store.List(ctx, main.ListOptions{Filter: main.EntityFilter{Value: "keep*"}})
+	missing := uuid.NewV4().String()
+
+	req, _ := http.NewRequest("DELETE", "/entities", http.NoBody)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("DELETE", "/entities?filter=drop*", http.NoBody)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var deleted map[string]int
+	checkErr(json.Unmarshal(response.Body.Bytes(), &deleted))
+	if deleted["deleted"] != 2 {
+		t.Errorf("Expected 2 deleted entities, got %v", deleted)
+	}
+
+	body := fmt.Sprintf(`{"ids": ["%s", "%s"]}`, page.Entities[0].Uuid, missing)
+	report := executeBulkRequest(t, "DELETE", "/entities", "", body, http.StatusMultiStatus)
+	if report.Results[0].Status != http.StatusFailedDependency || report.Results[1].Status != http.StatusNotFound {
+		t.Errorf("Unexpected atomic bulk delete result: %+v", report)
+	}
+
+	report = executeBulkRequest(t, "DELETE", "/entities?mode=best_effort", "", body, http.StatusMultiStatus)
+	if report.Results[0].Status != http.StatusOK || report.Results[1].Status != http.StatusNotFound {
+		t.Errorf("Unexpected best-effort bulk delete result: %+v", report)
+	}
+	page, _ = a.Store.List(ctx, main.ListOptions{})
+	if page.Total != 1 {
+		t.Errorf("Expected 1 entity left, got %d", page.Total)
+	}
+}
+
+func TestApp_DebugSeeding(t *testing.T) {
+	b := main.App{}
+	config := &main.Configuration{
+		Debug:   true,
+		Initial: &main.InitialData{Count: 50, Size: 20, ChunkSize: 10, Seed: 7, WaitForSeeding: true},
+		Admin:   &main.AdminConfig{Token: adminToken},
+	}
+	checkErr(b.Initialize(config))
+	b.DataGenerationWg.Wait()
+
+	req, _ := http.NewRequest("GET", "/admin/seed", nil)
+	rr := httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, asAdmin(req))
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	var status main.SeedingStatus
+	checkErr(json.Unmarshal(rr.Body.Bytes(), &status))
+	if status.State != main.SeedingDone || status.Generated != 50 || status.Inserted != 50 || status.Seed != 7 {
+		t.Errorf("Unexpected seeding status: %+v", status)
+	}
+	page, _ := b.Store.List(ctx, main.ListOptions{})
+	if page.Total != 50 {
+		t.Errorf("Expected 50 initial entities, got %d", page.Total)
+	}
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+
+	// failed seeding keeps server not ready
+	b = main.App{}
+	config.Initial.Distribution = "unknown"
+	checkErr(b.Initialize(config))
+	b.DataGenerationWg.Wait()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusServiceUnavailable, rr.Code)
+	req, _ = http.NewRequest("GET", "/admin/seed", nil)
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, asAdmin(req))
+	checkErr(json.Unmarshal(rr.Body.Bytes(), &status))
+	if status.State != main.SeedingFailed || status.Error == "" {
+		t.Errorf("Unexpected seeding status: %+v", status)
+	}
+}
+
+func TestApp_SeedingRestart(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+	config := &main.Configuration{
+		Storage: &main.StorageConfig{Backend: main.BackendFile, File: cfg},
+		Initial: &main.InitialData{Count: 20, Size: 20, ChunkSize: 10, Seed: 7, WaitForSeeding: true},
+	}
+	b := main.App{}
+	checkErr(b.Initialize(config))
+	b.DataGenerationWg.Wait()
+	page, _ := b.Store.List(ctx, main.ListOptions{})
+	changed := page.Entities[0]
+	changed.Data = "changed"
+	checkErr(b.Store.Update(ctx, &changed, 0))
+	checkErr(b.Close())
+
+	// the same entities are generated again, existing ones are kept
+	b = main.App{}
+	checkErr(b.Initialize(config))
+	b.DataGenerationWg.Wait()
+	defer func() { _ = b.Close() }()
+	if !b.Ready() {
+		t.Errorf("Server is not ready after seeding restart: %+v", b.CheckReadiness(ctx))
+	}
+	page, _ = b.Store.List(ctx, main.ListOptions{})
+	if page.Total != 20 {
+		t.Errorf("Expected 20 entities after restart, got %d", page.Total)
+	}
+	stored := main.Entity{Uuid: changed.Uuid}
+	checkErr(b.Store.Get(ctx, &stored))
+	if stored.Data != "changed" || stored.Version != 2 {
+		t.Errorf("Changed entity is overwritten by seeding: %+v", stored)
+	}
+}
+
+func TestApp_HealthChecks(t *testing.T) {
+	b := main.App{}
+	checkErr(b.Initialize(&main.Configuration{Debug: true, Admin: &main.AdminConfig{Token: adminToken}}))
+	b.DataGenerationWg.Wait()
+	readiness := func(expected int) main.ReadinessReport {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		b.Router.ServeHTTP(rr, req)
+		checkResponseCode(t, expected, rr.Code)
+		var report main.ReadinessReport
+		checkErr(json.Unmarshal(rr.Body.Bytes(), &report))
+		return report
+	}
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	rr := httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+
+	report := readiness(http.StatusOK)
+	for _, name := range []string{"storage", "seeding", "drain"} {
+		if report.Checks[name].Status != main.CheckOK {
+			t.Errorf("Check %s failed: %+v", name, report.Checks[name])
+		}
+	}
+
+	req, _ = http.NewRequest("PUT", "/admin/drain", nil)
+	b.Router.ServeHTTP(httptest.NewRecorder(), asAdmin(req))
+	report = readiness(http.StatusServiceUnavailable)
+	if report.Status != main.StatusNotReady || report.Checks["drain"].Status != main.CheckFail {
+		t.Errorf("Drained server is ready: %+v", report)
+	}
+	req, _ = http.NewRequest("DELETE", "/admin/drain", nil)
+	b.Router.ServeHTTP(httptest.NewRecorder(), asAdmin(req))
+	readiness(http.StatusOK)
+
+	// server waiting for database is alive, but not ready
+	b.Store = &main.DeferredStore{}
+	report = readiness(http.StatusServiceUnavailable)
+	if report.Checks["storage"].Error != main.ErrStoreUnavailable.Error() {
+		t.Errorf("Unexpected storage check: %+v", report.Checks["storage"])
+	}
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+}
+
+func TestApp_AdminToken(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/admin/drain", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req.Header.Set("Authorization", "Bearer wrong")
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req.Header.Set("Authorization", adminToken)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req, _ = http.NewRequest("PUT", "/collections/entity/schema", bytes.NewBufferString(`{"type": "object"}`))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req, _ = http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "unauthorized"}`))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req, _ = http.NewRequest("POST", "/collections", bytes.NewBufferString(`{"name": "protected"}`))
+	checkResponseCode(t, http.StatusCreated, executeRequest(asAdmin(req)).Code)
+	req, _ = http.NewRequest("DELETE", "/collections/protected", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	checkResponseCode(t, http.StatusOK, executeRequest(asAdmin(req)).Code)
+	if !a.Ready() {
+		t.Errorf("Server is drained by unauthorized request")
+	}
+
+	// admin routes are disabled without token
+	b := main.App{}
+	checkErr(b.Initialize(&main.Configuration{Debug: true}))
+	b.DataGenerationWg.Wait()
+	for _, method := range []string{"PUT", "DELETE"} {
+		req, _ = http.NewRequest(method, "/admin/drain", nil)
+		rr := httptest.NewRecorder()
+		b.Router.ServeHTTP(rr, asAdmin(req))
+		checkResponseCode(t, http.StatusForbidden, rr.Code)
+	}
+	if !b.Ready() {
+		t.Errorf("Server is drained without admin token configured")
+	}
+}
+
+func TestApp_RequestID(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/entity/"+uuid.NewV4().String(), nil)
+	req.Header.Set(main.HeaderRequestID, "client-id:1")
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+	if rr.Header().Get(main.HeaderRequestID) != "client-id:1" {
+		t.Errorf("Request ID is not echoed: %s", rr.Header().Get(main.HeaderRequestID))
+	}
+	var body map[string]string
+	checkErr(json.Unmarshal(rr.Body.Bytes(), &body))
+	if body["request_id"] != "client-id:1" {
+		t.Errorf("Error body doesn't contain request ID: %v", body)
+	}
+
+	for _, sent := range []string{"", "*/ DROP TABLE entity; /*", strings.Repeat("a", 129)} {
+		req, _ = http.NewRequest("GET", "/", nil)
+		req.Header.Set(main.HeaderRequestID, sent)
+		rr = executeRequest(req)
+		if generated := rr.Header().Get(main.HeaderRequestID); generated == sent || !uuid4Pattern.MatchString(generated) {
+			t.Errorf("Expected generated request ID instead of %q, got %q", sent, generated)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/twinj/uuid"
+)
+
+// NDJSONType is media type of newline delimited JSON accepted by bulk requests
+const NDJSONType = "application/x-ndjson"
+
+// MaxBulkItems limits count of items in single bulk request
+const MaxBulkItems = 10000
+
+// MaxBulkBodySize limits size of bulk request body in bytes
+const MaxBulkBodySize = 64 << 20
+
+// maxBulkLineSize limits size of single NDJSON line
+const maxBulkLineSize = 16 << 20
+
+// Modes of bulk requests
+const (
+	BulkAtomic     = "atomic"      // nothing is changed if any item fails
+	BulkBestEffort = "best_effort" // valid items are applied even if other items fail
+)
+
+// Bulk request errors
+var (
+	ErrUnsupportedBulk   = fmt.Errorf("unsupported bulk media type, application/json or %s is expected", NDJSONType)
+	ErrTooManyBulkItems  = fmt.Errorf("bulk request can contain at most %d items", MaxBulkItems)
+	ErrBulkTooLarge      = fmt.Errorf("bulk request body can be at most %d bytes", MaxBulkBodySize)
+	ErrInvalidBulkItem   = errors.New("invalid bulk item")
+	ErrDuplicateBulkItem = errors.New("entity is listed more than once")
+)
+
+var validEntityUUID = regexp.MustCompile(`^[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}$`)
+
+// BulkResult is result of single item of bulk request
+type BulkResult struct {
+	Index   int    `json:"index"`
+	Uuid    string `json:"uuid,omitempty"`
+	Status  int    `json:"status"`
+	Version int64  `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkReport is response of bulk request
+type BulkReport struct {
+	Mode      string       `json:"mode"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
+}
+
+// parseBulkOptions reads bulk options from `mode` and `upsert` query parameters, atomic mode is the default
+func parseBulkOptions(query url.Values) (BulkOptions, error) {
+	var opts BulkOptions
+	switch mode := query.Get("mode"); mode {
+	case "", BulkAtomic:
+		opts.Atomic = true
+	case BulkBestEffort:
+	default:
+		return opts, fmt.Errorf("invalid bulk mode: %s", mode)
+	}
+	if upsert := query.Get("upsert"); upsert != "" {
+		var err error
+		if opts.Upsert, err = strconv.ParseBool(upsert); err != nil {
+			return opts, fmt.Errorf("invalid upsert value: %s", upsert)
+		}
+	}
+	return opts, nil
+}
+
+// bulkBody counts bytes read from size limited request body to tell exceeded limit from other read errors
+type bulkBody struct {
+	reader io.Reader
+	read   int64
+}
+
+func (b *bulkBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= MaxBulkBodySize {
+		err = ErrBulkTooLarge
+	}
+	return n, err
+}
+
+// bulkReadError wraps error of reading bulk body, keeping body size error as is
+func bulkReadError(err error) error {
+	if errors.Is(err, ErrBulkTooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidBulkItem, err)
+}
+
+// readBulkItems reads items of JSON array or NDJSON request body
+//
+// Body is read item by item and reading stops as soon as `MaxBulkItems` or `MaxBulkBodySize` is exceeded.
+// Invalid NDJSON lines are reported as item errors, while invalid JSON array fails the whole request
+func readBulkItems(w http.ResponseWriter, r *http.Request) ([]json.RawMessage, []error, error) {
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, nil, ErrUnsupportedBulk
+		}
+	}
+	body := &bulkBody{reader: http.MaxBytesReader(w, r.Body, MaxBulkBodySize)}
+	var items []json.RawMessage
+	var errs []error
+	switch mediaType {
+	case "application/json":
+		decoder := json.NewDecoder(body)
+		if token, err := decoder.Token(); err != nil {
+			return nil, nil, bulkReadError(err)
+		} else if token != json.Delim('[') {
+			return nil, nil, fmt.Errorf("%w: JSON array is expected", ErrInvalidBulkItem)
+		}
+		for decoder.More() {
+			var item json.RawMessage
+			if err := decoder.Decode(&item); err != nil {
+				return nil, nil, bulkReadError(err)
+			}
+			items = append(items, item)
+			if len(items) > MaxBulkItems {
+				return nil, nil, ErrTooManyBulkItems
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, nil, bulkReadError(err)
+		}
+		errs = make([]error, len(items))
+	case NDJSONType:
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(nil, maxBulkLineSize)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var err error
+			if !json.Valid(line) {
+				err = fmt.Errorf("%w: line is not valid JSON", ErrInvalidBulkItem)
+			}
+			items = append(items, append(json.RawMessage{}, line...))
+			errs = append(errs, err)
+			if len(items) > MaxBulkItems {
+				return nil, nil, ErrTooManyBulkItems
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, bulkReadError(err)
+		}
+	default:
+		return nil, nil, ErrUnsupportedBulk
+	}
+	return items, errs, nil
+}
+
+// parseBulkEntity decodes entity of bulk item, generating uuid if it's missing
+func parseBulkEntity(item json.RawMessage, e *Entity, seen map[string]bool) error {
+	if err := json.Unmarshal(item, e); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBulkItem, err)
+	}
+	if e.Uuid == "" {
+		e.Uuid = uuid.NewV4().String()
+	}
+	if !validEntityUUID.MatchString(e.Uuid) {
+		return fmt.Errorf("%w: invalid uuid %s", ErrInvalidBulkItem, e.Uuid)
+	}
+	if seen[e.Uuid] {
+		return ErrDuplicateBulkItem
+	}
+	seen[e.Uuid] = true
+	return nil
+}
+
+// newBulkReport builds report of bulk request, `succeeded` is called for items without error
+func newBulkReport(opts BulkOptions, uuids []string, errs []error, succeeded func(i int) BulkResult) *BulkReport {
+	report := &BulkReport{Mode: BulkBestEffort, Results: make([]BulkResult, len(errs))}
+	if opts.Atomic {
+		report.Mode = BulkAtomic
+	}
+	for i, err := range errs {
+		if err == nil {
+			report.Succeeded++
+			report.Results[i] = succeeded(i)
+		} else {
+			report.Failed++
+			message := err.Error()
+			if errors.Is(err, sql.ErrNoRows) {
+				message = "entity not found"
+			}
+			report.Results[i] = BulkResult{Status: storeErrorCode(err), Error: message}
+		}
+		report.Results[i].Index = i
+		report.Results[i].Uuid = uuids[i]
+	}
+	return report
+}
+
+// statusCode returns 200 if all items succeeded and 207 otherwise
+func (r *BulkReport) statusCode() int {
+	if r.Failed > 0 {
+		return http.StatusMultiStatus
+	}
+	return http.StatusOK
+}
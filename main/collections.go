@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultCollection is collection used by routes without collection name
+const DefaultCollection = "entity"
+
+// collection names are limited, so PostgreSQL table name with prefix fits 63 bytes
+var validCollectionName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+var (
+	// ErrCollectionNotFound is returned when requested collection does not exist
+	ErrCollectionNotFound = errors.New("collection not found")
+	// ErrCollectionExists is returned when created collection already exists
+	ErrCollectionExists = errors.New("collection already exists")
+	// ErrDefaultCollection is returned on attempt to drop default collection
+	ErrDefaultCollection = errors.New("default collection can't be dropped")
+	// ErrInvalidCollectionName is returned when collection name doesn't match allowed pattern
+	ErrInvalidCollectionName = fmt.Errorf("invalid collection name, name must match %s pattern", validCollectionName)
+	// ErrCollectionsUnsupported is returned when storage backend has no collections
+	ErrCollectionsUnsupported = errors.New("storage doesn't support collections")
+	// ErrTooManyCollections is returned when collection count limit of storage is reached
+	ErrTooManyCollections = errors.New("too many collections")
+)
+
+// CollectionStore is implemented by storage backends keeping entities in named collections
+//
+// Each collection is independent EntityStore, store itself is the default collection
+type CollectionStore interface {
+	// Collection returns store of existing collection
+	Collection(ctx context.Context, name string) (EntityStore, error)
+	// Collections returns sorted names of all collections, including the default one
+	Collections(ctx context.Context) ([]string, error)
+	// CreateCollection creates new empty collection
+	CreateCollection(ctx context.Context, name string) error
+	// DropCollection removes collection with all its entities
+	DropCollection(ctx context.Context, name string) error
+}
+
+// ValidateCollectionName checks collection name can be safely used as part of table or file name
+func ValidateCollectionName(name string) error {
+	if !validCollectionName.MatchString(name) {
+		return ErrInvalidCollectionName
+	}
+	return nil
+}
+
+// collectionRegistry keeps collections of storage backends without own catalog
+type collectionRegistry struct {
+	mu     sync.Mutex
+	stores map[string]EntityStore
+	limit  int // maximum count of collections besides the default one, no limit if zero
+	create func(name string) (EntityStore, error)
+	drop   func(name string, store EntityStore) error
+}
+
+func newCollectionRegistry(defaultStore EntityStore) *collectionRegistry {
+	return &collectionRegistry{stores: map[string]EntityStore{DefaultCollection: defaultStore}}
+}
+
+func (c *collectionRegistry) Collection(_ context.Context, name string) (EntityStore, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	store, ok := c.stores[name]
+	if !ok {
+		return nil, ErrCollectionNotFound
+	}
+	return store, nil
+}
+
+func (c *collectionRegistry) Collections(_ context.Context) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.stores))
+	for name := range c.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *collectionRegistry) CreateCollection(_ context.Context, name string) error {
+	if err := ValidateCollectionName(name); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.stores[name]; ok {
+		return ErrCollectionExists
+	}
+	if c.limit > 0 && len(c.stores) > c.limit {
+		return ErrTooManyCollections
+	}
+	store, err := c.create(name)
+	if err != nil {
+		return err
+	}
+	c.stores[name] = store
+	return nil
+}
+
+func (c *collectionRegistry) DropCollection(_ context.Context, name string) error {
+	if name == DefaultCollection {
+		return ErrDefaultCollection
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	store, ok := c.stores[name]
+	if !ok {
+		return ErrCollectionNotFound
+	}
+	if c.drop != nil {
+		if err := c.drop(name, store); err != nil {
+			return err
+		}
+	}
+	delete(c.stores, name)
+	return nil
+}
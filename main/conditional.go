@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entityETag returns strong ETag of entity version
+func entityETag(e *Entity) string {
+	return strconv.Quote(strconv.FormatInt(e.Version, 10))
+}
+
+// setValidators sets `ETag` and `Last-Modified` headers of entity response
+func setValidators(w http.ResponseWriter, e *Entity) {
+	w.Header().Set("ETag", entityETag(e))
+	if !e.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", e.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+func setCacheControl(w http.ResponseWriter, value string) {
+	if value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// parseETags splits list of entity tags, weak tags are returned with W/ prefix
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// versionFromETag parses entity version from strong ETag
+func versionFromETag(tag string) (int64, bool) {
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil || !strings.HasPrefix(tag, `"`) {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// ifMatchVersion selects version required by `If-Match` header of the request
+//
+// Zero is returned if any version is acceptable. If none of the tags can match, ErrVersionMismatch
+// is returned. If several versions are listed, version of stored entity is used if it's in the list
+func ifMatchVersion(ctx context.Context, r *http.Request, store EntityStore, uuid string) (int64, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+	var versions []int64
+	for _, tag := range parseETags(header) {
+		if tag == "*" {
+			return 0, nil
+		}
+		// If-Match uses strong comparison, so weak tags never match
+		if version, ok := versionFromETag(tag); ok {
+			versions = append(versions, version)
+		}
+	}
+	switch len(versions) {
+	case 0:
+		return 0, ErrVersionMismatch
+	case 1:
+		return versions[0], nil
+	}
+	current := Entity{Uuid: uuid}
+	if err := store.Get(WithPrimaryRead(ctx), &current); err != nil {
+		return 0, err
+	}
+	for _, version := range versions {
+		if version == current.Version {
+			return version, nil
+		}
+	}
+	return 0, ErrVersionMismatch
+}
+
+// notModified checks `If-None-Match` and `If-Modified-Since` headers of the request against entity
+//
+// `If-Modified-Since` is ignored if `If-None-Match` is present
+func notModified(r *http.Request, e *Entity) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		etag := entityETag(e)
+		for _, tag := range parseETags(header) {
+			// If-None-Match uses weak comparison
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || e.UpdatedAt.IsZero() {
+		return false
+	}
+	// Last-Modified has precision of one second
+	return !e.UpdatedAt.Truncate(time.Second).After(since)
+}
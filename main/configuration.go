@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 func getUserDir() string {
@@ -15,17 +16,114 @@ func getUserDir() string {
 var defaultUserDir = filepath.Join(getUserDir(), ".too-simple")
 var defaultCfgPATH = filepath.Join(defaultUserDir, "config.yml")
 
+// InitialData configures random entities generated at start
 type InitialData struct {
-	Count int `yaml:"count"`
-	Size  int `yaml:"size"`
+	Count     int   `yaml:"count"`
+	Size      int   `yaml:"size"`
+	ChunkSize int   `yaml:"chunk_size,omitempty"` // entities generated and inserted at once, 1000 by default
+	Seed      int64 `yaml:"seed,omitempty"`       // the same seed generates the same data, random seed is used if not set
+	Workers   int   `yaml:"workers,omitempty"`    // number of CPUs by default
+	// WaitForSeeding makes readiness check fail until initial data is loaded
+	WaitForSeeding bool `yaml:"wait_for_seeding,omitempty"`
+
+	Distribution string  `yaml:"distribution,omitempty"` // fixed, uniform or normal
+	MinSize      int     `yaml:"min_size,omitempty"`
+	MaxSize      int     `yaml:"max_size,omitempty"`
+	SizeStdDev   float64 `yaml:"size_stddev,omitempty"`
+}
+
+// SSLConfig configures SSL connection to PostgreSQL, see libpq `sslmode` for available modes
+type SSLConfig struct {
+	Mode     string `yaml:"mode"`
+	RootCert string `yaml:"root_cert,omitempty"`
+	Cert     string `yaml:"cert,omitempty"`
+	Key      string `yaml:"key,omitempty"`
 }
 
 type PostgresConfig struct {
-	DbURL    string       `yaml:"db_url"`
-	Database string       `yaml:"database"`
-	Username string       `yaml:"username"`
-	Password string       `yaml:"password"`
-	Initial  *InitialData `yaml:"initial_data,omitempty"`
+	DbURL    string `yaml:"db_url"`
+	Database string `yaml:"database"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	MaxOpenConns     int           `yaml:"max_open_conns,omitempty"`
+	MaxIdleConns     int           `yaml:"max_idle_conns,omitempty"`
+	ConnMaxLifetime  time.Duration `yaml:"conn_max_lifetime,omitempty"`
+	ConnMaxIdleTime  time.Duration `yaml:"conn_max_idle_time,omitempty"`
+	ConnectTimeout   time.Duration `yaml:"connect_timeout,omitempty"`
+	StatementTimeout time.Duration `yaml:"statement_timeout,omitempty"`
+	SSL              *SSLConfig    `yaml:"ssl,omitempty"`
+
+	ConnectRetries   int           `yaml:"connect_retries,omitempty"`
+	RetryInterval    time.Duration `yaml:"retry_interval,omitempty"`
+	MaxRetryInterval time.Duration `yaml:"max_retry_interval,omitempty"`
+	DegradedStart    bool          `yaml:"degraded_start,omitempty"` // start serving before database is available
+
+	Replicas             []string      `yaml:"replicas,omitempty"` // read replicas in host:port form
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval,omitempty"`
+
+	Initial *InitialData `yaml:"initial_data,omitempty"`
+}
+
+// MemoryConfig limits in-memory storage used in debug mode, zero means no limit
+type MemoryConfig struct {
+	MaxCount       int    `yaml:"max_count"`
+	MaxBytes       int64  `yaml:"max_bytes"`
+	Eviction       string `yaml:"eviction"`        // lru, fifo or none
+	MaxCollections int    `yaml:"max_collections"` // DefaultMaxCollections if not set
+}
+
+// FileStorageConfig configures file-backed storage used without PostgreSQL
+type FileStorageConfig struct {
+	Path            string        `yaml:"path"`
+	CompactInterval time.Duration `yaml:"compact_interval"`
+	Sync            bool          `yaml:"sync"` // fsync file after every write
+}
+
+// Storage backends
+const (
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+	BackendFile     = "file"
+)
+
+// StorageConfig selects entity storage backend
+type StorageConfig struct {
+	Backend string             `yaml:"backend"`
+	File    *FileStorageConfig `yaml:"file,omitempty"`
+}
+
+// CacheConfig sets `Cache-Control` header of entity responses, empty value means no header
+type CacheConfig struct {
+	Entity   string `yaml:"entity"`   // single entity responses
+	Entities string `yaml:"entities"` // entity list and search responses
+}
+
+// HealthConfig configures readiness checks
+type HealthConfig struct {
+	PingTimeout time.Duration `yaml:"ping_timeout,omitempty"` // timeout of database ping, 2s by default
+}
+
+// AdminConfig protects administrative routes
+type AdminConfig struct {
+	Token string `yaml:"token"` // sent as `Authorization: Bearer <token>`, admin routes are disabled without it
+}
+
+// LogConfig configures server logs
+type LogConfig struct {
+	Level  string `yaml:"level,omitempty"`  // debug, info, warn or error, info by default
+	Format string `yaml:"format,omitempty"` // logfmt or json, logfmt by default
+}
+
+// TracingConfig configures export of request traces
+type TracingConfig struct {
+	Exporter      string            `yaml:"exporter"`                 // otlp, stdout or file
+	Endpoint      string            `yaml:"endpoint,omitempty"`       // OTLP/HTTP traces URL, http://localhost:4318/v1/traces by default
+	Headers       map[string]string `yaml:"headers,omitempty"`        // headers of OTLP requests, e.g. for authentication
+	Path          string            `yaml:"path,omitempty"`           // file of `file` exporter
+	ServiceName   string            `yaml:"service_name,omitempty"`   // too-simple by default
+	SampleRatio   *float64          `yaml:"sample_ratio,omitempty"`   // ratio of sampled new traces from 0 to 1, all by default
+	FlushInterval time.Duration     `yaml:"flush_interval,omitempty"` // how often spans are exported, 5s by default
 }
 
 // Configuration file structure
@@ -33,6 +131,42 @@ type Configuration struct {
 	Debug      bool            `yaml:"debug"`
 	ServerPort int             `yaml:"server_port"`
 	Postgres   *PostgresConfig `yaml:"postgres,omitempty"`
+	Memory     *MemoryConfig   `yaml:"memory,omitempty"`
+	Storage    *StorageConfig  `yaml:"storage,omitempty"`
+	Cache      *CacheConfig    `yaml:"cache,omitempty"`
+	Initial    *InitialData    `yaml:"initial_data,omitempty"` // generated in any storage backend
+	Health     *HealthConfig   `yaml:"health,omitempty"`
+	Admin      *AdminConfig    `yaml:"admin,omitempty"`
+	Log        *LogConfig      `yaml:"log,omitempty"`
+	Tracing    *TracingConfig  `yaml:"tracing,omitempty"`
+	// Schemas maps collection names to files with JSON Schema of their entities
+	Schemas map[string]string `yaml:"schemas,omitempty"`
+}
+
+// StorageBackend returns name of used storage backend
+//
+// Debug mode never uses PostgreSQL, in-memory storage is used instead
+func (c *Configuration) StorageBackend() string {
+	backend := ""
+	if c.Storage != nil {
+		backend = c.Storage.Backend
+	}
+	if backend == "" || (c.Debug && backend == BackendPostgres) {
+		if c.Debug {
+			return BackendMemory
+		}
+		return BackendPostgres
+	}
+	return backend
+}
+
+// InitialData returns configuration of initial data, `initial_data` of `postgres` section
+// is used if top-level section is missing
+func (c *Configuration) InitialData() *InitialData {
+	if c.Initial == nil && c.Postgres != nil {
+		return c.Postgres.Initial
+	}
+	return c.Initial
 }
 
 // LoadConfiguration load configuration from given path
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
 )
@@ -176,3 +177,30 @@ func TestConfiguration_LoadConfiguration(t *testing.T) {
 	}
 
 }
+
+func TestConfiguration_LoadPostgresPool(t *testing.T) {
+	path := validRandomPath()
+	defer func() { _ = os.Remove(path) }()
+	data := strings.Join([]string{
+		"postgres:",
+		"  db_url: localhost:5432",
+		"  max_open_conns: 20",
+		"  conn_max_lifetime: 30m",
+		"  statement_timeout: 1500ms",
+		"  ssl:",
+		"    mode: verify-full",
+		"    root_cert: /etc/ca.pem",
+	}, "\n")
+	checkErr(ioutil.WriteFile(path, []byte(data), 0644))
+
+	res, err := main.LoadConfiguration(path)
+	checkErr(err)
+	expected := &main.PostgresConfig{
+		DbURL:            "localhost:5432",
+		MaxOpenConns:     20,
+		ConnMaxLifetime:  30 * time.Minute,
+		StatementTimeout: 1500 * time.Millisecond,
+		SSL:              &main.SSLConfig{Mode: "verify-full", RootCert: "/etc/ca.pem"},
+	}
+	errorOnDiff(expected, res.Postgres, t)
+}
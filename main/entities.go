@@ -1,29 +1,70 @@
 package main
 
 import (
-	"github.com/twinj/uuid"
-	"log"
+	"context"
+	"encoding/json"
 	"math/rand"
+	"sync"
 	"time"
 	"unsafe"
 )
 
 type Entity struct {
-	Uuid string `json:"uuid"`
-	Data string `json:"data"`
+	Uuid      string    `json:"uuid"`
+	Data      string    `json:"data"`
+	Version   int64     `json:"version"` // incremented on every update
+	UpdatedAt time.Time `json:"updated_at"`
+	// Document is optional structured data, stored as JSONB in PostgreSQL
+	Document json.RawMessage `json:"document,omitempty"`
+}
+
+// documentValue converts entity document to SQL parameter, missing document is stored as NULL
+func (e *Entity) documentValue() interface{} {
+	if len(e.Document) == 0 {
+		return nil
+	}
+	return string(e.Document)
+}
+
+// modificationTime returns current time with precision of PostgreSQL timestamp
+func modificationTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
 }
 
 const DataRandCS = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ :;~`\\|/?.,<>{}()&*%$#@"
 
-var src = rand.NewSource(time.Now().UnixNano())
+// lockedSource is rand.Source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+var src rand.Source = &lockedSource{src: rand.NewSource(time.Now().UnixNano())}
 
 func randomByteSlice(size int, prefix string, charset string) []byte {
+	return randomBytes(src, size, prefix, charset)
+}
+
+// randomBytes generates random slice using given source
+func randomBytes(source rand.Source, size int, prefix string, charset string) []byte {
 	csLen := len(charset)
 	prefLen := len(prefix)
 	result := make([]byte, size)
 	copy(result, prefix)
 	for i := prefLen; i < size; i++ {
-		result[i] = charset[src.Int63()%int64(csLen)]
+		result[i] = charset[source.Int63()%int64(csLen)]
 	}
 	return result
 }
@@ -44,17 +85,16 @@ func GenerateSomeEntities(count int, dataSize ...int) []Entity {
 		size = dataSize[0]
 	}
 
-	var data = make([]Entity, count)
-	startTime := time.Now().Unix()
-	for i := 0; i < count; i++ {
-		func() {
-			data[i] = Entity{
-				Uuid: uuid.NewV4().String(),
-				Data: RandomString(size, "RANDOM DATA: "),
-			}
-		}()
+	generator, err := NewDataGenerator(InitialData{Count: count, Size: size})
+	if err != nil {
+		logger.Error("Can't generate data", "error", err)
+		return nil
+	}
+	var data = make([]Entity, 0, count)
+	startTime := time.Now()
+	for batch := range generator.Batches(context.Background()) {
+		data = append(data, batch...)
 	}
-	log.Print("Waiting for data to be generated...")
-	log.Printf("Generated data in %vs", time.Now().Unix()-startTime)
+	logger.Debug("Generated data", "count", len(data), "duration", time.Since(startTime))
 	return data
 }
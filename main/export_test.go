@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+)
+
+// WrapFileStoreWriter replaces writer of storage log with small buffered writer to wrapped file,
+// so tests can make writes fail after part of the record is written
+func WrapFileStoreWriter(s *FileStore, wrap func(file io.Writer) io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writer = bufio.NewWriterSize(wrap(s.file), 16)
+}
+
+// NewPostgresStoreWithReplicas creates store of default collection reading from given replicas,
+// replicas are checked immediately and then every `interval`
+func NewPostgresStoreWithReplicas(primary *sql.DB, interval time.Duration, replicas ...*sql.DB) *PostgresStore {
+	s := NewPostgresStoreFromDB(primary)
+	for i, db := range replicas {
+		s.replicas = append(s.replicas, &replica{url: fmt.Sprintf("replica-%d", i), db: db})
+	}
+	s.startReplicaChecks(interval)
+	return s
+}
+
+// ConnectionString builds libpq connection string of given database
+func ConnectionString(config *PostgresConfig, dbURL, dbName string) (string, error) {
+	return config.connectionString(dbURL, dbName)
+}
+
+// MetricFamily is metric family written in Prometheus text format
+type MetricFamily = metricFamily
+
+// NewMetricFamily creates metric family of `counter`, `gauge` or `histogram` type
+func NewMetricFamily(name, help, kind string, buckets []float64, labels ...string) *MetricFamily {
+	return newMetricFamily(name, help, kind, buckets, labels...)
+}
+
+// Add changes counter or gauge value
+func (f *MetricFamily) Add(value float64, labelValues ...string) {
+	f.add(value, labelValues...)
+}
+
+// Observe adds value to histogram
+func (f *MetricFamily) Observe(value float64, labelValues ...string) {
+	f.observe(value, labelValues...)
+}
+
+// Write writes family in Prometheus text format
+func (f *MetricFamily) Write(w io.Writer) {
+	f.write(w)
+}
@@ -1,65 +1,451 @@
 package main
 
 import (
+	"container/list"
+	"context"
 	"database/sql"
-	"regexp"
-	"strings"
+	"errors"
+	"fmt"
+	"sync"
 )
 
-var FakeDataStorage = make(map[string]Entity)
+// Eviction policies of in-memory storage
+const (
+	EvictionLRU  = "lru"
+	EvictionFIFO = "fifo"
+	EvictionNone = "none"
+)
+
+var (
+	// ErrStoreFull is returned when storage limits are reached and eviction is disabled,
+	// or when atomic bulk operation alone exceeds the limits
+	ErrStoreFull = errors.New("storage is full")
+	// ErrEntityTooLarge is returned when single entity doesn't fit storage size limit
+	ErrEntityTooLarge = errors.New("entity is too large")
+)
+
+// FakeStore is concurrency-safe in-memory entity storage used in debug mode
+//
+// Storage size can be limited by entity count and by total size of entities.
+// When limit is reached, entities are evicted according to eviction policy
+type FakeStore struct {
+	mu       sync.Mutex
+	data     map[string]*list.Element
+	order    *list.List // front is the most recently added (fifo) or used (lru) entity
+	size     int64
+	maxCount int
+	maxBytes int64
+	eviction string
+	index    *invertedIndex // full-text index, built on first search
+
+	*collectionRegistry
+}
+
+// DefaultMaxCollections is count of collections in-memory storage can have besides the default one
+const DefaultMaxCollections = 100
+
+// NewFakeStore creates empty in-memory storage, limits are taken from optional configuration
+//
+// Every collection of the storage has the same limits, so count of collections is limited too
+func NewFakeStore(config ...*MemoryConfig) *FakeStore {
+	var cfg *MemoryConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	s := newFakeStore(cfg)
+	registry := newCollectionRegistry(s)
+	registry.limit = DefaultMaxCollections
+	if cfg != nil && cfg.MaxCollections > 0 {
+		registry.limit = cfg.MaxCollections
+	}
+	registry.create = func(string) (EntityStore, error) {
+		store := newFakeStore(cfg)
+		store.collectionRegistry = registry
+		return store, nil
+	}
+	s.collectionRegistry = registry
+	return s
+}
+
+func newFakeStore(cfg *MemoryConfig) *FakeStore {
+	s := &FakeStore{
+		data:     make(map[string]*list.Element),
+		order:    list.New(),
+		eviction: EvictionLRU,
+	}
+	if cfg != nil {
+		s.maxCount = cfg.MaxCount
+		s.maxBytes = cfg.MaxBytes
+		if cfg.Eviction != "" {
+			s.eviction = cfg.Eviction
+		}
+	}
+	return s
+}
 
-func FakeGet(e *Entity) error {
-	ent, ok := FakeDataStorage[e.Uuid]
+func entitySize(e *Entity) int64 {
+	return int64(len(e.Uuid) + len(e.Data) + len(e.Document))
+}
+
+// Len returns count of stored entities
+func (s *FakeStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+// Size returns total size of stored entities in bytes
+func (s *FakeStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *FakeStore) Get(_ context.Context, e *Entity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.data[e.Uuid]
 	if !ok {
 		return sql.ErrNoRows
 	}
-	e.Data = ent.Data
+	if s.eviction == EvictionLRU {
+		s.order.MoveToFront(el)
+	}
+	*e = *el.Value.(*Entity)
 	return nil
 }
 
-func FakeList(length int, filter string) ([]Entity, error) {
-	storLength := len(FakeDataStorage)
-	values := make([]Entity, 0, storLength)
-
-	reFilter := strings.Replace(filter, "%", ".*", -1)
-	if reFilter == "" {
-		reFilter = ".*"
+func (s *FakeStore) List(_ context.Context, opts ListOptions) (*EntityPage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	match, err := opts.Filter.Matcher()
+	if err != nil {
+		return nil, err
 	}
-	for _, val := range FakeDataStorage {
-		match, _ := regexp.MatchString(reFilter, val.Data)
-		if match {
-			values = append(values, val)
+
+	s.mu.Lock()
+	values := make([]Entity, 0, len(s.data))
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		val := el.Value.(*Entity)
+		if match(val) {
+			values = append(values, *val)
 		}
 	}
-	if length > storLength {
-		length = storLength
+	s.mu.Unlock()
+	return opts.paginate(values)
+}
+
+// reserve evicts entities until entity of given size fits storage limits
+//
+// `replaced` is size of the entity being overwritten, `keep` is its list element, which is never evicted
+func (s *FakeStore) reserve(size int64, replaced int64, keep *list.Element) error {
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return ErrEntityTooLarge
+	}
+	count := len(s.data)
+	if keep == nil {
+		count++
 	}
-	vLength := len(values)
-	if length > vLength {
-		length = vLength
+	total := s.size - replaced + size
+	for (s.maxCount > 0 && count > s.maxCount) || (s.maxBytes > 0 && total > s.maxBytes) {
+		if s.eviction != EvictionLRU && s.eviction != EvictionFIFO {
+			return ErrStoreFull
+		}
+		victim := s.order.Back()
+		if victim == keep {
+			victim = victim.Prev()
+		}
+		if victim == nil {
+			return ErrStoreFull
+		}
+		total -= entitySize(victim.Value.(*Entity))
+		count--
+		s.remove(victim)
 	}
-	return values[:length], nil
+	return nil
+}
+
+func (s *FakeStore) remove(el *list.Element) {
+	ent := s.order.Remove(el).(*Entity)
+	delete(s.data, ent.Uuid)
+	s.size -= entitySize(ent)
+	if s.index != nil {
+		s.index.remove(ent)
+	}
+}
+
+func (s *FakeStore) Create(_ context.Context, e *Entity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.Version = 1
+	e.UpdatedAt = modificationTime()
+	return s.put(e)
 }
 
-func FakeNew(e *Entity) error {
-	FakeDataStorage[e.Uuid] = *e
+// restore puts entity to storage as is
+func (s *FakeStore) restore(e *Entity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(e)
+}
+
+// put stores entity replacing existing one, existing entity is kept if new one doesn't fit
+func (s *FakeStore) put(e *Entity) error {
+	size := entitySize(e)
+	var oldSize int64
+	el, ok := s.data[e.Uuid]
+	if ok {
+		oldSize = entitySize(el.Value.(*Entity))
+	}
+	if err := s.reserve(size, oldSize, el); err != nil {
+		return err
+	}
+	if ok {
+		s.remove(el)
+	}
+	ent := *e
+	s.data[e.Uuid] = s.order.PushFront(&ent)
+	s.size += size
+	if s.index != nil {
+		s.index.add(&ent)
+	}
 	return nil
 }
 
-func FakeDel(e *Entity) error {
-	ent, ok := FakeDataStorage[e.Uuid]
+// lookup finds entity element checking its version
+func (s *FakeStore) lookup(uuid string, ifVersion int64) (*list.Element, error) {
+	el, ok := s.data[uuid]
 	if !ok {
-		return sql.ErrNoRows
+		return nil, sql.ErrNoRows
 	}
-	delete(FakeDataStorage, ent.Uuid)
+	if ifVersion != 0 && el.Value.(*Entity).Version != ifVersion {
+		return nil, ErrVersionMismatch
+	}
+	return el, nil
+}
+
+func (s *FakeStore) Delete(_ context.Context, e *Entity, ifVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, err := s.lookup(e.Uuid, ifVersion)
+	if err != nil {
+		return err
+	}
+	s.remove(el)
 	return nil
 }
 
-func FakeUpdate(e *Entity) error {
-	_, ok := FakeDataStorage[e.Uuid]
-	if !ok {
-		return sql.ErrNoRows
+func (s *FakeStore) Update(_ context.Context, e *Entity, ifVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, err := s.lookup(e.Uuid, ifVersion)
+	if err != nil {
+		return err
 	}
-	FakeDataStorage[e.Uuid] = *e
+	return s.replace(el, e)
+}
+
+func (s *FakeStore) Modify(_ context.Context, e *Entity, ifVersion int64, mutate func(e *Entity) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, err := s.lookup(e.Uuid, ifVersion)
+	if err != nil {
+		return err
+	}
+	changed := *el.Value.(*Entity)
+	if err := mutate(&changed); err != nil {
+		return err
+	}
+	changed.Uuid = e.Uuid
+	if err := s.replace(el, &changed); err != nil {
+		return err
+	}
+	*e = changed
 	return nil
 }
+
+// replace stores new version of the entity in existing element
+func (s *FakeStore) replace(el *list.Element, e *Entity) error {
+	oldSize := entitySize(el.Value.(*Entity))
+	newSize := entitySize(e)
+	if err := s.reserve(newSize, oldSize, el); err != nil {
+		return err
+	}
+	if s.eviction == EvictionLRU {
+		s.order.MoveToFront(el)
+	}
+	e.Version = el.Value.(*Entity).Version + 1
+	e.UpdatedAt = modificationTime()
+	ent := *e
+	if s.index != nil {
+		s.index.remove(el.Value.(*Entity))
+		s.index.add(&ent)
+	}
+	el.Value = &ent
+	s.size += newSize - oldSize
+	return nil
+}
+
+func (s *FakeStore) AddEntities(_ context.Context, entities []Entity, opts LoadOptions) error {
+	return opts.forEachChunk(len(entities), func(start, end int) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		now := modificationTime()
+		for i := start; i < end; i++ {
+			if _, ok := s.data[entities[i].Uuid]; ok {
+				continue
+			}
+			entities[i].Version = 1
+			entities[i].UpdatedAt = now
+			if err := s.put(&entities[i]); err != nil {
+				return fmt.Errorf("unable to add entity %s: %w", entities[i].Uuid, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Search finds entities containing all words of the query using inverted index
+func (s *FakeStore) Search(_ context.Context, query string, count int) ([]SearchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index == nil {
+		s.index = newInvertedIndex()
+		for el := s.order.Front(); el != nil; el = el.Next() {
+			s.index.add(el.Value.(*Entity))
+		}
+	}
+	results := s.index.search(query, count)
+	for i := range results {
+		results[i].Entity = *s.data[results[i].Uuid].Value.(*Entity)
+	}
+	return results, nil
+}
+
+// snapshot returns copy of all stored entities, oldest first
+func (s *FakeStore) snapshot() []Entity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entities := make([]Entity, 0, len(s.data))
+	for el := s.order.Back(); el != nil; el = el.Prev() {
+		entities = append(entities, *el.Value.(*Entity))
+	}
+	return entities
+}
+
+func (s *FakeStore) BulkCreate(_ context.Context, entities []Entity, opts BulkOptions) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(entities))
+	if !opts.Upsert {
+		for i := range entities {
+			if _, ok := s.data[entities[i].Uuid]; ok {
+				errs[i] = ErrEntityExists
+			}
+		}
+		if opts.Atomic && abortBulk(errs) {
+			return errs, nil
+		}
+	}
+	if opts.Atomic && !s.fits(entities, errs) {
+		abortBulk(errs)
+		return errs, nil
+	}
+	now := modificationTime()
+	for i := range entities {
+		if errs[i] != nil {
+			continue
+		}
+		e := &entities[i]
+		e.Version = 1
+		e.UpdatedAt = now
+		if el, ok := s.data[e.Uuid]; ok {
+			e.Version = el.Value.(*Entity).Version + 1
+		}
+		errs[i] = s.put(e)
+	}
+	return errs, nil
+}
+
+// fits checks if all entities of atomic bulk operation can be stored before any of them is written,
+// so failed operation doesn't evict anything. The item that doesn't fit is marked with its error
+//
+// With eviction enabled older entities make room for the batch, but the batch itself still has to fit,
+// otherwise its first items would be evicted by the following ones
+func (s *FakeStore) fits(entities []Entity, errs []error) bool {
+	evicting := s.eviction == EvictionLRU || s.eviction == EvictionFIFO
+	batch := make(map[string]int64)
+	var batchSize int64
+	count, total := len(s.data), s.size
+	for i := range entities {
+		if errs[i] != nil {
+			continue
+		}
+		uuid := entities[i].Uuid
+		size := entitySize(&entities[i])
+		if s.maxBytes > 0 && size > s.maxBytes {
+			errs[i] = ErrEntityTooLarge
+			return false
+		}
+		oldSize, inBatch := batch[uuid]
+		if inBatch {
+			total -= oldSize
+		} else if el, ok := s.data[uuid]; ok {
+			total -= entitySize(el.Value.(*Entity))
+		} else {
+			count++
+		}
+		total += size
+		batchSize += size - oldSize
+		batch[uuid] = size
+		needCount, needBytes := count, total
+		if evicting {
+			needCount, needBytes = len(batch), batchSize
+		}
+		if (s.maxCount > 0 && needCount > s.maxCount) || (s.maxBytes > 0 && needBytes > s.maxBytes) {
+			errs[i] = ErrStoreFull
+			return false
+		}
+	}
+	return true
+}
+
+func (s *FakeStore) BulkDelete(_ context.Context, uuids []string, opts BulkOptions) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(uuids))
+	for i, uuid := range uuids {
+		if _, ok := s.data[uuid]; !ok {
+			errs[i] = sql.ErrNoRows
+		}
+	}
+	if opts.Atomic && abortBulk(errs) {
+		return errs, nil
+	}
+	for _, uuid := range uuids {
+		if el, ok := s.data[uuid]; ok {
+			s.remove(el)
+		}
+	}
+	return errs, nil
+}
+
+func (s *FakeStore) DeleteMatching(_ context.Context, filter EntityFilter) (int64, error) {
+	match, err := filter.Matcher()
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for el := s.order.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*Entity)) {
+			s.remove(el)
+			count++
+		}
+		el = next
+	}
+	return count, nil
+}
@@ -0,0 +1,283 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+	"github.com/twinj/uuid"
+)
+
+var ctx = context.Background()
+
+func newTestEntity(data string) *main.Entity {
+	return &main.Entity{Uuid: uuid.NewV4().String(), Data: data}
+}
+
+func fillStore(t *testing.T, store *main.FakeStore, count int) []*main.Entity {
+	entities := make([]*main.Entity, count)
+	for i := 0; i < count; i++ {
+		entities[i] = newTestEntity(fmt.Sprintf("data %d", i))
+		if err := store.Create(ctx, entities[i]); err != nil {
+			t.Fatalf("Can't create entity: %v", err)
+		}
+	}
+	return entities
+}
+
+func isStored(store main.EntityStore, e *main.Entity) bool {
+	return store.Get(ctx, &main.Entity{Uuid: e.Uuid}) == nil
+}
+
+func TestFakeStore_EvictionLRU(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 3, Eviction: main.EvictionLRU})
+	entities := fillStore(t, store, 3)
+
+	// first entity become the most recently used one
+	checkErr(store.Get(ctx, &main.Entity{Uuid: entities[0].Uuid}))
+	checkErr(store.Create(ctx, newTestEntity("new")))
+
+	if store.Len() != 3 {
+		t.Errorf("Expected 3 entities in store, got %d", store.Len())
+	}
+	if !isStored(store, entities[0]) {
+		t.Error("Recently used entity was evicted")
+	}
+	if isStored(store, entities[1]) {
+		t.Error("Least recently used entity was not evicted")
+	}
+}
+
+func TestFakeStore_FailedUpdateKeepsLRUOrder(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 3, MaxBytes: 1024, Eviction: main.EvictionLRU})
+	entities := fillStore(t, store, 3)
+
+	tooLarge := &main.Entity{Uuid: entities[0].Uuid, Data: strings.Repeat("x", 2048)}
+	if err := store.Update(ctx, tooLarge, 0); err != main.ErrEntityTooLarge {
+		t.Fatalf("Expected too large update to fail, got %v", err)
+	}
+	checkErr(store.Create(ctx, newTestEntity("new")))
+	if isStored(store, entities[0]) {
+		t.Error("Failed update made entity recently used")
+	}
+	if !isStored(store, entities[1]) {
+		t.Error("Entity other than least recently used was evicted")
+	}
+}
+
+func TestFakeStore_EvictionFIFO(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 3, Eviction: main.EvictionFIFO})
+	entities := fillStore(t, store, 3)
+
+	checkErr(store.Get(ctx, &main.Entity{Uuid: entities[0].Uuid}))
+	checkErr(store.Create(ctx, newTestEntity("new")))
+
+	if isStored(store, entities[0]) {
+		t.Error("Oldest entity was not evicted")
+	}
+	if !isStored(store, entities[1]) {
+		t.Error("Entity other than oldest was evicted")
+	}
+}
+
+func TestFakeStore_MaxBytes(t *testing.T) {
+	entitySize := int64(len(uuid.NewV4().String()) + len("data 0"))
+	store := main.NewFakeStore(&main.MemoryConfig{MaxBytes: entitySize * 2})
+	fillStore(t, store, 5)
+
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 entities in store, got %d", store.Len())
+	}
+	if store.Size() > entitySize*2 {
+		t.Errorf("Store size %d exceeds limit %d", store.Size(), entitySize*2)
+	}
+	if err := store.Create(ctx, newTestEntity(main.RandomString(int(entitySize*2), ""))); err != main.ErrEntityTooLarge {
+		t.Errorf("Expected ErrEntityTooLarge, got %v", err)
+	}
+}
+
+func TestFakeStore_NoEviction(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 2, Eviction: main.EvictionNone})
+	entities := fillStore(t, store, 2)
+
+	if err := store.Create(ctx, newTestEntity("new")); err != main.ErrStoreFull {
+		t.Errorf("Expected ErrStoreFull, got %v", err)
+	}
+	entities[0].Data = "updated"
+	if err := store.Update(ctx, entities[0], 0); err != nil {
+		t.Errorf("Can't update entity in full store: %v", err)
+	}
+}
+
+func TestFakeStore_Concurrent(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 50})
+	workers := 20
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				e := newTestEntity("concurrent")
+				_ = store.Create(ctx, e)
+				_ = store.Get(ctx, &main.Entity{Uuid: e.Uuid})
+				e.Data = "updated"
+				_ = store.Update(ctx, e, 0)
+				_, _ = store.List(ctx, main.ListOptions{Count: 10})
+				if j%2 == 0 {
+					_ = store.Delete(ctx, e, 0)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if store.Len() > 50 {
+		t.Errorf("Store contains %d entities, limit is 50", store.Len())
+	}
+}
+
+func TestFakeStore_Modify(t *testing.T) {
+	store := main.NewFakeStore()
+	e := fillStore(t, store, 1)[0]
+
+	errCancel := fmt.Errorf("cancelled")
+	err := store.Modify(ctx, &main.Entity{Uuid: e.Uuid}, 0, func(e *main.Entity) error {
+		e.Data = "cancelled"
+		return errCancel
+	})
+	if err != errCancel {
+		t.Fatalf("Expected mutation error, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkErr(store.Modify(ctx, &main.Entity{Uuid: e.Uuid}, 0, func(e *main.Entity) error {
+				e.Data += "+"
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	stored := &main.Entity{Uuid: e.Uuid}
+	checkErr(store.Get(ctx, stored))
+	if stored.Data != e.Data+"++++++++++" || stored.Version != 11 {
+		t.Errorf("Concurrent modifications are lost: data '%s', version %d", stored.Data, stored.Version)
+	}
+}
+
+func TestFakeStore_BulkCreate(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 3, Eviction: main.EvictionNone})
+	existing := fillStore(t, store, 2)[0]
+
+	// the third new entity doesn't fit, so atomic operation is rolled back
+	batch := []main.Entity{
+		{Uuid: existing.Uuid, Data: "replaced"},
+		*newTestEntity("new 1"),
+		*newTestEntity("new 2"),
+	}
+	errs, err := store.BulkCreate(ctx, batch, main.BulkOptions{Atomic: true, Upsert: true})
+	checkErr(err)
+	if errs[0] != main.ErrBulkAborted || errs[1] != main.ErrBulkAborted || errs[2] != main.ErrStoreFull {
+		t.Errorf("Unexpected results of atomic bulk create: %v", errs)
+	}
+	stored := &main.Entity{Uuid: existing.Uuid}
+	checkErr(store.Get(ctx, stored))
+	if store.Len() != 2 || stored.Data != existing.Data || stored.Version != 1 {
+		t.Errorf("Atomic bulk create is not rolled back: %d entities, %+v", store.Len(), stored)
+	}
+
+	errs, err = store.BulkCreate(ctx, batch, main.BulkOptions{Upsert: false})
+	checkErr(err)
+	if errs[0] != main.ErrEntityExists || errs[1] != nil || errs[2] != main.ErrStoreFull {
+		t.Errorf("Unexpected results of best-effort bulk create: %v", errs)
+	}
+	if store.Len() != 3 || batch[1].Version != 1 {
+		t.Errorf("Best-effort bulk create stored %d entities", store.Len())
+	}
+}
+
+func TestFakeStore_BulkCreateAtomicEviction(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 3, MaxBytes: 1024, Eviction: main.EvictionLRU})
+	existing := fillStore(t, store, 3)
+
+	// the second entity is too large, so nothing is evicted for the first one
+	batch := []main.Entity{*newTestEntity("new"), *newTestEntity(strings.Repeat("x", 2048))}
+	errs, err := store.BulkCreate(ctx, batch, main.BulkOptions{Atomic: true})
+	checkErr(err)
+	if errs[0] != main.ErrBulkAborted || errs[1] != main.ErrEntityTooLarge {
+		t.Errorf("Unexpected results of atomic bulk create: %v", errs)
+	}
+	for _, e := range existing {
+		if !isStored(store, e) {
+			t.Errorf("Entity %s is evicted by failed atomic bulk create", e.Uuid)
+		}
+	}
+
+	errs, err = store.BulkCreate(ctx, batch[:1], main.BulkOptions{Atomic: true})
+	checkErr(err)
+	if errs[0] != nil || !isStored(store, &batch[0]) || isStored(store, existing[0]) {
+		t.Errorf("Successful atomic bulk create doesn't evict oldest entity: %v", errs)
+	}
+}
+
+func TestFakeStore_BulkCreateAtomicOverCapacity(t *testing.T) {
+	for _, eviction := range []string{main.EvictionLRU, main.EvictionFIFO} {
+		store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 3, Eviction: eviction})
+		existing := fillStore(t, store, 2)
+
+		batch := make([]main.Entity, 4)
+		for i := range batch {
+			batch[i] = *newTestEntity("batch")
+		}
+		errs, err := store.BulkCreate(ctx, batch, main.BulkOptions{Atomic: true})
+		checkErr(err)
+		if errs[3] != main.ErrStoreFull || errs[0] != main.ErrBulkAborted {
+			t.Errorf("Expected atomic bulk larger than store to fail with %s eviction: %v", eviction, errs)
+		}
+		for i := range batch {
+			if isStored(store, &batch[i]) {
+				t.Errorf("Entity of failed atomic bulk is stored with %s eviction", eviction)
+			}
+		}
+		for _, e := range existing {
+			if !isStored(store, e) {
+				t.Errorf("Entity %s is evicted by failed atomic bulk create with %s eviction", e.Uuid, eviction)
+			}
+		}
+	}
+}
+
+func TestFakeStore_CollectionLimit(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxCount: 10, MaxCollections: 2})
+	checkErr(store.CreateCollection(ctx, "first"))
+	checkErr(store.CreateCollection(ctx, "second"))
+	if err := store.CreateCollection(ctx, "third"); err != main.ErrTooManyCollections {
+		t.Errorf("Expected collection count to be limited, got %v", err)
+	}
+	checkErr(store.DropCollection(ctx, "first"))
+	checkErr(store.CreateCollection(ctx, "third"))
+}
+
+func TestFakeStore_FailedUpsertKeepsEntity(t *testing.T) {
+	store := main.NewFakeStore(&main.MemoryConfig{MaxBytes: 1024, Eviction: main.EvictionNone})
+	existing := fillStore(t, store, 1)[0]
+
+	batch := []main.Entity{{Uuid: existing.Uuid, Data: strings.Repeat("x", 2048)}}
+	errs, err := store.BulkCreate(ctx, batch, main.BulkOptions{Upsert: true})
+	checkErr(err)
+	if errs[0] != main.ErrEntityTooLarge {
+		t.Errorf("Expected too large entity to be rejected, got %v", errs[0])
+	}
+	stored := &main.Entity{Uuid: existing.Uuid}
+	checkErr(store.Get(ctx, stored))
+	if stored.Data != existing.Data || store.Size() != int64(len(existing.Uuid)+len(existing.Data)) {
+		t.Errorf("Existing entity is changed by failed upsert: %+v", stored)
+	}
+}
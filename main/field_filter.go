@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Operators of document field conditions
+const (
+	OpEqual          = "eq"
+	OpNotEqual       = "ne"
+	OpGreater        = "gt"
+	OpGreaterOrEqual = "gte"
+	OpLess           = "lt"
+	OpLessOrEqual    = "lte"
+	OpExists         = "exists"
+)
+
+var comparisonOperators = map[string]string{
+	OpGreater:        ">",
+	OpGreaterOrEqual: ">=",
+	OpLess:           "<",
+	OpLessOrEqual:    "<=",
+}
+
+// FieldCondition checks value of entity document field
+//
+// Path is split by dots, array elements are referenced by index, negative index counts from the end.
+// Missing fields match only `ne` condition. Numbers are compared by exact decimal value and strings byte-wise,
+// values of other types never match comparison operators
+type FieldCondition struct {
+	Path  []string
+	Op    string
+	Value interface{} // decoded JSON value, nil for `exists`
+}
+
+// ParseFieldCondition parses condition in `path:op:value` or `path:exists` form
+//
+// Value is parsed as JSON if possible, otherwise it's used as string, so both `status:eq:active`
+// and `status:eq:"active"` compare field with string `active`
+func ParseFieldCondition(condition string) (FieldCondition, error) {
+	parts := strings.SplitN(condition, ":", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return FieldCondition{}, fmt.Errorf("invalid field condition: %s, path:op:value is expected", condition)
+	}
+	c := FieldCondition{Path: strings.Split(parts[0], "."), Op: parts[1]}
+	if len(parts) == 3 {
+		if err := decodeJSON([]byte(parts[2]), &c.Value); err != nil {
+			c.Value = parts[2]
+		}
+	}
+	if c.Op != OpExists && len(parts) != 3 {
+		return FieldCondition{}, fmt.Errorf("missing value of field condition: %s", condition)
+	}
+	return c, c.Validate()
+}
+
+// Validate checks operator is known and can be used with condition value
+func (c *FieldCondition) Validate() error {
+	for _, token := range c.Path {
+		if token == "" {
+			return fmt.Errorf("invalid field path: %s", strings.Join(c.Path, "."))
+		}
+	}
+	switch c.Op {
+	case OpEqual, OpNotEqual:
+		switch c.Value.(type) {
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("only scalar values can be compared")
+		}
+	case OpExists:
+	case OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual:
+		switch c.Value.(type) {
+		case json.Number, string:
+		default:
+			return fmt.Errorf("%s operator requires number or string value", c.Op)
+		}
+	default:
+		return fmt.Errorf("invalid field operator: %s", c.Op)
+	}
+	return nil
+}
+
+// sqlCondition builds SQL condition over `document` JSONB column, adding its parameters to `args`
+func (c *FieldCondition) sqlCondition(args *[]interface{}) string {
+	*args = append(*args, pq.Array(c.Path))
+	field := fmt.Sprintf("document #> $%d::text[]", len(*args))
+	if c.Op == OpExists {
+		return field + " IS NOT NULL"
+	}
+	value, _ := json.Marshal(c.Value)
+	switch c.Op {
+	case OpEqual:
+		*args = append(*args, string(value))
+		return fmt.Sprintf("%s = $%d::jsonb", field, len(*args))
+	case OpNotEqual:
+		*args = append(*args, string(value))
+		return fmt.Sprintf("(%s = $%d::jsonb) IS NOT TRUE", field, len(*args))
+	}
+	operator := comparisonOperators[c.Op]
+	textField := fmt.Sprintf("document #>> $%d::text[]", len(*args))
+	// CASE guarantees cast is done only for values of proper type
+	if number, ok := c.Value.(json.Number); ok {
+		*args = append(*args, number.String())
+		return fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'number' THEN (%s)::numeric %s $%d::numeric END",
+			field, textField, operator, len(*args))
+	}
+	*args = append(*args, c.Value)
+	return fmt.Sprintf(`CASE WHEN jsonb_typeof(%s) = 'string' THEN %s COLLATE "C" %s $%d END`,
+		field, textField, operator, len(*args))
+}
+
+// lookupField finds value of decoded document by path the same way as PostgreSQL `#>` operator
+//
+// Array elements are referenced by integer index, negative index counts from the end of array
+func lookupField(doc interface{}, path []string) (interface{}, bool) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			index, err := strconv.Atoi(strings.TrimLeft(token, " \t\n\v\f\r"))
+			if err != nil {
+				return nil, false
+			}
+			if index < 0 {
+				index += len(node)
+			}
+			if index < 0 || index >= len(node) {
+				return nil, false
+			}
+			doc = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// maxNumberExponent limits decimal exponent of compared numbers, larger numbers can't be stored
+// as PostgreSQL numeric either and would take too much memory to be compared exactly
+const maxNumberExponent = 131072
+
+// parseNumber converts JSON number to exact rational value
+func parseNumber(n json.Number) (*big.Rat, bool) {
+	text := n.String()
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		exponent, err := strconv.Atoi(text[i+1:])
+		if err != nil || exponent > maxNumberExponent || exponent < -maxNumberExponent {
+			return nil, false
+		}
+	}
+	return new(big.Rat).SetString(text)
+}
+
+// compareNumbers compares JSON numbers exactly like PostgreSQL numeric, `ok` is false for invalid numbers
+func compareNumbers(a, b json.Number) (result int, ok bool) {
+	ratA, okA := parseNumber(a)
+	ratB, okB := parseNumber(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	return ratA.Cmp(ratB), true
+}
+
+// compareValues compares numbers or strings, `ok` is false for values of different types
+func compareValues(a, b interface{}) (result int, ok bool) {
+	switch valueA := a.(type) {
+	case json.Number:
+		valueB, isNumber := b.(json.Number)
+		if !isNumber {
+			return 0, false
+		}
+		return compareNumbers(valueA, valueB)
+	case string:
+		valueB, isString := b.(string)
+		if !isString {
+			return 0, false
+		}
+		return strings.Compare(valueA, valueB), true
+	default:
+		return 0, false
+	}
+}
+
+// matches checks condition against decoded document
+func (c *FieldCondition) matches(doc interface{}) bool {
+	value, found := lookupField(doc, c.Path)
+	switch c.Op {
+	case OpExists:
+		return found
+	case OpEqual:
+		return found && jsonEqual(value, c.Value)
+	case OpNotEqual:
+		return !found || !jsonEqual(value, c.Value)
+	}
+	if !found {
+		return false
+	}
+	result, ok := compareValues(value, c.Value)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case OpGreater:
+		return result > 0
+	case OpGreaterOrEqual:
+		return result >= 0
+	case OpLess:
+		return result < 0
+	default:
+		return result <= 0
+	}
+}
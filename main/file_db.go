@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCompactInterval = 5 * time.Minute
+
+const (
+	opPut    = "put"
+	opDelete = "del"
+)
+
+// logRecord is single line of storage file
+type logRecord struct {
+	Op string `json:"op"`
+	Entity
+}
+
+// FileStore is entity storage persisted to append-only log file
+//
+// All entities are kept in memory, every change is appended to the log.
+// Log is periodically compacted, so it contains only latest versions of existing entities
+type FileStore struct {
+	mu       sync.Mutex // serializes writes to the log
+	mem      *FakeStore
+	path     string
+	sync     bool
+	file     *os.File
+	writer   *bufio.Writer
+	records  int // count of records in the log, used to detect garbage
+	stopChan chan struct{}
+	stopOnce sync.Once
+
+	*collectionRegistry
+}
+
+// NewFileStore opens storage file, replaying existing log into memory
+//
+// Other collections are stored in `<path>.collections` directory, single file per collection
+func NewFileStore(config *FileStorageConfig) (*FileStore, error) {
+	s, err := openFileStore(config)
+	if err != nil {
+		return nil, err
+	}
+	collectionsDir := config.Path + ".collections"
+	registry := newCollectionRegistry(s)
+	registry.create = func(name string) (EntityStore, error) {
+		cfg := *config
+		cfg.Path = filepath.Join(collectionsDir, name+".log")
+		store, err := openFileStore(&cfg)
+		if err != nil {
+			return nil, err
+		}
+		store.collectionRegistry = registry
+		return store, nil
+	}
+	registry.drop = func(_ string, store EntityStore) error {
+		fileStore := store.(*FileStore)
+		if err := fileStore.closeFile(); err != nil {
+			return err
+		}
+		return os.Remove(fileStore.path)
+	}
+	s.collectionRegistry = registry
+
+	paths, _ := filepath.Glob(filepath.Join(collectionsDir, "*.log"))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".log")
+		if ValidateCollectionName(name) != nil {
+			continue
+		}
+		store, err := registry.create(name)
+		if err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("can't open collection %s: %v", name, err)
+		}
+		registry.stores[name] = store
+	}
+	return s, nil
+}
+
+func openFileStore(config *FileStorageConfig) (*FileStore, error) {
+	s := &FileStore{
+		mem:      newFakeStore(nil),
+		path:     config.Path,
+		sync:     config.Sync,
+		stopChan: make(chan struct{}),
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.Compact(); err != nil {
+		return nil, err
+	}
+	interval := config.CompactInterval
+	if interval == 0 {
+		interval = defaultCompactInterval
+	}
+	go s.compactPeriodically(interval)
+	return s, nil
+}
+
+// load replays log file into memory, incomplete record at the end of file is dropped
+func (s *FileStore) load() error {
+	file, err := os.OpenFile(s.path, os.O_RDONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := bufio.NewReader(file)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logger.Warn("Dropping incomplete record at the end of storage file", "path", s.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("corrupted storage file %s, line %d: %v", s.path, lineNum, err)
+		}
+		s.apply(&rec)
+		s.records++
+	}
+}
+
+func (s *FileStore) apply(rec *logRecord) {
+	ctx := context.Background()
+	switch rec.Op {
+	case opPut:
+		_ = s.mem.restore(&rec.Entity)
+	case opDelete:
+		_ = s.mem.Delete(ctx, &rec.Entity, 0)
+	}
+}
+
+func (s *FileStore) compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				logger.Error("Storage compaction failed", "path", s.path, "error", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// Compact rewrites log so it contains single record per existing entity
+func (s *FileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil && s.records == s.mem.Len() {
+		return nil // nothing to compact
+	}
+
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	entities := s.mem.snapshot()
+	writer := bufio.NewWriter(tmp)
+	for i := range entities {
+		if err = writeRecord(writer, &logRecord{Op: opPut, Entity: entities[i]}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	_ = tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err = syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	s.writer = bufio.NewWriter(s.file)
+	s.records = len(entities)
+	return nil
+}
+
+// syncDir flushes directory entries, so renamed file survives crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+	return dir.Sync()
+}
+
+// Close stops compaction and closes storage file, closing default collection closes all collections
+func (s *FileStore) Close() error {
+	var others []*FileStore
+	if s.collectionRegistry != nil {
+		s.collectionRegistry.mu.Lock()
+		if s.stores[DefaultCollection] == EntityStore(s) {
+			for name, store := range s.stores {
+				if name != DefaultCollection {
+					others = append(others, store.(*FileStore))
+				}
+			}
+		}
+		s.collectionRegistry.mu.Unlock()
+	}
+	for _, store := range others {
+		_ = store.closeFile()
+	}
+	return s.closeFile()
+}
+
+func (s *FileStore) closeFile() error {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func (s *FileStore) write(records []*logRecord) error {
+	for _, rec := range records {
+		if err := writeRecord(s.writer, rec); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if s.sync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func writeRecord(writer *bufio.Writer, rec *logRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return err
+	}
+	return writer.WriteByte('\n')
+}
+
+// append writes records to the log, changes are applied in memory only after successful write
+//
+// Failed write is rolled back: buffered data is dropped and partially written records are truncated
+func (s *FileStore) append(records ...*logRecord) error {
+	offset, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err := s.write(records); err != nil {
+		s.writer.Reset(s.file)
+		if truncErr := s.file.Truncate(offset); truncErr != nil {
+			return fmt.Errorf("%v, can't truncate storage file %s: %v", err, s.path, truncErr)
+		}
+		return err
+	}
+	for _, rec := range records {
+		s.apply(rec)
+	}
+	s.records += len(records)
+	return nil
+}
+
+func (s *FileStore) Get(ctx context.Context, e *Entity) error {
+	return s.mem.Get(ctx, e)
+}
+
+func (s *FileStore) List(ctx context.Context, opts ListOptions) (*EntityPage, error) {
+	return s.mem.List(ctx, opts)
+}
+
+func (s *FileStore) Search(ctx context.Context, query string, count int) ([]SearchResult, error) {
+	return s.mem.Search(ctx, query, count)
+}
+
+func (s *FileStore) Create(_ context.Context, e *Entity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.Version = 1
+	e.UpdatedAt = modificationTime()
+	return s.append(&logRecord{Op: opPut, Entity: *e})
+}
+
+// current returns stored entity checking its version
+func (s *FileStore) current(ctx context.Context, uuid string, ifVersion int64) (*Entity, error) {
+	current := &Entity{Uuid: uuid}
+	if err := s.mem.Get(ctx, current); err != nil {
+		return nil, err
+	}
+	if ifVersion != 0 && current.Version != ifVersion {
+		return nil, ErrVersionMismatch
+	}
+	return current, nil
+}
+
+func (s *FileStore) Update(ctx context.Context, e *Entity, ifVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.current(ctx, e.Uuid, ifVersion)
+	if err != nil {
+		return err
+	}
+	e.Version = current.Version + 1
+	e.UpdatedAt = modificationTime()
+	return s.append(&logRecord{Op: opPut, Entity: *e})
+}
+
+func (s *FileStore) Modify(ctx context.Context, e *Entity, ifVersion int64, mutate func(e *Entity) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.current(ctx, e.Uuid, ifVersion)
+	if err != nil {
+		return err
+	}
+	if err := mutate(current); err != nil {
+		return err
+	}
+	current.Uuid = e.Uuid
+	current.Version++
+	current.UpdatedAt = modificationTime()
+	if err := s.append(&logRecord{Op: opPut, Entity: *current}); err != nil {
+		return err
+	}
+	*e = *current
+	return nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, e *Entity, ifVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.current(ctx, e.Uuid, ifVersion); err != nil {
+		return err
+	}
+	return s.append(&logRecord{Op: opDelete, Entity: Entity{Uuid: e.Uuid}})
+}
+
+func (s *FileStore) AddEntities(ctx context.Context, entities []Entity, opts LoadOptions) error {
+	return opts.forEachChunk(len(entities), func(start, end int) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		records := make([]*logRecord, 0, end-start)
+		now := modificationTime()
+		for i := start; i < end; i++ {
+			if _, err := s.current(ctx, entities[i].Uuid, 0); err == nil {
+				continue
+			}
+			entities[i].Version = 1
+			entities[i].UpdatedAt = now
+			records = append(records, &logRecord{Op: opPut, Entity: entities[i]})
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return s.append(records...)
+	})
+}
+
+func (s *FileStore) BulkCreate(ctx context.Context, entities []Entity, opts BulkOptions) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(entities))
+	records := make([]*logRecord, 0, len(entities))
+	now := modificationTime()
+	for i := range entities {
+		e := &entities[i]
+		e.Version = 1
+		e.UpdatedAt = now
+		current, err := s.current(ctx, e.Uuid, 0)
+		switch {
+		case err == nil && !opts.Upsert:
+			errs[i] = ErrEntityExists
+			continue
+		case err == nil:
+			e.Version = current.Version + 1
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, err
+		}
+		records = append(records, &logRecord{Op: opPut, Entity: *e})
+	}
+	if opts.Atomic && abortBulk(errs) {
+		return errs, nil
+	}
+	return errs, s.append(records...)
+}
+
+func (s *FileStore) BulkDelete(ctx context.Context, uuids []string, opts BulkOptions) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]error, len(uuids))
+	records := make([]*logRecord, 0, len(uuids))
+	for i, uuid := range uuids {
+		if _, err := s.current(ctx, uuid, 0); err != nil {
+			errs[i] = err
+			continue
+		}
+		records = append(records, &logRecord{Op: opDelete, Entity: Entity{Uuid: uuid}})
+	}
+	if opts.Atomic && abortBulk(errs) {
+		return errs, nil
+	}
+	return errs, s.append(records...)
+}
+
+func (s *FileStore) DeleteMatching(_ context.Context, filter EntityFilter) (int64, error) {
+	match, err := filter.Matcher()
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []*logRecord
+	for _, e := range s.mem.snapshot() {
+		if match(&e) {
+			records = append(records, &logRecord{Op: opDelete, Entity: Entity{Uuid: e.Uuid}})
+		}
+	}
+	if err := s.append(records...); err != nil {
+		return 0, err
+	}
+	return int64(len(records)), nil
+}
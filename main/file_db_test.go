@@ -0,0 +1,205 @@
+package main_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+)
+
+func tempStorageConfig(t *testing.T) (*main.FileStorageConfig, func()) {
+	dir, err := ioutil.TempDir("", "too-simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &main.FileStorageConfig{Path: filepath.Join(dir, "data", "entities.log")}
+	return cfg, func() { _ = os.RemoveAll(dir) }
+}
+
+func countLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestFileStore_Persistence(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+
+	store, err := main.NewFileStore(cfg)
+	checkErr(err)
+	kept := newTestEntity("kept")
+	updated := newTestEntity("original")
+	deleted := newTestEntity("deleted")
+	for _, e := range []*main.Entity{kept, updated, deleted} {
+		checkErr(store.Create(ctx, e))
+	}
+	updated.Data = "updated"
+	checkErr(store.Update(ctx, updated, 0))
+	checkErr(store.Delete(ctx, deleted, 0))
+	checkErr(store.Close())
+
+	store, err = main.NewFileStore(cfg)
+	checkErr(err)
+	defer func() { _ = store.Close() }()
+
+	e := main.Entity{Uuid: updated.Uuid}
+	checkErr(store.Get(ctx, &e))
+	if e.Data != "updated" {
+		t.Errorf("Expected updated data after reopening, got %s", e.Data)
+	}
+	checkErr(store.Get(ctx, &main.Entity{Uuid: kept.Uuid}))
+	if store.Get(ctx, &main.Entity{Uuid: deleted.Uuid}) == nil {
+		t.Error("Deleted entity is restored after reopening")
+	}
+	// log is compacted on open
+	if lines := countLines(t, cfg.Path); lines != 2 {
+		t.Errorf("Expected 2 records after compaction, got %d", lines)
+	}
+}
+
+// shortWriter writes first `left` bytes and fails afterwards
+type shortWriter struct {
+	writer io.Writer
+	left   int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.left {
+		w.left -= len(p)
+		return w.writer.Write(p)
+	}
+	n, _ := w.writer.Write(p[:w.left])
+	w.left = 0
+	return n, errors.New("no space left on device")
+}
+
+func TestFileStore_FailedWrite(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+
+	store, err := main.NewFileStore(cfg)
+	checkErr(err)
+	kept := newTestEntity("kept")
+	checkErr(store.Create(ctx, kept))
+	before, err := os.Stat(cfg.Path)
+	checkErr(err)
+
+	main.WrapFileStoreWriter(store, func(file io.Writer) io.Writer {
+		return &shortWriter{writer: file, left: 20}
+	})
+	failed := newTestEntity(strings.Repeat("x", 100))
+	if err := store.Create(ctx, failed); err == nil {
+		t.Fatal("Expected failed write to be reported")
+	}
+	after, err := os.Stat(cfg.Path)
+	checkErr(err)
+	if after.Size() != before.Size() {
+		t.Errorf("Partially written record is left in the log: %d bytes instead of %d", after.Size(), before.Size())
+	}
+	if isStored(store, failed) {
+		t.Error("Entity of failed write is stored")
+	}
+
+	// writer is reset to the log file, so following writes succeed
+	added := newTestEntity("added")
+	checkErr(store.Create(ctx, added))
+	checkErr(store.Close())
+
+	store, err = main.NewFileStore(cfg)
+	checkErr(err)
+	defer func() { _ = store.Close() }()
+	if !isStored(store, kept) || !isStored(store, added) || isStored(store, failed) {
+		t.Error("Unexpected entities after reopening log with failed write")
+	}
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+
+	store, err := main.NewFileStore(cfg)
+	checkErr(err)
+	defer func() { _ = store.Close() }()
+
+	e := newTestEntity("data")
+	checkErr(store.Create(ctx, e))
+	for i := 0; i < 10; i++ {
+		e.Data = main.RandomString(10, "")
+		checkErr(store.Update(ctx, e, 0))
+	}
+	if lines := countLines(t, cfg.Path); lines != 11 {
+		t.Errorf("Expected 11 records before compaction, got %d", lines)
+	}
+	checkErr(store.Compact())
+	if lines := countLines(t, cfg.Path); lines != 1 {
+		t.Errorf("Expected single record after compaction, got %d", lines)
+	}
+}
+
+func TestFileStore_IncompleteRecord(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+
+	store, err := main.NewFileStore(cfg)
+	checkErr(err)
+	e := newTestEntity("data")
+	checkErr(store.Create(ctx, e))
+	checkErr(store.Close())
+
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND, 0640)
+	checkErr(err)
+	_, err = f.WriteString(`{"op":"put","uuid":"abc`)
+	checkErr(err)
+	checkErr(f.Close())
+
+	store, err = main.NewFileStore(cfg)
+	if err != nil {
+		t.Fatalf("Can't open storage with incomplete record: %v", err)
+	}
+	defer func() { _ = store.Close() }()
+	checkErr(store.Get(ctx, &main.Entity{Uuid: e.Uuid}))
+	checkErr(store.Create(ctx, newTestEntity("new")))
+	if lines := countLines(t, cfg.Path); lines != 2 {
+		t.Errorf("Expected 2 records, got %d", lines)
+	}
+}
+
+func TestFileStore_Collections(t *testing.T) {
+	cfg, cleanup := tempStorageConfig(t)
+	defer cleanup()
+
+	store, err := main.NewFileStore(cfg)
+	checkErr(err)
+	checkErr(store.CreateCollection(ctx, "suite_one"))
+	collection, err := store.Collection(ctx, "suite_one")
+	checkErr(err)
+	e := newTestEntity("in collection")
+	checkErr(collection.Create(ctx, e))
+	if store.Get(ctx, &main.Entity{Uuid: e.Uuid}) == nil {
+		t.Error("Entity of collection is found in default collection")
+	}
+	checkErr(store.CreateCollection(ctx, "dropped"))
+	checkErr(store.DropCollection(ctx, "dropped"))
+	checkErr(store.Close())
+
+	store, err = main.NewFileStore(cfg)
+	checkErr(err)
+	defer func() { _ = store.Close() }()
+
+	names, err := store.Collections(ctx)
+	checkErr(err)
+	if strings.Join(names, ",") != "entity,suite_one" {
+		t.Errorf("Unexpected collections after reopening: %v", names)
+	}
+	collection, err = store.Collection(ctx, "suite_one")
+	checkErr(err)
+	checkErr(collection.Get(ctx, &main.Entity{Uuid: e.Uuid}))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Match modes of entity filter
+const (
+	MatchWildcard = "wildcard" // `*` matches any sequence of characters, the whole data has to match
+	MatchPrefix   = "prefix"
+	MatchSuffix   = "suffix"
+	MatchContains = "contains"
+	MatchExact    = "exact"
+	MatchRegex    = "regex" // data contains match of regular expression
+)
+
+var validUUIDPrefix = regexp.MustCompile(`^[0-9a-f-]*$`)
+
+// EntityFilter selects entities by data, uuid and document fields
+//
+// Filters have the same semantics in all storage backends. Regular expressions are checked
+// using Go syntax, so only the subset common for Go and PostgreSQL should be used
+type EntityFilter struct {
+	Value      string
+	Match      string
+	IgnoreCase bool
+	UUIDPrefix string
+	Where      []FieldCondition // all conditions have to match
+}
+
+// Validate sets default match mode and checks filter is valid
+func (f *EntityFilter) Validate() error {
+	if f.Match == "" {
+		f.Match = MatchWildcard
+	}
+	switch f.Match {
+	case MatchWildcard, MatchPrefix, MatchSuffix, MatchContains, MatchExact:
+	case MatchRegex:
+		if _, err := regexp.Compile(f.Value); err != nil {
+			return fmt.Errorf("invalid regex filter: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid match mode: %s", f.Match)
+	}
+	if !validUUIDPrefix.MatchString(f.UUIDPrefix) {
+		return fmt.Errorf("invalid uuid prefix: %s, only lowercase hex digits and dashes are allowed", f.UUIDPrefix)
+	}
+	for i := range f.Where {
+		if err := f.Where[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeLike escapes special characters of LIKE pattern
+func escapeLike(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `%`, `\%`, -1)
+	return strings.Replace(value, `_`, `\_`, -1)
+}
+
+// likePattern converts filter value to LIKE pattern
+func (f *EntityFilter) likePattern() string {
+	switch f.Match {
+	case MatchPrefix:
+		return escapeLike(f.Value) + "%"
+	case MatchSuffix:
+		return "%" + escapeLike(f.Value)
+	case MatchContains:
+		return "%" + escapeLike(f.Value) + "%"
+	case MatchWildcard:
+		return strings.Replace(escapeLike(f.Value), "*", "%", -1)
+	default:
+		return escapeLike(f.Value)
+	}
+}
+
+// sqlConditions builds SQL conditions of the filter, adding their parameters to `args`
+func (f *EntityFilter) sqlConditions(args *[]interface{}) []string {
+	var conditions []string
+	if f.Value != "" {
+		operator, value := "LIKE", f.likePattern()
+		if f.IgnoreCase {
+			operator = "ILIKE"
+		}
+		if f.Match == MatchRegex {
+			operator, value = "~", f.Value
+			if f.IgnoreCase {
+				operator = "~*"
+			}
+		}
+		*args = append(*args, value)
+		conditions = append(conditions, fmt.Sprintf("data %s $%d", operator, len(*args)))
+	}
+	if f.UUIDPrefix != "" {
+		*args = append(*args, f.UUIDPrefix+"%")
+		conditions = append(conditions, fmt.Sprintf("uuid LIKE $%d", len(*args)))
+	}
+	for i := range f.Where {
+		conditions = append(conditions, f.Where[i].sqlCondition(args))
+	}
+	return conditions
+}
+
+// Matcher creates function checking if entity matches the filter
+func (f *EntityFilter) Matcher() (func(e *Entity) bool, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	value := f.Value
+	normalize := func(s string) string { return s }
+	if f.IgnoreCase {
+		normalize = strings.ToLower
+		value = normalize(value)
+	}
+
+	var matchData func(data string) bool
+	switch f.Match {
+	case MatchPrefix:
+		matchData = func(data string) bool { return strings.HasPrefix(normalize(data), value) }
+	case MatchSuffix:
+		matchData = func(data string) bool { return strings.HasSuffix(normalize(data), value) }
+	case MatchContains:
+		matchData = func(data string) bool { return strings.Contains(normalize(data), value) }
+	case MatchExact:
+		matchData = func(data string) bool { return normalize(data) == value }
+	case MatchRegex:
+		expr := f.Value
+		if f.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re := regexp.MustCompile(expr)
+		matchData = re.MatchString
+	case MatchWildcard:
+		parts := strings.Split(value, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		re := regexp.MustCompile("(?s)^" + strings.Join(parts, ".*") + "$")
+		matchData = func(data string) bool { return re.MatchString(normalize(data)) }
+	}
+	if f.Value == "" {
+		matchData = func(string) bool { return true }
+	}
+
+	return func(e *Entity) bool {
+		if !strings.HasPrefix(e.Uuid, f.UUIDPrefix) || !matchData(e.Data) {
+			return false
+		}
+		if len(f.Where) == 0 {
+			return true
+		}
+		var doc interface{}
+		if len(e.Document) > 0 {
+			if err := decodeJSON(e.Document, &doc); err != nil {
+				return false
+			}
+		}
+		for i := range f.Where {
+			if !f.Where[i].matches(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
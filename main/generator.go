@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Size distributions of generated data
+const (
+	DistributionFixed   = "fixed"   // all entities have `size` bytes of data
+	DistributionUniform = "uniform" // sizes are uniformly distributed between `min_size` and `max_size`
+	DistributionNormal  = "normal"  // sizes are normally distributed around `size`, limited by `min_size` and `max_size`
+)
+
+// generatedDataPrefix starts data of every generated entity
+const generatedDataPrefix = "RANDOM DATA: "
+
+// DataGenerator generates random entities in parallel, batch by batch
+//
+// Every batch uses own random source derived from the seed, so generated entities depend
+// only on configuration and not on the number of workers or their scheduling
+type DataGenerator struct {
+	generated int64 // count of generated entities, accessed atomically, first for 64-bit alignment
+	config    InitialData
+	batchSize int
+	workers   int
+}
+
+// NewDataGenerator validates configuration, random seed is used if it's not set
+func NewDataGenerator(config InitialData) (*DataGenerator, error) {
+	if config.Count < 0 || config.Size < 0 || config.MinSize < 0 || config.MaxSize < 0 || config.SizeStdDev < 0 {
+		return nil, fmt.Errorf("initial data count and sizes can't be negative")
+	}
+	switch config.Distribution {
+	case "", DistributionFixed:
+		config.Distribution = DistributionFixed
+	case DistributionUniform:
+		if config.MaxSize < config.MinSize || config.MaxSize == 0 {
+			return nil, fmt.Errorf("uniform distribution requires max_size not less than min_size")
+		}
+	case DistributionNormal:
+		if config.MaxSize != 0 && config.MaxSize < config.MinSize {
+			return nil, fmt.Errorf("max_size is less than min_size")
+		}
+	default:
+		return nil, fmt.Errorf("invalid size distribution: %s", config.Distribution)
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	g := &DataGenerator{config: config, batchSize: config.ChunkSize, workers: config.Workers}
+	if g.batchSize <= 0 {
+		g.batchSize = DefaultLoadChunkSize
+	}
+	if g.workers <= 0 {
+		g.workers = runtime.NumCPU()
+	}
+	return g, nil
+}
+
+// Seed returns seed of generated data, it can be used to generate the same data again
+func (g *DataGenerator) Seed() int64 {
+	return g.config.Seed
+}
+
+// Generated returns count of already generated entities
+func (g *DataGenerator) Generated() int64 {
+	return atomic.LoadInt64(&g.generated)
+}
+
+// Batches starts generation, batches are sent in order until all entities are generated or `ctx` is done
+//
+// At most `workers` batches are generated ahead of the consumer
+func (g *DataGenerator) Batches(ctx context.Context) <-chan []Entity {
+	out := make(chan []Entity, g.workers)
+	batches := (g.config.Count + g.batchSize - 1) / g.batchSize
+	go func() {
+		defer close(out)
+		for first := 0; first < batches; first += g.workers {
+			round := make([][]Entity, g.workers)
+			if batches-first < g.workers {
+				round = round[:batches-first]
+			}
+			var wg sync.WaitGroup
+			for i := range round {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					round[i] = g.batch(first + i)
+				}(i)
+			}
+			wg.Wait()
+			for _, batch := range round {
+				select {
+				case out <- batch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// batchSeed derives seed of batch random source using SplitMix64 mixing function
+func batchSeed(seed int64, index int) int64 {
+	z := uint64(seed) + uint64(index+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
+
+func (g *DataGenerator) batch(index int) []Entity {
+	rng := rand.New(rand.NewSource(batchSeed(g.config.Seed, index)))
+	count := g.batchSize
+	if rest := g.config.Count - index*g.batchSize; rest < count {
+		count = rest
+	}
+	entities := make([]Entity, count)
+	for i := range entities {
+		entities[i] = Entity{
+			Uuid: randomUUID(rng),
+			Data: string(randomBytes(rng, g.size(rng), generatedDataPrefix, DataRandCS)),
+		}
+	}
+	atomic.AddInt64(&g.generated, int64(count))
+	return entities
+}
+
+// size returns data size of the next entity according to configured distribution
+func (g *DataGenerator) size(rng *rand.Rand) int {
+	cfg := &g.config
+	switch cfg.Distribution {
+	case DistributionUniform:
+		return cfg.MinSize + rng.Intn(cfg.MaxSize-cfg.MinSize+1)
+	case DistributionNormal:
+		size := cfg.Size + int(math.Round(rng.NormFloat64()*cfg.SizeStdDev))
+		if size < cfg.MinSize {
+			size = cfg.MinSize
+		}
+		if cfg.MaxSize > 0 && size > cfg.MaxSize {
+			size = cfg.MaxSize
+		}
+		return size
+	default:
+		return cfg.Size
+	}
+}
+
+// randomUUID generates version 4 UUID using given random source
+func randomUUID(rng *rand.Rand) string {
+	var b [16]byte
+	_, _ = rng.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// loadInitialData streams generated entities to the store, batch by batch, reporting progress
+func loadInitialData(ctx context.Context, store EntityStore, initial *InitialData, progress *seedProgress) error {
+	generator, err := NewDataGenerator(*initial)
+	if err != nil {
+		return err
+	}
+	progress.start(generator)
+	logger.Info("Generating initial entities", "count", initial.Count, "seed", generator.Seed())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops generation if loading fails
+
+	started := time.Now()
+	loaded := 0
+	for batch := range generator.Batches(ctx) {
+		if err := store.AddEntities(ctx, batch, LoadOptions{ChunkSize: len(batch)}); err != nil {
+			return fmt.Errorf("loaded %d of %d entities: %w", loaded, initial.Count, err)
+		}
+		loaded += len(batch)
+		progress.insert(len(batch))
+		logger.Debug("Loaded initial entities", "loaded", loaded, "total", initial.Count,
+			"elapsed", time.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
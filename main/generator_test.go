@@ -0,0 +1,82 @@
+package main_test
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+)
+
+var uuid4Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func generate(t *testing.T, config main.InitialData) []main.Entity {
+	generator, err := main.NewDataGenerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entities []main.Entity
+	for batch := range generator.Batches(context.Background()) {
+		entities = append(entities, batch...)
+	}
+	return entities
+}
+
+func TestDataGenerator_Deterministic(t *testing.T) {
+	config := main.InitialData{Count: 95, Size: 40, ChunkSize: 10, Seed: 42, Workers: 1}
+	first := generate(t, config)
+	config.Workers = 4
+	second := generate(t, config)
+	if len(first) != 95 || !reflect.DeepEqual(first, second) {
+		t.Fatalf("Data generated with the same seed differs")
+	}
+	for _, e := range first {
+		if !uuid4Pattern.MatchString(e.Uuid) || len(e.Data) != 40 {
+			t.Fatalf("Invalid generated entity: %+v", e)
+		}
+	}
+
+	config.Seed = 43
+	if third := generate(t, config); reflect.DeepEqual(first, third) {
+		t.Errorf("Data generated with different seeds is the same")
+	}
+}
+
+func TestDataGenerator_Distributions(t *testing.T) {
+	uniform := generate(t, main.InitialData{Count: 500, Distribution: main.DistributionUniform, MinSize: 20, MaxSize: 30})
+	sizes := make(map[int]bool)
+	for _, e := range uniform {
+		if len(e.Data) < 20 || len(e.Data) > 30 {
+			t.Fatalf("Size %d is out of uniform range", len(e.Data))
+		}
+		sizes[len(e.Data)] = true
+	}
+	if len(sizes) != 11 {
+		t.Errorf("Expected all 11 sizes of uniform range, got %d", len(sizes))
+	}
+
+	normal := generate(t, main.InitialData{Count: 2000, Size: 100, SizeStdDev: 10, MaxSize: 110,
+		Distribution: main.DistributionNormal})
+	total := 0
+	for _, e := range normal {
+		if len(e.Data) > 110 {
+			t.Fatalf("Size %d exceeds max_size", len(e.Data))
+		}
+		total += len(e.Data)
+	}
+	if mean := total / len(normal); mean < 90 || mean > 100 {
+		t.Errorf("Unexpected mean size of normal distribution: %d", mean)
+	}
+
+	invalid := []main.InitialData{
+		{Count: 1, Distribution: "poisson"},
+		{Count: 1, Distribution: main.DistributionUniform, MinSize: 10, MaxSize: 5},
+		{Count: -1},
+	}
+	for _, config := range invalid {
+		if _, err := main.NewDataGenerator(config); err == nil {
+			t.Errorf("No error for invalid configuration %+v", config)
+		}
+	}
+}
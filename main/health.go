@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of health checks
+const (
+	CheckOK   = "ok"
+	CheckFail = "fail"
+)
+
+// Statuses of readiness report
+const (
+	StatusReady    = "ready"
+	StatusNotReady = "not ready"
+)
+
+const defaultPingTimeout = 2 * time.Second
+
+// ErrDraining is reported by readiness check while server is drained
+var ErrDraining = errors.New("server is draining")
+
+// HealthCheck is result of single readiness check
+type HealthCheck struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// ReadinessReport is response of readiness endpoint
+type ReadinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// pinger is implemented by stores able to check their connection
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.DB.PingContext(ctx)
+}
+
+func (d *DeferredStore) Ping(ctx context.Context) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	if p, ok := store.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func runCheck(check func() error) HealthCheck {
+	started := time.Now()
+	err := check()
+	result := HealthCheck{Status: CheckOK, LatencyMs: float64(time.Since(started).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = CheckFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkStorage pings database with configured timeout, storage without connection is always available
+func (a *App) checkStorage(ctx context.Context) error {
+	if a.Store == nil {
+		return ErrStoreUnavailable
+	}
+	p, ok := a.Store.(pinger)
+	if !ok {
+		return nil
+	}
+	timeout := a.pingTimeout
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return p.Ping(ctx)
+}
+
+// checkSeeding fails while initial data is loaded if readiness waits for it
+func (a *App) checkSeeding() error {
+	if a.seeding.ready() {
+		return nil
+	}
+	return fmt.Errorf("initial data is not loaded, seeding is %s", a.seeding.Status().State)
+}
+
+func (a *App) checkDrain() error {
+	if a.Draining() {
+		return ErrDraining
+	}
+	return nil
+}
+
+// CheckReadiness runs all readiness checks, server is ready only if all of them pass
+func (a *App) CheckReadiness(ctx context.Context) *ReadinessReport {
+	report := &ReadinessReport{
+		Status: StatusReady,
+		Checks: map[string]HealthCheck{
+			"storage": runCheck(func() error { return a.checkStorage(ctx) }),
+			"seeding": runCheck(a.checkSeeding),
+			"drain":   runCheck(a.checkDrain),
+		},
+	}
+	for _, check := range report.Checks {
+		if check.Status != CheckOK {
+			report.Status = StatusNotReady
+		}
+	}
+	return report
+}
+
+// SetDraining switches drain mode, drained server is reported as not ready, but keeps serving requests
+func (a *App) SetDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&a.draining, value)
+}
+
+// Draining checks if server is drained
+func (a *App) Draining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+// Liveness responds with 200 while process is able to serve requests
+func (a *App) Liveness(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// StartDrain makes readiness check fail, so load balancer takes the server out
+func (a *App) StartDrain(w http.ResponseWriter, r *http.Request) {
+	a.SetDraining(true)
+	respondWithJSON(w, http.StatusOK, map[string]bool{"draining": true})
+}
+
+// StopDrain returns drained server to load balancing
+func (a *App) StopDrain(w http.ResponseWriter, r *http.Request) {
+	a.SetDraining(false)
+	respondWithJSON(w, http.StatusOK, map[string]bool{"draining": false})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Log formats
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+var levelSeverity = map[string]int{LevelDebug: 0, LevelInfo: 1, LevelWarn: 2, LevelError: 3}
+
+// logSink is destination of log records shared by logger and all its children
+type logSink struct {
+	mu       sync.Mutex
+	out      io.Writer
+	severity int
+	format   string
+}
+
+// Logger writes structured records with level, message and key-value fields
+type Logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+// logger is used by the whole server, it's configured by SetupLogging
+var logger = &Logger{sink: &logSink{out: os.Stdout, severity: levelSeverity[LevelInfo], format: LogFormatLogfmt}}
+
+// SetupLogging sets level and format of server logs, info level and logfmt are used by default
+func SetupLogging(config *LogConfig, out io.Writer) error {
+	level, format := LevelInfo, LogFormatLogfmt
+	if config != nil && config.Level != "" {
+		level = strings.ToLower(config.Level)
+	}
+	if config != nil && config.Format != "" {
+		format = strings.ToLower(config.Format)
+	}
+	severity, ok := levelSeverity[level]
+	if !ok {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+	if format != LogFormatLogfmt && format != LogFormatJSON {
+		return fmt.Errorf("invalid log format: %s", format)
+	}
+	sink := logger.sink
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.out, sink.severity, sink.format = out, severity, format
+	return nil
+}
+
+// With returns logger adding given key-value pairs to every record
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// Fatal logs error and exits, pending spans are exported before exit as deferred calls don't run
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+	ShutdownTracing()
+	os.Exit(1)
+}
+
+func (l *Logger) log(level, msg string, keyvals []interface{}) {
+	sink := l.sink
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if levelSeverity[level] < sink.severity {
+		return
+	}
+	record := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	record = append(record, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level, "msg", msg)
+	record = append(append(record, l.fields...), keyvals...)
+	if len(record)%2 != 0 {
+		record = append(record, "(MISSING)")
+	}
+	var buf bytes.Buffer
+	if sink.format == LogFormatJSON {
+		writeJSONRecord(&buf, record)
+	} else {
+		writeLogfmtRecord(&buf, record)
+	}
+	_, _ = sink.out.Write(buf.Bytes())
+}
+
+// logValue converts field value to the form written to the log
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func writeJSONRecord(buf *bytes.Buffer, record []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(record); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(record[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(logValue(record[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(record[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+func writeLogfmtRecord(buf *bytes.Buffer, record []interface{}) {
+	for i := 0; i < len(record); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(record[i]))
+		buf.WriteByte('=')
+		value := fmt.Sprint(logValue(record[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n\\") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+// stdLogWriter passes records of standard `log` package, e.g. errors of `net/http` server, to the logger
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logger.Error(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,128 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+	"github.com/twinj/uuid"
+)
+
+// logBuffer collects log records, background goroutines of other tests can log concurrently
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs redirects server logs to returned buffer until the test ends
+func captureLogs(t *testing.T, config *main.LogConfig) *logBuffer {
+	buf := &logBuffer{}
+	checkErr(main.SetupLogging(config, buf))
+	t.Cleanup(func() { checkErr(main.SetupLogging(nil, os.Stdout)) })
+	return buf
+}
+
+func TestSetupLogging_Invalid(t *testing.T) {
+	invalid := []*main.LogConfig{{Level: "verbose"}, {Format: "xml"}}
+	for _, config := range invalid {
+		if err := main.SetupLogging(config, os.Stdout); err == nil {
+			t.Errorf("No error for invalid configuration %+v", config)
+		}
+	}
+}
+
+func TestApp_AccessLog(t *testing.T) {
+	logs := captureLogs(t, &main.LogConfig{Format: main.LogFormatJSON, Level: main.LevelWarn})
+
+	id := uuid.NewV4().String()
+	req, _ := http.NewRequest("GET", "/entity/"+id, nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	req.RemoteAddr = "192.0.2.1:4242"
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Log record is not valid JSON: %s", line)
+		}
+		if record["msg"] == "request" {
+			records = append(records, record)
+		}
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected only record of failed request with warn level, got %v", records)
+	}
+	expected := map[string]interface{}{
+		"level":       main.LevelWarn,
+		"method":      "GET",
+		"route":       "/entity/{id}",
+		"path":        "/entity/" + id,
+		"status":      float64(http.StatusNotFound),
+		"remote_addr": "192.0.2.1:4242",
+		"request_id":  "test-request",
+		"error":       "entity not found",
+	}
+	for key, value := range expected {
+		if records[0][key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, records[0][key])
+		}
+	}
+	if _, ok := records[0]["latency_ms"].(float64); !ok {
+		t.Errorf("Latency is missing: %v", records[0])
+	}
+
+	logs = captureLogs(t, nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if !strings.Contains(logs.String(), `level=info msg=request request_id=test-request method=GET route=/ path=/ status=200`) {
+		t.Errorf("Unexpected logfmt record: %s", logs.String())
+	}
+}
+
+// failingWriter is response writer of disconnected client
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestApp_WriteFailureLog(t *testing.T) {
+	logs := captureLogs(t, &main.LogConfig{Format: main.LogFormatJSON})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "failed-write")
+	a.Router.ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		checkErr(json.Unmarshal([]byte(line), &record))
+		if record["request_id"] == "failed-write" && record["error"] == "write failed: connection reset" {
+			return
+		}
+	}
+	t.Errorf("Write failure is not logged with request ID: %s", logs.String())
+}
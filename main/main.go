@@ -32,7 +32,7 @@ func selectDir(preferred string, backup string) string {
 }
 
 func termHandler(sig os.Signal) error {
-	log.Println("terminating...")
+	logger.Info("terminating...")
 
 	return daemon.ErrStop
 }
@@ -54,8 +54,8 @@ func main() {
 	}
 	daemon.AddCommand(daemon.StringFlag(&action, "stop"), syscall.SIGTERM, termHandler)
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(os.Stdout)
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
 
 	context := &daemon.Context{
 		PidFileName: filepath.Join(selectDir("/tmp", defaultUserDir), "too-simple.pid"),
@@ -67,7 +67,7 @@ func main() {
 	if len(daemon.ActiveFlags()) > 0 {
 		dProcess, err := context.Search()
 		if err != nil {
-			log.Fatalf("Unable send signal to the daemon: %s", err.Error())
+			logger.Fatal("Unable send signal to the daemon", "error", err)
 		}
 		_ = daemon.SendCommands(dProcess)
 		return
@@ -87,14 +87,33 @@ func main() {
 			}
 		}
 	}
-	log.Print("Load config\n")
-	a.Initialize(config)
-	log.Print("Init app\n")
+	if err := SetupLogging(config.Log, os.Stdout); err != nil {
+		logger.Fatal("Invalid log configuration", "error", err)
+	}
+	if err := SetupTracing(config.Tracing); err != nil {
+		logger.Fatal("Invalid tracing configuration", "error", err)
+	}
+	defer ShutdownTracing()
+	logger.Info("Load config")
+	if action == "migrate" {
+		if err := RunMigrateCommand(config, flag.Args()[1:]); err != nil {
+			logger.Fatal("Migration failed", "error", err)
+		}
+		return
+	}
+	// storage is opened by the process serving requests only, so parent and daemon don't write the same files
+	initialize := func() {
+		if err := a.Initialize(config); err != nil {
+			logger.Fatal("Can't initialize app", "error", err)
+		}
+		logger.Info("Init app")
+	}
 
 	d, err := context.Reborn()
 	if err != nil {
 		// seems you're running this in windows
-		log.Println("Can't start service. Starting in foreground\n", err)
+		logger.Warn("Can't start service. Starting in foreground", "error", err)
+		initialize()
 		a.Run(fmt.Sprintf(":%v", config.ServerPort))
 	}
 	if d != nil { // this is parent process
@@ -102,15 +121,21 @@ func main() {
 	}
 	defer func() {
 		err = context.Release()
-		log.Println("Error on closing: ", err)
+		if err != nil {
+			logger.Error("Error on closing", "error", err)
+		}
 	}()
+	initialize()
 
-	log.Println("Daemon started")
+	logger.Info("Daemon started", "version", version)
 
 	go a.Run(fmt.Sprintf(":%v", config.ServerPort))
 
 	err = daemon.ServeSignals()
 	if err != nil {
-		log.Printf("Error: %s", err.Error())
+		logger.Error("Serving signals failed", "error", err)
+	}
+	if err = a.Close(); err != nil {
+		logger.Error("Can't close storage", "error", err)
 	}
 }
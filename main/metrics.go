@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsContentType is media type of Prometheus text exposition format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+// Metric types
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// metricSeries is value of metric with particular label values
+type metricSeries struct {
+	labelValues []string
+	value       float64  // value of counter or gauge, sum of histogram
+	counts      []uint64 // histogram counts by bucket, not cumulative
+	count       uint64
+}
+
+// metricFamily is metric with all its series, safe for concurrent use
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+func newMetricFamily(name, help, kind string, buckets []float64, labels ...string) *metricFamily {
+	return &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+// get returns series of label values, `mu` has to be locked
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if f.kind == metricHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add changes counter or gauge value
+func (f *metricFamily) add(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value += value
+}
+
+// observe adds value to histogram
+func (f *metricFamily) observe(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(labelValues)
+	s.value += value
+	s.count++
+	for i, bound := range f.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label set, `extra` is added as the last label
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeHeader(w, f.name, f.help, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != metricHistogram {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+				formatLabels(f.labels, s.labelValues, "le", formatValue(bound)), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatValue(s.value))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues), s.count)
+	}
+}
+
+// Metrics keeps HTTP and storage metrics of the server
+type Metrics struct {
+	requests        *metricFamily
+	requestDuration *metricFamily
+	responseSize    *metricFamily
+	inFlight        *metricFamily
+	storeDuration   *metricFamily
+	storeErrors     *metricFamily
+}
+
+// NewMetrics creates empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetricFamily("http_requests_total",
+			"Count of handled HTTP requests.", metricCounter, nil, "method", "route", "code"),
+		requestDuration: newMetricFamily("http_request_duration_seconds",
+			"Latency of HTTP requests.", metricHistogram, durationBuckets, "method", "route"),
+		responseSize: newMetricFamily("http_response_size_bytes",
+			"Size of HTTP response bodies.", metricHistogram, sizeBuckets, "method", "route"),
+		inFlight: newMetricFamily("http_requests_in_flight",
+			"Count of HTTP requests being handled.", metricGauge, nil, "route"),
+		storeDuration: newMetricFamily("store_operation_duration_seconds",
+			"Latency of entity store operations.", metricHistogram, durationBuckets, "operation", "collection"),
+		storeErrors: newMetricFamily("store_operation_errors_total",
+			"Count of failed entity store operations, missing entities included.", metricCounter, nil,
+			"operation", "collection"),
+	}
+}
+
+// Write writes all metrics in Prometheus text format, connection pool statistics are taken from the store
+func (m *Metrics) Write(w io.Writer, store EntityStore) {
+	for _, family := range []*metricFamily{
+		m.requests, m.requestDuration, m.responseSize, m.inFlight, m.storeDuration, m.storeErrors,
+	} {
+		family.write(w)
+	}
+	writePoolStats(w, store)
+}
+
+// statusRecorder remembers status code, size and error of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	err    error
+}
+
+// errorRecorder is implemented by response writers remembering error responded with
+type errorRecorder interface {
+	recordError(err error)
+}
+
+func (r *statusRecorder) recordError(err error) {
+	r.err = err
+	if parent, ok := r.ResponseWriter.(errorRecorder); ok {
+		parent.recordError(err)
+	}
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// routeLabel removes patterns of route variables, so `/entity/{id:[a-z]{8}}` becomes `/entity/{id}`
+func routeLabel(template string) string {
+	var b strings.Builder
+	depth := 0
+	skipping := false
+	for _, c := range template {
+		switch {
+		case c == '{':
+			depth++
+			if depth == 1 {
+				b.WriteRune(c)
+				continue
+			}
+		case c == '}':
+			depth--
+			if depth == 0 {
+				skipping = false
+				b.WriteRune(c)
+				continue
+			}
+		case c == ':' && depth == 1:
+			skipping = true
+		}
+		if !skipping {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// instrumentedStore measures latency of entity store operations
+type instrumentedStore struct {
+	store      EntityStore
+	metrics    *Metrics
+	collection string
+}
+
+// instrument wraps store of the collection measuring its operations, store is returned as is if metrics are disabled
+func (m *Metrics) instrument(store EntityStore, collection string) EntityStore {
+	if m == nil {
+		return store
+	}
+	return &instrumentedStore{store: store, metrics: m, collection: collection}
+}
+
+func (s *instrumentedStore) observe(operation string, started time.Time, err *error) {
+	s.metrics.storeDuration.observe(time.Since(started).Seconds(), operation, s.collection)
+	if *err != nil {
+		s.metrics.storeErrors.add(1, operation, s.collection)
+	}
+}
+
+func (s *instrumentedStore) Get(ctx context.Context, e *Entity) (err error) {
+	defer s.observe("get", time.Now(), &err)
+	return s.store.Get(ctx, e)
+}
+
+func (s *instrumentedStore) List(ctx context.Context, opts ListOptions) (page *EntityPage, err error) {
+	defer s.observe("list", time.Now(), &err)
+	return s.store.List(ctx, opts)
+}
+
+func (s *instrumentedStore) Search(ctx context.Context, query string, count int) (results []SearchResult, err error) {
+	defer s.observe("search", time.Now(), &err)
+	return s.store.Search(ctx, query, count)
+}
+
+func (s *instrumentedStore) Create(ctx context.Context, e *Entity) (err error) {
+	defer s.observe("create", time.Now(), &err)
+	return s.store.Create(ctx, e)
+}
+
+func (s *instrumentedStore) Update(ctx context.Context, e *Entity, ifVersion int64) (err error) {
+	defer s.observe("update", time.Now(), &err)
+	return s.store.Update(ctx, e, ifVersion)
+}
+
+func (s *instrumentedStore) Modify(ctx context.Context, e *Entity, ifVersion int64, mutate func(e *Entity) error) (err error) {
+	defer s.observe("modify", time.Now(), &err)
+	return s.store.Modify(ctx, e, ifVersion, mutate)
+}
+
+func (s *instrumentedStore) Delete(ctx context.Context, e *Entity, ifVersion int64) (err error) {
+	defer s.observe("delete", time.Now(), &err)
+	return s.store.Delete(ctx, e, ifVersion)
+}
+
+func (s *instrumentedStore) AddEntities(ctx context.Context, entities []Entity, opts LoadOptions) (err error) {
+	defer s.observe("add_entities", time.Now(), &err)
+	return s.store.AddEntities(ctx, entities, opts)
+}
+
+func (s *instrumentedStore) BulkCreate(ctx context.Context, entities []Entity, opts BulkOptions) (errs []error, err error) {
+	defer s.observe("bulk_create", time.Now(), &err)
+	return s.store.BulkCreate(ctx, entities, opts)
+}
+
+func (s *instrumentedStore) BulkDelete(ctx context.Context, uuids []string, opts BulkOptions) (errs []error, err error) {
+	defer s.observe("bulk_delete", time.Now(), &err)
+	return s.store.BulkDelete(ctx, uuids, opts)
+}
+
+func (s *instrumentedStore) DeleteMatching(ctx context.Context, filter EntityFilter) (count int64, err error) {
+	defer s.observe("delete_matching", time.Now(), &err)
+	return s.store.DeleteMatching(ctx, filter)
+}
+
+// poolStats returns statistics of primary and replica connection pools by their names
+func (s *PostgresStore) poolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{"primary": s.DB.Stats()}
+	for _, r := range s.replicas {
+		stats[r.url] = r.db.Stats()
+	}
+	return stats
+}
+
+// writePoolStats writes connection pool metrics of PostgreSQL store, nothing is written for other backends
+func writePoolStats(w io.Writer, store EntityStore) {
+	if deferred, ok := store.(*DeferredStore); ok {
+		var err error
+		if store, err = deferred.get(); err != nil {
+			return
+		}
+	}
+	pg, ok := store.(*PostgresStore)
+	if !ok {
+		return
+	}
+	stats := pg.poolStats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name, help, kind string
+		value            func(s sql.DBStats) float64
+	}{
+		{"db_max_open_connections", "Maximum number of open connections.", metricGauge,
+			func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"db_open_connections", "Number of established connections.", metricGauge,
+			func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+		{"db_in_use_connections", "Number of connections currently in use.", metricGauge,
+			func(s sql.DBStats) float64 { return float64(s.InUse) }},
+		{"db_idle_connections", "Number of idle connections.", metricGauge,
+			func(s sql.DBStats) float64 { return float64(s.Idle) }},
+		{"db_wait_count_total", "Count of waits for a connection.", metricCounter,
+			func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+		{"db_wait_duration_seconds_total", "Total time blocked waiting for a connection.", metricCounter,
+			func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+		{"db_max_idle_closed_total", "Count of connections closed due to max_idle_conns.", metricCounter,
+			func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }},
+		{"db_max_idle_time_closed_total", "Count of connections closed due to conn_max_idle_time.", metricCounter,
+			func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }},
+		{"db_max_lifetime_closed_total", "Count of connections closed due to conn_max_lifetime.", metricCounter,
+			func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }},
+	}
+	for _, metric := range metrics {
+		writeHeader(w, metric.name, metric.help, metric.kind)
+		for _, name := range names {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", metric.name,
+				formatLabels([]string{"db"}, []string{name}), formatValue(metric.value(stats[name])))
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+	"github.com/twinj/uuid"
+)
+
+func TestApp_Metrics(t *testing.T) {
+	b := main.App{}
+	checkErr(b.Initialize(&main.Configuration{Debug: true}))
+	b.DataGenerationWg.Wait()
+
+	serve := func(method, route, body string) {
+		req, _ := http.NewRequest(method, route, bytes.NewBufferString(body))
+		b.Router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("POST", "/entity", `{"data": "measured"}`)
+	serve("GET", "/entity/"+uuid.NewV4().String(), "")
+	serve("GET", "/entity/"+uuid.NewV4().String(), "")
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if rr.Header().Get("Content-Type") != main.MetricsContentType {
+		t.Errorf("Unexpected content type: %s", rr.Header().Get("Content-Type"))
+	}
+	expected := []string{
+		"# TYPE http_requests_total counter",
+		`http_requests_total{method="POST",route="/entity",code="201"} 1`,
+		`http_requests_total{method="GET",route="/entity/{id}",code="404"} 2`,
+		`http_request_duration_seconds_bucket{method="GET",route="/entity/{id}",le="+Inf"} 2`,
+		`http_response_size_bytes_count{method="POST",route="/entity"} 1`,
+		`http_requests_in_flight{route="/entity"} 0`,
+		`store_operation_duration_seconds_count{operation="get",collection="entity"} 2`,
+		`store_operation_errors_total{operation="get",collection="entity"} 2`,
+	}
+	metrics := rr.Body.String()
+	for _, line := range expected {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Metrics don't contain %s", line)
+		}
+	}
+}
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	metricTypes       = map[string]bool{"counter": true, "gauge": true, "histogram": true, "summary": true, "untyped": true}
+)
+
+type metricSample struct {
+	family string
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// unescape decodes escape sequences of label values (`quote` is set) and HELP texts
+func unescape(s string, quote bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' && quote {
+			return "", fmt.Errorf("unescaped quote in %q", s)
+		}
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("incomplete escape sequence in %q", s)
+		}
+		switch {
+		case s[i] == '\\':
+			b.WriteByte('\\')
+		case s[i] == 'n':
+			b.WriteByte('\n')
+		case s[i] == '"' && quote:
+			b.WriteByte('"')
+		default:
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+	}
+	return b.String(), nil
+}
+
+// parseLabels parses label set at the start of `s`, returning the rest of the line
+func parseLabels(s string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	if !strings.HasPrefix(s, "{") {
+		return labels, s, nil
+	}
+	s = s[1:]
+	for !strings.HasPrefix(s, "}") {
+		eq := strings.Index(s, `="`)
+		if eq < 0 {
+			return nil, "", fmt.Errorf("label without value: %s", s)
+		}
+		name := s[:eq]
+		if !labelNamePattern.MatchString(name) {
+			return nil, "", fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, "", fmt.Errorf("duplicate label %s", name)
+		}
+		s = s[eq+2:]
+		end := 0
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		value, err := unescape(s[:end], true)
+		if err != nil {
+			return nil, "", err
+		}
+		labels[name] = value
+		s = s[end+1:]
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", fmt.Errorf("unexpected characters after label %s: %s", name, s)
+		}
+	}
+	return labels, s[1:], nil
+}
+
+// seriesKey identifies series by metric name and labels, `skip` label is left out
+func seriesKey(name string, labels map[string]string, skip string) string {
+	pairs := make([]string, 0, len(labels))
+	for label, value := range labels {
+		if label != skip {
+			pairs = append(pairs, label+"="+strconv.Quote(value))
+		}
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// parseExposition strictly parses metrics in Prometheus text format, returning types of metric families
+// and samples. Every family must have single HELP and TYPE preceding its samples, which are grouped together
+func parseExposition(text string) (map[string]string, []metricSample, error) {
+	if !strings.HasSuffix(text, "\n") {
+		return nil, nil, fmt.Errorf("exposition doesn't end with line feed")
+	}
+	types := map[string]string{}
+	helps := map[string]bool{}
+	done := map[string]bool{} // families followed by samples of other family
+	series := map[string]bool{}
+	var samples []metricSample
+	current := ""
+	for n, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d %q: %s", n+1, line, fmt.Sprintf(format, args...))
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue // plain comment
+			}
+			name := fields[2]
+			if !metricNamePattern.MatchString(name) {
+				return nil, nil, fail("invalid metric name")
+			}
+			if done[name] || current == name {
+				return nil, nil, fail("%s after samples", fields[1])
+			}
+			if fields[1] == "HELP" {
+				if helps[name] {
+					return nil, nil, fail("duplicate HELP")
+				}
+				helps[name] = true
+				if len(fields) == 4 {
+					if _, err := unescape(fields[3], false); err != nil {
+						return nil, nil, fail("%v", err)
+					}
+				}
+				continue
+			}
+			if _, ok := types[name]; ok {
+				return nil, nil, fail("duplicate TYPE")
+			}
+			if len(fields) != 4 || !metricTypes[fields[3]] {
+				return nil, nil, fail("invalid TYPE")
+			}
+			types[name] = fields[3]
+			continue
+		}
+		if line == "" {
+			return nil, nil, fail("empty line")
+		}
+		nameEnd := strings.IndexAny(line, "{ ")
+		if nameEnd < 0 {
+			return nil, nil, fail("sample without value")
+		}
+		sample := metricSample{name: line[:nameEnd], family: line[:nameEnd]}
+		if !metricNamePattern.MatchString(sample.name) {
+			return nil, nil, fail("invalid metric name")
+		}
+		if _, ok := types[sample.family]; !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				base := strings.TrimSuffix(sample.name, suffix)
+				if base != sample.name && types[base] == "histogram" {
+					sample.family = base
+				}
+			}
+		}
+		if _, ok := types[sample.family]; !ok || !helps[sample.family] {
+			return nil, nil, fail("sample without preceding HELP and TYPE")
+		}
+		if sample.family != current {
+			if done[sample.family] {
+				return nil, nil, fail("samples of family are not grouped together")
+			}
+			done[current] = true
+			current = sample.family
+		}
+		labels, rest, err := parseLabels(line[nameEnd:])
+		if err != nil {
+			return nil, nil, fail("%v", err)
+		}
+		sample.labels = labels
+		fields := strings.Split(rest, " ")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] != "" {
+			return nil, nil, fail("invalid value")
+		}
+		if sample.value, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return nil, nil, fail("invalid value: %v", err)
+		}
+		key := seriesKey(sample.name, labels, "")
+		if series[key] {
+			return nil, nil, fail("duplicate series")
+		}
+		series[key] = true
+		samples = append(samples, sample)
+	}
+	return types, samples, nil
+}
+
+// checkHistograms checks every histogram series has cumulative buckets ordered by bound,
+// the last `+Inf` bucket equal to `_count` and `_sum`
+func checkHistograms(types map[string]string, samples []metricSample) error {
+	type histogram struct {
+		bounds   []float64
+		counts   []float64
+		count    *float64
+		hasSum   bool
+		infCount float64
+	}
+	histograms := map[string]*histogram{}
+	get := func(s metricSample) *histogram {
+		key := seriesKey(s.family, s.labels, "le")
+		if histograms[key] == nil {
+			histograms[key] = &histogram{}
+		}
+		return histograms[key]
+	}
+	for _, s := range samples {
+		if types[s.family] != "histogram" {
+			continue
+		}
+		h := get(s)
+		switch s.name {
+		case s.family + "_bucket":
+			le, ok := s.labels["le"]
+			if !ok {
+				return fmt.Errorf("bucket of %s without le label", s.family)
+			}
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				return fmt.Errorf("invalid le %q of %s", le, s.family)
+			}
+			if n := len(h.bounds); n > 0 && (bound <= h.bounds[n-1] || s.value < h.counts[n-1]) {
+				return fmt.Errorf("buckets of %s are not cumulative and ordered: le=%s", s.family, le)
+			}
+			h.bounds = append(h.bounds, bound)
+			h.counts = append(h.counts, s.value)
+		case s.family + "_sum":
+			h.hasSum = true
+		case s.family + "_count":
+			value := s.value
+			h.count = &value
+		default:
+			return fmt.Errorf("unexpected sample %s of histogram %s", s.name, s.family)
+		}
+	}
+	for key, h := range histograms {
+		n := len(h.bounds)
+		if n == 0 || !math.IsInf(h.bounds[n-1], 1) {
+			return fmt.Errorf("histogram %s has no +Inf bucket", key)
+		}
+		if h.count == nil || *h.count != h.counts[n-1] || !h.hasSum {
+			return fmt.Errorf("histogram %s has no _sum or _count matching +Inf bucket", key)
+		}
+	}
+	return nil
+}
+
+func TestParseExposition_Invalid(t *testing.T) {
+	header := "# HELP m Help.\n# TYPE m counter\n"
+	histogram := "# HELP h Help.\n# TYPE h histogram\n"
+	invalid := []string{
+		"m 1\n",
+		header + "m 1",
+		header + "m{a=\"1\"} 1\nm{a=\"1\"} 2\n",
+		header + "m{a=\"x\\q\"} 1\n",
+		header + "m{a=\"x\"\"} 1\n",
+		header + "m{1a=\"x\"} 1\n",
+		header + "m one\n",
+		header + "# TYPE m gauge\n",
+		"# HELP m Bad \\escape.\n# TYPE m counter\n",
+		header + "m 1\n" + "# HELP n Help.\n# TYPE n counter\nn 1\nm{a=\"1\"} 1\n",
+		histogram + "h_bucket{le=\"1\"} 2\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n",
+		histogram + "h_bucket{le=\"2\"} 1\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n",
+		histogram + "h_bucket{le=\"1\"} 1\nh_sum 1\nh_count 1\n",
+		histogram + "h_bucket{le=\"+Inf\"} 2\nh_sum 1\nh_count 1\n",
+		histogram + "h_bucket{le=\"+Inf\"} 1\nh_count 1\n",
+	}
+	for _, text := range invalid {
+		types, samples, err := parseExposition(text)
+		if err == nil {
+			err = checkHistograms(types, samples)
+		}
+		if err == nil {
+			t.Errorf("No error for invalid exposition:\n%s", text)
+		}
+	}
+}
+
+func TestApp_MetricsExposition(t *testing.T) {
+	b := main.App{}
+	checkErr(b.Initialize(&main.Configuration{Debug: true}))
+	b.DataGenerationWg.Wait()
+
+	serve := func(method, route, body string) {
+		req, _ := http.NewRequest(method, route, bytes.NewBufferString(body))
+		b.Router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("POST", "/entity", `{"data": "measured"}`)
+	serve("POST", "/entity", `invalid`)
+	serve("GET", "/entity/"+uuid.NewV4().String(), "")
+	serve("GET", "/entities?count=5", "")
+	serve("POST", "/entities/bulk", `[{"data": "a"}, {"data": "b"}]`)
+	serve("GET", "/unknown/route", "")
+	serve("GET", "/collections/missing/entities", "")
+	b.Store = main.NewPostgresStoreFromDB(main.OpenDB(&stubPostgres{})) // adds connection pool metrics
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	types, samples, err := parseExposition(rr.Body.String())
+	if err != nil {
+		t.Fatalf("Invalid exposition: %v\n%s", err, rr.Body.String())
+	}
+	if err := checkHistograms(types, samples); err != nil {
+		t.Errorf("Invalid histogram: %v", err)
+	}
+	expected := map[string]string{
+		"http_requests_total":              "counter",
+		"http_request_duration_seconds":    "histogram",
+		"http_response_size_bytes":         "histogram",
+		"http_requests_in_flight":          "gauge",
+		"store_operation_duration_seconds": "histogram",
+		"store_operation_errors_total":     "counter",
+		"db_open_connections":              "gauge",
+		"db_wait_duration_seconds_total":   "counter",
+	}
+	for name, kind := range expected {
+		if types[name] != kind {
+			t.Errorf("Expected %s to be %s, got %q", name, kind, types[name])
+		}
+	}
+	primary := false
+	for _, s := range samples {
+		primary = primary || (s.name == "db_open_connections" && s.labels["db"] == "primary")
+	}
+	if !primary {
+		t.Errorf("No connection pool metrics of primary database")
+	}
+}
+
+func writeFamily(f *main.MetricFamily) string {
+	buf := &bytes.Buffer{}
+	f.Write(buf)
+	return buf.String()
+}
+
+func TestMetricFamily_Escaping(t *testing.T) {
+	value := "quote \" backslash \\ line\nfeed"
+	f := main.NewMetricFamily("escaped_total", "Help with \\ backslash,\nline feed and \" quote.",
+		"counter", nil, "label")
+	f.Add(1, value)
+	expected := "# HELP escaped_total Help with \\\\ backslash,\\nline feed and \" quote.\n" +
+		"# TYPE escaped_total counter\n" +
+		"escaped_total{label=\"quote \\\" backslash \\\\ line\\nfeed\"} 1\n"
+	text := writeFamily(f)
+	if text != expected {
+		t.Fatalf("Expected exposition:\n%s\ngot:\n%s", expected, text)
+	}
+	_, samples, err := parseExposition(text)
+	if err != nil {
+		t.Fatalf("Invalid exposition: %v", err)
+	}
+	if samples[0].labels["label"] != value {
+		t.Errorf("Expected label value %q, got %q", value, samples[0].labels["label"])
+	}
+}
+
+func TestMetricFamily_CounterAndGauge(t *testing.T) {
+	counter := main.NewMetricFamily("requests_total", "Requests.", "counter", nil, "method", "code")
+	counter.Add(1, "POST", "201")
+	counter.Add(1, "GET", "200")
+	counter.Add(2, "GET", "200")
+	counter.Add(1e6, "GET", "404")
+	gauge := main.NewMetricFamily("temperature", "Temperature.", "gauge", nil)
+	gauge.Add(1)
+	gauge.Add(-2.5)
+
+	cases := []struct {
+		family   *main.MetricFamily
+		expected string
+	}{
+		{counter, "# HELP requests_total Requests.\n# TYPE requests_total counter\n" +
+			"requests_total{method=\"GET\",code=\"200\"} 3\n" +
+			"requests_total{method=\"GET\",code=\"404\"} 1e+06\n" +
+			"requests_total{method=\"POST\",code=\"201\"} 1\n"},
+		{gauge, "# HELP temperature Temperature.\n# TYPE temperature gauge\ntemperature -1.5\n"},
+		{main.NewMetricFamily("empty_total", "No series.", "counter", nil, "label"),
+			"# HELP empty_total No series.\n# TYPE empty_total counter\n"},
+	}
+	for _, c := range cases {
+		text := writeFamily(c.family)
+		if text != c.expected {
+			t.Errorf("Expected exposition:\n%s\ngot:\n%s", c.expected, text)
+		}
+		if _, _, err := parseExposition(text); err != nil {
+			t.Errorf("Invalid exposition: %v\n%s", err, text)
+		}
+	}
+}
+
+func TestMetricFamily_Histogram(t *testing.T) {
+	f := main.NewMetricFamily("latency_seconds", "Latency.", "histogram", []float64{.5, 1, 2.5}, "route")
+	for _, value := range []float64{.25, 1, 1, 3, 10} { // upper bounds are inclusive
+		f.Observe(value, "/a")
+	}
+	f.Observe(.1, "/b")
+	expected := "# HELP latency_seconds Latency.\n# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"0.5\"} 1\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"1\"} 3\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"2.5\"} 3\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"+Inf\"} 5\n" +
+		"latency_seconds_sum{route=\"/a\"} 15.25\n" +
+		"latency_seconds_count{route=\"/a\"} 5\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"0.5\"} 1\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"1\"} 1\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"2.5\"} 1\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"+Inf\"} 1\n" +
+		"latency_seconds_sum{route=\"/b\"} 0.1\n" +
+		"latency_seconds_count{route=\"/b\"} 1\n"
+	text := writeFamily(f)
+	if text != expected {
+		t.Fatalf("Expected exposition:\n%s\ngot:\n%s", expected, text)
+	}
+	types, samples, err := parseExposition(text)
+	if err != nil {
+		t.Fatalf("Invalid exposition: %v", err)
+	}
+	if err := checkHistograms(types, samples); err != nil {
+		t.Errorf("Invalid histogram: %v", err)
+	}
+}
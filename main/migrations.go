@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Migration is single versioned change of PostgreSQL schema
+//
+// Collection tables are created as copies of `entity` table, so changes of its structure are also applied
+// to every collection table with CollectionUp and CollectionDown, `%[1]s` in them is replaced with table name
+type Migration struct {
+	Version        int
+	Description    string
+	Up             string
+	Down           string
+	CollectionUp   string
+	CollectionDown string
+}
+
+// migrations are applied in order of versions, applied migrations must never be changed
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create entity table",
+		Up: `
+			CREATE TABLE IF NOT EXISTS entity(
+				uuid TEXT NOT NULL PRIMARY KEY,
+				data TEXT
+			);`,
+		Down: `DROP TABLE IF EXISTS entity;`,
+	},
+	{
+		Version:     2,
+		Description: "add full-text search column",
+		Up: `
+			ALTER TABLE entity ADD COLUMN search tsvector;
+			UPDATE entity SET search = to_tsvector('pg_catalog.simple', coalesce(data, ''));
+			CREATE INDEX entity_search_idx ON entity USING GIN (search);
+			CREATE TRIGGER entity_search_update BEFORE INSERT OR UPDATE OF data ON entity
+				FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(search, 'pg_catalog.simple', data);`,
+		Down: `
+			DROP TRIGGER IF EXISTS entity_search_update ON entity;
+			DROP INDEX IF EXISTS entity_search_idx;
+			ALTER TABLE entity DROP COLUMN IF EXISTS search;`,
+		CollectionUp: `
+			ALTER TABLE %[1]s ADD COLUMN search tsvector;
+			UPDATE %[1]s SET search = to_tsvector('pg_catalog.simple', coalesce(data, ''));
+			CREATE INDEX ON %[1]s USING GIN (search);
+			CREATE TRIGGER search_update BEFORE INSERT OR UPDATE OF data ON %[1]s
+				FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(search, 'pg_catalog.simple', data);`,
+		CollectionDown: `
+			DROP TRIGGER IF EXISTS search_update ON %[1]s;
+			ALTER TABLE %[1]s DROP COLUMN IF EXISTS search;`,
+	},
+	{
+		Version:        3,
+		Description:    "add entity version",
+		Up:             `ALTER TABLE entity ADD COLUMN version BIGINT NOT NULL DEFAULT 1;`,
+		Down:           `ALTER TABLE entity DROP COLUMN IF EXISTS version;`,
+		CollectionUp:   `ALTER TABLE %[1]s ADD COLUMN version BIGINT NOT NULL DEFAULT 1;`,
+		CollectionDown: `ALTER TABLE %[1]s DROP COLUMN IF EXISTS version;`,
+	},
+	{
+		Version:        4,
+		Description:    "add entity modification time",
+		Up:             `ALTER TABLE entity ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();`,
+		Down:           `ALTER TABLE entity DROP COLUMN IF EXISTS updated_at;`,
+		CollectionUp:   `ALTER TABLE %[1]s ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();`,
+		CollectionDown: `ALTER TABLE %[1]s DROP COLUMN IF EXISTS updated_at;`,
+	},
+	{
+		Version:        5,
+		Description:    "add entity document",
+		Up:             `ALTER TABLE entity ADD COLUMN document JSONB;`,
+		Down:           `ALTER TABLE entity DROP COLUMN IF EXISTS document;`,
+		CollectionUp:   `ALTER TABLE %[1]s ADD COLUMN document JSONB;`,
+		CollectionDown: `ALTER TABLE %[1]s DROP COLUMN IF EXISTS document;`,
+	},
+	{
+		Version:     6,
+		Description: "add keyset pagination indexes",
+		Up: `
+			CREATE INDEX entity_uuid_sort_idx ON entity (uuid COLLATE "C");
+			CREATE INDEX entity_data_sort_idx ON entity ((left(data, 512)) COLLATE "C");`,
+		Down: `
+			DROP INDEX IF EXISTS entity_data_sort_idx;
+			DROP INDEX IF EXISTS entity_uuid_sort_idx;`,
+		CollectionUp: `
+			CREATE INDEX ON %[1]s (uuid COLLATE "C");
+			CREATE INDEX ON %[1]s ((left(data, 512)) COLLATE "C");`,
+		// indexes of collection tables are named by PostgreSQL, so they are found by "C" collation
+		CollectionDown: `
+			DO $$
+			DECLARE idx regclass;
+			BEGIN
+				FOR idx IN SELECT indexrelid::regclass FROM pg_index
+					WHERE indrelid = '%[1]s'::regclass
+						AND indcollation[0] = (SELECT oid FROM pg_collation WHERE collname = 'C')
+				LOOP
+					EXECUTE 'DROP INDEX ' || idx;
+				END LOOP;
+			END $$;`,
+	},
+}
+
+// migrationLockID is key of advisory lock preventing concurrent migrations
+const migrationLockID = 7355608
+
+// MigrationState describes migration and whether it's applied
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// withMigrationLock runs f holding migration advisory lock on single connection
+func withMigrationLock(db *sql.DB, f func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("can't acquire migration lock: %v", err)
+	}
+	defer func() {
+		_, _ = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version INTEGER NOT NULL PRIMARY KEY,
+			description TEXT,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`)
+	if err != nil {
+		return err
+	}
+	return f(ctx, conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// collectionTables returns quoted names of all collection tables
+func collectionTables(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename LIKE $1`,
+		escapeLike(collectionTablePrefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, pq.QuoteIdentifier(table))
+	}
+	return tables, rows.Err()
+}
+
+// migrateCollections applies collection part of migration to every collection table
+func migrateCollections(ctx context.Context, tx *sql.Tx, query string) error {
+	if query == "" {
+		return nil
+	}
+	tables, err := collectionTables(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, table)); err != nil {
+			return fmt.Errorf("table %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// runMigration executes migration SQL and records result in single transaction
+func runMigration(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	query, collectionQuery, record := m.Down, m.CollectionDown, "DELETE FROM schema_migrations WHERE version = $1"
+	args := []interface{}{m.Version}
+	if up {
+		query, collectionQuery = m.Up, m.CollectionUp
+		record = "INSERT INTO schema_migrations(version, description) VALUES ($1, $2)"
+		args = append(args, m.Description)
+	}
+	if _, err = tx.ExecContext(ctx, query); err == nil {
+		err = migrateCollections(ctx, tx, collectionQuery)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, record, args...)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+	}
+	return tx.Commit()
+}
+
+// MigrateUp applies all pending migrations up to `target` version, 0 means latest
+func MigrateUp(db *sql.DB, target int) error {
+	return withMigrationLock(db, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if target > 0 && m.Version > target {
+				break
+			}
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			logger.Info("Applied migration", "version", m.Version, "description", m.Description)
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts `steps` latest applied migrations
+func MigrateDown(db *sql.DB, steps int) error {
+	return withMigrationLock(db, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			logger.Info("Reverted migration", "version", m.Version, "description", m.Description)
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatus lists all known migrations with time they were applied.
+// It only reads database: no lock is taken and missing `schema_migrations`
+// table means no migration is applied yet
+func MigrationStatus(db *sql.DB) ([]MigrationState, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	var exists bool
+	err = conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	if exists {
+		if applied, err = appliedMigrations(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if appliedAt, ok := applied[m.Version]; ok {
+			state.AppliedAt = &appliedAt
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// RunMigrateCommand executes `migrate up [version]`, `migrate down [steps]` or `migrate status` command
+func RunMigrateCommand(config *Configuration, args []string) error {
+	if config.Postgres == nil {
+		return fmt.Errorf("no postgres configuration is given")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("migrate command requires one of: up, down, status")
+	}
+	number := 0
+	if len(args) > 1 {
+		var err error
+		if number, err = strconv.Atoi(args[1]); err != nil || number < 0 {
+			return fmt.Errorf("invalid migrate argument: %s", args[1])
+		}
+	}
+
+	// only migrating up creates missing database, other commands work with existing one
+	open := openPostgres
+	if args[0] != "up" {
+		open = func(config *PostgresConfig) (*sql.DB, error) {
+			return openPool(config, config.DbURL)
+		}
+	}
+	db, err := open(config.Postgres)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	switch args[0] {
+	case "up":
+		return MigrateUp(db, number)
+	case "down":
+		if number == 0 {
+			number = 1
+		}
+		return MigrateDown(db, number)
+	case "status":
+		states, err := MigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		anyApplied := false
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+				anyApplied = true
+			}
+			fmt.Printf("%4d  %-25s  %s\n", s.Version, applied, s.Description)
+		}
+		if !anyApplied {
+			fmt.Println("no migrations applied")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+}
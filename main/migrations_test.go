@@ -0,0 +1,139 @@
+package main_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+)
+
+// migrationRows answers queries of migration runner from statements committed to `db`,
+// there is single collection table `collection_suite`
+func migrationRows(db *scriptedDB) func(string, []driver.Value) ([]string, [][]driver.Value, error) {
+	return func(query string, _ []driver.Value) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "to_regclass"):
+			exists := len(db.statements("CREATE TABLE IF NOT EXISTS schema_migrations")) > 0
+			return []string{"exists"}, [][]driver.Value{{exists}}, nil
+		case strings.Contains(query, "FROM schema_migrations"):
+			applied := map[int64]bool{}
+			for _, st := range db.statements("schema_migrations") {
+				switch {
+				case strings.HasPrefix(st.query, "INSERT"):
+					applied[st.args[0].(int64)] = true
+				case strings.HasPrefix(st.query, "DELETE"):
+					delete(applied, st.args[0].(int64))
+				}
+			}
+			var rows [][]driver.Value
+			for version := range applied {
+				rows = append(rows, []driver.Value{version, time.Now()})
+			}
+			return []string{"version", "applied_at"}, rows, nil
+		case strings.Contains(query, "pg_tables"):
+			return []string{"tablename"}, [][]driver.Value{{"collection_suite"}}, nil
+		}
+		return nil, nil, errors.New("unexpected query")
+	}
+}
+
+// appliedVersions returns versions of applied migrations, checking status doesn't change database
+func appliedVersions(t *testing.T, db *scriptedDB, sqlDB *sql.DB) (applied []int, total int) {
+	committed := len(db.statements(""))
+	states, err := main.MigrationStatus(sqlDB)
+	checkErr(err)
+	if len(db.statements("")) != committed {
+		t.Error("Migration status changed database")
+	}
+	for _, state := range states {
+		if state.AppliedAt != nil {
+			applied = append(applied, state.Version)
+		}
+	}
+	return applied, len(states)
+}
+
+func countExecuted(db *scriptedDB, part string) (count int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, query := range db.executed {
+		if strings.Contains(query, part) {
+			count++
+		}
+	}
+	return
+}
+
+func TestMigrations_Versions(t *testing.T) {
+	db := &scriptedDB{}
+	db.rows = migrationRows(db)
+	sqlDB := sql.OpenDB(db)
+	defer sqlDB.Close()
+
+	applied, total := appliedVersions(t, db, sqlDB)
+	if len(applied) != 0 || total < 6 {
+		t.Fatalf("Expected %d pending migrations before migrating, got applied %v", total, applied)
+	}
+	if countExecuted(db, "pg_advisory_lock") != 0 {
+		t.Error("Migration status takes migration lock")
+	}
+
+	checkErr(main.MigrateUp(sqlDB, 3))
+	if applied, _ = appliedVersions(t, db, sqlDB); len(applied) != 3 {
+		t.Errorf("Expected migrations up to version 3 to be applied, got %v", applied)
+	}
+	checkErr(main.MigrateUp(sqlDB, 0))
+	if applied, _ = appliedVersions(t, db, sqlDB); len(applied) != total {
+		t.Errorf("Expected all migrations to be applied, got %v", applied)
+	}
+	if records := db.statements("INSERT INTO schema_migrations"); len(records) != total {
+		t.Errorf("Expected every migration to be recorded once, got %d records", len(records))
+	}
+	if len(db.statements(`ALTER TABLE "collection_suite" ADD COLUMN version`)) != 1 {
+		t.Error("Migration is not applied to collection table")
+	}
+
+	checkErr(main.MigrateDown(sqlDB, 2))
+	if applied, _ = appliedVersions(t, db, sqlDB); len(applied) != total-2 {
+		t.Errorf("Expected two latest migrations to be reverted, got applied %v", applied)
+	}
+	for _, version := range applied {
+		if version > total-2 {
+			t.Errorf("Migration %d is not reverted", version)
+		}
+	}
+	locks, unlocks := countExecuted(db, "pg_advisory_lock("), countExecuted(db, "pg_advisory_unlock(")
+	if locks != 3 || unlocks != 3 {
+		t.Errorf("Expected migration lock to be taken and released 3 times, got %d and %d", locks, unlocks)
+	}
+}
+
+func TestMigrations_FailedMigrationRollsBack(t *testing.T) {
+	db := &scriptedDB{fail: func(query string) error {
+		if strings.Contains(query, `ALTER TABLE "collection_suite" ADD COLUMN version`) {
+			return errors.New("column already exists")
+		}
+		return nil
+	}}
+	db.rows = migrationRows(db)
+	sqlDB := sql.OpenDB(db)
+	defer sqlDB.Close()
+
+	err := main.MigrateUp(sqlDB, 0)
+	if err == nil || !strings.Contains(err.Error(), "migration 3") {
+		t.Fatalf("Expected migration 3 to fail, got %v", err)
+	}
+	if applied, _ := appliedVersions(t, db, sqlDB); len(applied) != 2 {
+		t.Errorf("Expected only migrations before the failed one to be applied, got %v", applied)
+	}
+	if len(db.statements("ADD COLUMN version")) != 0 || db.rollbacks != 1 {
+		t.Errorf("Failed migration is not rolled back, %d rollbacks", db.rollbacks)
+	}
+	if countExecuted(db, "pg_advisory_unlock(") != 1 {
+		t.Error("Migration lock is not released after failure")
+	}
+}
@@ -1,30 +1,99 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
+// quoteConnValue quotes value of libpq connection string parameter
+func quoteConnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// applicationName identifies server connections in `pg_stat_activity`
+const applicationName = "too-simple"
+
+// connectionString builds libpq connection string for given database of instance at `dbURL`
+func (c *PostgresConfig) connectionString(dbURL string, dbName string) (string, error) {
+	dbURLSliced := strings.Split(dbURL, ":")
+	if len(dbURLSliced) != 2 {
+		return "", fmt.Errorf("invalid db url: %s, expected host:port", dbURL)
+	}
+	host := dbURLSliced[0]
+	port, err := strconv.Atoi(dbURLSliced[1])
+	if err != nil {
+		return "", err
+	}
+	params := []string{
+		"host=" + quoteConnValue(host),
+		fmt.Sprintf("port=%d", port),
+		"user=" + quoteConnValue(c.Username),
+		"password=" + quoteConnValue(c.Password),
+		"dbname=" + quoteConnValue(dbName),
+		"application_name=" + quoteConnValue(applicationName),
+	}
+	sslMode := "disable"
+	if c.SSL != nil {
+		if c.SSL.Mode != "" {
+			sslMode = c.SSL.Mode
+		}
+		if c.SSL.RootCert != "" {
+			params = append(params, "sslrootcert="+quoteConnValue(c.SSL.RootCert))
+		}
+		if c.SSL.Cert != "" {
+			params = append(params, "sslcert="+quoteConnValue(c.SSL.Cert))
+		}
+		if c.SSL.Key != "" {
+			params = append(params, "sslkey="+quoteConnValue(c.SSL.Key))
+		}
+	}
+	params = append(params, "sslmode="+quoteConnValue(sslMode))
+	if c.ConnectTimeout > 0 {
+		seconds := int(c.ConnectTimeout.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		params = append(params, fmt.Sprintf("connect_timeout=%d", seconds))
+	}
+	if c.StatementTimeout > 0 {
+		// not a libpq setting, so it's sent to the server as run-time parameter
+		params = append(params, fmt.Sprintf("statement_timeout=%d", c.StatementTimeout/time.Millisecond))
+	}
+	return strings.Join(params, " "), nil
+}
+
 // CreatePostgreDBIfNotExist create new database on given PostgreSQL instance if given DB does not exist on server
-func CreatePostgreDBIfNotExist(dbName string, host string, port int, username string, password string) error {
-	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, username, password, "postgres")
+func CreatePostgreDBIfNotExist(config *PostgresConfig) error {
+	dbName := config.Database
+	connectionString, err := config.connectionString(config.DbURL, "postgres")
+	if err != nil {
+		return err
+	}
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = db.Close() }()
 	rowSize := 0
 	err = db.QueryRow("SELECT COUNT(*) FROM pg_database WHERE datname = $1", dbName).Scan(&rowSize)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if rowSize == 0 {
-		log.Printf("Database %s does not exist, DB to be created", dbName)
+		logger.Info("Database does not exist, DB to be created", "database", dbName)
 		pattern := "^[a-zA-Z_]+$"
 		seemsOk, _ := regexp.MatchString(pattern, dbName)
 		if !seemsOk {
@@ -35,78 +104,452 @@ func CreatePostgreDBIfNotExist(dbName string, host string, port int, username st
 	return err
 }
 
-// CreateTable if not exists
-func CreateTable(db *sql.DB) {
-	sqlTable := `
-        CREATE TABLE IF NOT EXISTS entity(
-                uuid TEXT NOT NULL PRIMARY KEY,
-                data TEXT
-        );
-        `
+// PostgresStore is entity storage backed by PostgreSQL database
+//
+// Reads are routed to healthy read replicas, if there are any
+type PostgresStore struct {
+	DB       *sql.DB
+	table    string // quoted name of collection table
+	replicas []*replica
+	next     uint32 // round-robin counter of replicas
+	stopChan chan struct{}
+}
 
-	_, err := db.Exec(sqlTable)
+// openPool opens connection pool to configured database on instance at `dbURL`
+func openPool(config *PostgresConfig, dbURL string) (*sql.DB, error) {
+	connectionString, err := config.connectionString(dbURL, config.Database)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	connector, err := pq.NewConnector(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	db := OpenDB(connector)
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	if config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	return db, nil
 }
 
-func (e *Entity) getEntity(db *sql.DB) error {
-	if db == nil {
-		return FakeGet(e)
+// openPostgres connects to PostgreSQL instance, creating database if required
+func openPostgres(config *PostgresConfig) (*sql.DB, error) {
+	if err := CreatePostgreDBIfNotExist(config); err != nil {
+		return nil, fmt.Errorf("error during db creation: %v", err)
 	}
+	return openPool(config, config.DbURL)
+}
 
-	return db.QueryRow("SELECT data FROM entity WHERE uuid like ($1)", e.Uuid).Scan(&e.Data)
+// NewPostgresStore connects to PostgreSQL instance and applies pending schema migrations
+func NewPostgresStore(config *PostgresConfig) (*PostgresStore, error) {
+	db, err := openPostgres(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := MigrateUp(db, 0); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	store := NewPostgresStoreFromDB(db)
+	if err := store.openReplicas(config); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewPostgresStoreFromDB creates store of default collection using opened connection pool, migrations are not applied
+func NewPostgresStoreFromDB(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db, table: DefaultCollection}
 }
 
-func (e *Entity) updateEntity(db *sql.DB) error {
-	if db == nil {
-		return FakeUpdate(e)
+const (
+	defaultRetryInterval    = time.Second
+	defaultMaxRetryInterval = 30 * time.Second
+)
+
+// retryDelay returns exponential backoff delay before retry number `attempt`, starting from 0
+func (c *PostgresConfig) retryDelay(attempt int) time.Duration {
+	delay, maxDelay := c.RetryInterval, c.MaxRetryInterval
+	if delay <= 0 {
+		delay = defaultRetryInterval
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxRetryInterval
+	}
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
 	}
+	return delay
+}
 
-	_, err := db.Exec("UPDATE entity SET data = $1 WHERE uuid = $2", e.Data, e.Uuid)
-	return err
+// ConnectPostgresStore creates PostgresStore retrying `connect_retries` times with exponential backoff
+func ConnectPostgresStore(config *PostgresConfig) (*PostgresStore, error) {
+	for attempt := 0; ; attempt++ {
+		store, err := NewPostgresStore(config)
+		if err == nil || attempt >= config.ConnectRetries {
+			return store, err
+		}
+		delay := config.retryDelay(attempt)
+		logger.Warn("Can't connect to PostgreSQL, retrying", "error", err, "delay", delay)
+		time.Sleep(delay)
+	}
 }
 
-func (e *Entity) deleteEntity(db *sql.DB) error {
-	if db == nil {
-		return FakeDel(e)
+// ConnectPostgresStoreInBackground keeps trying to connect until succeeded, then sets connected store to `deferred`
+func ConnectPostgresStoreInBackground(config *PostgresConfig, deferred *DeferredStore, onReady func()) {
+	for attempt := 0; ; attempt++ {
+		store, err := NewPostgresStore(config)
+		if err == nil {
+			logger.Info("Connected to PostgreSQL, entity routes are served")
+			deferred.Set(store)
+			onReady()
+			return
+		}
+		delay := config.retryDelay(attempt)
+		logger.Warn("PostgreSQL is still unavailable, retrying", "error", err, "delay", delay)
+		time.Sleep(delay)
 	}
+}
+
+// entityColumns are selected to fill entity using entityFields
+const entityColumns = "uuid, data, version, updated_at, document"
+
+func entityFields(e *Entity) []interface{} {
+	return []interface{}{&e.Uuid, &e.Data, &e.Version, &e.UpdatedAt, (*[]byte)(&e.Document)}
+}
+
+func (s *PostgresStore) Get(ctx context.Context, e *Entity) error {
+	return s.read(ctx, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, "SELECT "+entityColumns+" FROM "+s.table+" WHERE uuid = $1", e.Uuid).
+			Scan(entityFields(e)...)
+	})
+}
+
+// conditionalError tells why conditional change of entity affected no rows
+func (s *PostgresStore) conditionalError(ctx context.Context, uuid string, ifVersion int64) error {
+	if ifVersion == 0 {
+		return sql.ErrNoRows
+	}
+	exists := false
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM "+s.table+" WHERE uuid = $1)", uuid).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return sql.ErrNoRows
+}
 
-	_, err := db.Exec("DELETE FROM entity WHERE uuid = $1", e.Uuid)
+func (s *PostgresStore) Update(ctx context.Context, e *Entity, ifVersion int64) error {
+	err := s.DB.QueryRowContext(ctx, `
+		UPDATE `+s.table+` SET data = $1, document = $2, version = version + 1, updated_at = now()
+			WHERE uuid = $3 AND ($4::BIGINT = 0 OR version = $4)
+			RETURNING version, updated_at`, e.Data, e.documentValue(), e.Uuid, ifVersion).Scan(&e.Version, &e.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return s.conditionalError(ctx, e.Uuid, ifVersion)
+	}
 	return err
 }
 
-func (e *Entity) createEntity(db *sql.DB) error {
-	if db == nil {
-		return FakeNew(e)
+// Modify locks entity row with `SELECT FOR UPDATE`, so concurrent changes wait for the transaction
+func (s *PostgresStore) Modify(ctx context.Context, e *Entity, ifVersion int64, mutate func(e *Entity) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	current := Entity{Uuid: e.Uuid}
+	err = tx.QueryRowContext(ctx, "SELECT "+entityColumns+" FROM "+s.table+" WHERE uuid = $1 FOR UPDATE", e.Uuid).
+		Scan(entityFields(&current)...)
+	if err != nil {
+		return err
+	}
+	if ifVersion != 0 && current.Version != ifVersion {
+		return ErrVersionMismatch
 	}
+	if err := mutate(&current); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE `+s.table+` SET data = $1, document = $2, version = version + 1, updated_at = now()
+			WHERE uuid = $3
+			RETURNING version, updated_at`, current.Data, current.documentValue(), e.Uuid).
+		Scan(&current.Version, &current.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	current.Uuid = e.Uuid
+	*e = current
+	return nil
+}
 
+func (s *PostgresStore) Delete(ctx context.Context, e *Entity, ifVersion int64) error {
+	res, err := s.DB.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE uuid = $1 AND ($2::BIGINT = 0 OR version = $2)",
+		e.Uuid, ifVersion)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+	return s.conditionalError(ctx, e.Uuid, ifVersion)
+}
+
+func (s *PostgresStore) Create(ctx context.Context, e *Entity) error {
 	// postgres doesn't return the last inserted Uuid so this is the workaround
-	_, err := db.Exec("INSERT INTO entity(uuid, data) VALUES ($1, $2)", e.Uuid, e.Data)
-	return err
+	e.Version = 1
+	return s.DB.QueryRowContext(ctx, `
+		INSERT INTO `+s.table+`(uuid, data, version, document) VALUES ($1, $2, $3, $4)
+			RETURNING updated_at`, e.Uuid, e.Data, e.Version, e.documentValue()).Scan(&e.UpdatedAt)
 }
 
-//AddEntities — add multiple entities in single transaction
-func AddEntities(db *sql.DB, entities []Entity) error {
-	tx, err := db.Begin()
+//AddEntities — add multiple entities, every chunk is inserted in own transaction
+func (s *PostgresStore) AddEntities(ctx context.Context, entities []Entity, opts LoadOptions) error {
+	return opts.forEachChunk(len(entities), func(start, end int) error {
+		return s.addChunk(ctx, entities[start:end])
+	})
+}
+
+func (s *PostgresStore) addChunk(ctx context.Context, entities []Entity) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	count := len(entities)
-	baseQ, _ := tx.Prepare("INSERT INTO entity (uuid, data) VALUES ($1, $2)")
-	for i := 0; i < count; i++ {
-		entity := entities[i]
-		_, err = baseQ.Exec(entity.Data, entity.Uuid)
-		if err != nil {
-			_ = tx.Rollback()
-			log.Fatalf("Unable to insert data %v into entities table", entity)
-			return err
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx,
+		"INSERT INTO "+s.table+" (uuid, data, version, updated_at, document) VALUES ($1, $2, $3, $4, $5)"+
+			" ON CONFLICT (uuid) DO NOTHING")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := modificationTime()
+	for i := range entities {
+		e := &entities[i]
+		e.Version = 1
+		e.UpdatedAt = now
+		if _, err := stmt.ExecContext(ctx, e.Uuid, e.Data, e.Version, e.UpdatedAt, e.documentValue()); err != nil {
+			return fmt.Errorf("unable to insert entity %s: %w", e.Uuid, err)
 		}
 	}
 	return tx.Commit()
 }
 
+// bulkCopyThreshold is the least count of entities loaded by BulkCreate using COPY
+const bulkCopyThreshold = 1000
+
+// upsertClause returns conflict handling part of entity INSERT, table has to be aliased as `t`
+func upsertClause(upsert bool) string {
+	if !upsert {
+		return "ON CONFLICT (uuid) DO NOTHING"
+	}
+	return `ON CONFLICT (uuid) DO UPDATE SET data = EXCLUDED.data, document = EXCLUDED.document,
+		version = t.version + 1, updated_at = now()`
+}
+
+// BulkCreate inserts entities one by one in single transaction, large batches are loaded with COPY
+//
+// In best-effort mode every insert is protected with savepoint, so failed entity doesn't abort the transaction.
+// COPY fails as a whole on any invalid entity, in this case entities are inserted one by one to find failed ones
+func (s *PostgresStore) BulkCreate(ctx context.Context, entities []Entity, opts BulkOptions) ([]error, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	errs := make([]error, len(entities))
+	if len(entities) >= bulkCopyThreshold {
+		err = s.copyOrInsertEntities(ctx, tx, entities, opts, errs)
+	} else {
+		err = s.insertEntities(ctx, tx, entities, opts, errs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Atomic && abortBulk(errs) {
+		return errs, nil
+	}
+	return errs, tx.Commit()
+}
+
+func (s *PostgresStore) insertEntities(ctx context.Context, tx *sql.Tx, entities []Entity, opts BulkOptions, errs []error) error {
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO `+s.table+` AS t (uuid, data, document) VALUES ($1, $2, $3)
+			`+upsertClause(opts.Upsert)+`
+			RETURNING version, updated_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := range entities {
+		e := &entities[i]
+		if !opts.Atomic {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_item"); err != nil {
+				return err
+			}
+		}
+		err := stmt.QueryRowContext(ctx, e.Uuid, e.Data, e.documentValue()).Scan(&e.Version, &e.UpdatedAt)
+		switch {
+		case err == nil:
+		case err == sql.ErrNoRows:
+			errs[i] = ErrEntityExists
+		case isConnectionError(err):
+			return err
+		case opts.Atomic:
+			// transaction is aborted, so the rest of entities are not inserted
+			errs[i] = err
+			return nil
+		default:
+			errs[i] = err
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_item"); err != nil {
+				return err
+			}
+		}
+		if !opts.Atomic {
+			// savepoint is kept after rolling back to it, so it's released either way to avoid nesting subtransactions
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT bulk_item"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyOrInsertEntities loads entities with COPY, falling back to inserts one by one if the database rejects any of them
+func (s *PostgresStore) copyOrInsertEntities(ctx context.Context, tx *sql.Tx, entities []Entity, opts BulkOptions, errs []error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_copy"); err != nil {
+		return err
+	}
+	err := s.copyEntities(ctx, tx, entities, opts.Upsert, errs)
+	if _, ok := err.(*pq.Error); !ok {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_copy"); err != nil {
+		return err
+	}
+	for i := range errs {
+		errs[i] = nil
+	}
+	return s.insertEntities(ctx, tx, entities, opts, errs)
+}
+
+// copyEntities loads entities to temporary table with COPY and moves them to entity table with single INSERT
+func (s *PostgresStore) copyEntities(ctx context.Context, tx *sql.Tx, entities []Entity, upsert bool, errs []error) error {
+	_, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE bulk_entity (uuid TEXT, data TEXT, document JSONB) ON COMMIT DROP")
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("bulk_entity", "uuid", "data", "document"))
+	if err != nil {
+		return err
+	}
+	for i := range entities {
+		if _, err := stmt.ExecContext(ctx, entities[i].Uuid, entities[i].Data, entities[i].documentValue()); err != nil {
+			_ = stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		INSERT INTO `+s.table+` AS t (uuid, data, document) SELECT uuid, data, document FROM bulk_entity
+			`+upsertClause(upsert)+`
+			RETURNING uuid, version, updated_at`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	index := make(map[string]int, len(entities))
+	for i := range entities {
+		index[entities[i].Uuid] = i
+		errs[i] = ErrEntityExists
+	}
+	for rows.Next() {
+		var uuid string
+		var version int64
+		var updatedAt time.Time
+		if err := rows.Scan(&uuid, &version, &updatedAt); err != nil {
+			return err
+		}
+		if i, ok := index[uuid]; ok {
+			entities[i].Version, entities[i].UpdatedAt, errs[i] = version, updatedAt, nil
+		}
+	}
+	return rows.Err()
+}
+
+func (s *PostgresStore) BulkDelete(ctx context.Context, uuids []string, opts BulkOptions) ([]error, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx, "DELETE FROM "+s.table+" WHERE uuid = ANY($1) RETURNING uuid", pq.Array(uuids))
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]bool, len(uuids))
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		deleted[uuid] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(uuids))
+	for i, uuid := range uuids {
+		if !deleted[uuid] {
+			errs[i] = sql.ErrNoRows
+		}
+	}
+	if opts.Atomic && abortBulk(errs) {
+		return errs, nil
+	}
+	return errs, tx.Commit()
+}
+
+func (s *PostgresStore) DeleteMatching(ctx context.Context, filter EntityFilter) (int64, error) {
+	if err := filter.Validate(); err != nil {
+		return 0, err
+	}
+	var args []interface{}
+	conditions := filter.sqlConditions(&args)
+	res, err := s.DB.ExecContext(ctx, "DELETE FROM "+s.table+" "+whereClause(conditions), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func isConnectionError(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
 	switch err.(type) {
 	default:
 		return false
@@ -115,33 +558,126 @@ func isConnectionError(err error) bool {
 	}
 }
 
-var validFilter, _ = regexp.Compile(`[a-zA-Z*]+`)
-
-func getEntities(db *sql.DB, count int, filter ...string) ([]Entity, error) {
+// Search uses full-text index, query words are combined with AND operator
+func (s *PostgresStore) Search(ctx context.Context, query string, count int) ([]SearchResult, error) {
+	results := make([]SearchResult, 0, count)
+	err := s.read(ctx, func(db *sql.DB) error {
+		results = results[:0]
+		rows, err := db.QueryContext(ctx, `
+			SELECT `+entityColumns+`, ts_rank(search, query) AS rank
+				FROM `+s.table+`, plainto_tsquery('pg_catalog.simple', $1) query
+				WHERE search @@ query
+				ORDER BY rank DESC, uuid
+				LIMIT $2`, query, count)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
 
-	like := ""
-	singleFilter := "*"
-	if len(filter) > 0 {
-		singleFilter = filter[0]
-		if singleFilter != "" {
-			if !validFilter.MatchString(singleFilter) {
-				return nil, fmt.Errorf("invalid filter: %s, only letters and * are allowed symbols", singleFilter)
+		for rows.Next() {
+			var r SearchResult
+			if err := rows.Scan(append(entityFields(&r.Entity), &r.Rank)...); err != nil {
+				return err
 			}
-			singleFilter = strings.Replace(singleFilter, "*", "%", -1)
-			like = fmt.Sprintf("LIKE '%s'", singleFilter)
+			results = append(results, r)
 		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
-	if db == nil {
-		return FakeList(count, singleFilter)
+	return results, nil
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
 	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
 
+// sortPrefixLength is length of data prefix indexed for sorting, whole data can exceed btree index row size
+const sortPrefixLength = 512
+
+// List uses keyset pagination, values are compared with "C" collation, so the order is the same as in other backends.
+//
+// Sorting by data uses index on its prefix first, which gives the same order as sorting by whole data.
+// Cursor keeps only prefix of the data, full data is read by uuid of the cursor entity
+func (s *PostgresStore) List(ctx context.Context, opts ListOptions) (*EntityPage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	var args []interface{}
+	conditions := opts.Filter.sqlConditions(&args)
+	countQuery := "SELECT COUNT(*) FROM " + s.table + " " + whereClause(conditions)
+	countArgs := append([]interface{}{}, args...)
+
+	op, direction := ">", "ASC"
+	if opts.Order == OrderDesc {
+		op, direction = "<", "DESC"
+	}
+	order := fmt.Sprintf(`uuid COLLATE "C" %s`, direction)
+	if opts.Sort == SortByData {
+		order = fmt.Sprintf(`left(data, %[2]d) COLLATE "C" %[1]s, data COLLATE "C" %[1]s, uuid COLLATE "C" %[1]s`,
+			direction, sortPrefixLength)
+	}
+	c, _ := opts.cursor()
+	keyArg := -1
+	if c != nil {
+		if opts.Sort == SortByData {
+			keyArg = len(args)
+			args = append(args, c.Key, c.UUID)
+			conditions = append(conditions, fmt.Sprintf(
+				`(left(data, %[4]d) COLLATE "C", data COLLATE "C", uuid COLLATE "C") %[1]s (left($%[2]d, %[4]d), $%[2]d, $%[3]d)`,
+				op, len(args)-1, len(args), sortPrefixLength))
+		} else {
+			args = append(args, c.UUID)
+			conditions = append(conditions, fmt.Sprintf(`uuid COLLATE "C" %s $%d`, op, len(args)))
+		}
+	}
+	args = append(args, opts.Count+1) // one more entity shows if there is next page
 	queryString := fmt.Sprintf(`
-		SELECT uuid, data
-			FROM entity
-			WHERE data %s
-			LIMIT $1`, like)
+		SELECT `+entityColumns+`
+			FROM `+s.table+`
+			%s
+			ORDER BY %s
+			LIMIT $%d`, whereClause(conditions), order, len(args))
+
+	page := &EntityPage{}
+	err := s.read(ctx, func(db *sql.DB) error {
+		page.Entities = make([]Entity, 0, opts.Count)
+		if err := db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&page.Total); err != nil {
+			return err
+		}
+		if keyArg >= 0 && c.Partial {
+			var data string
+			err := db.QueryRowContext(ctx, "SELECT data FROM "+s.table+" WHERE uuid = $1", c.UUID).Scan(&data)
+			switch {
+			case err == nil:
+				args[keyArg] = c.resolveKey(data)
+			case err != sql.ErrNoRows:
+				return err
+			}
+		}
+		rows, err := db.QueryContext(ctx, queryString, args...)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
 
-	rows, err := db.Query(queryString, count)
+		for rows.Next() {
+			var e Entity
+			if err := rows.Scan(entityFields(&e)...); err != nil {
+				return err
+			}
+			page.Entities = append(page.Entities, e)
+		}
+		return rows.Err()
+	})
 
 	if err != nil {
 		if isConnectionError(err) {
@@ -149,20 +685,104 @@ func getEntities(db *sql.DB, count int, filter ...string) ([]Entity, error) {
 		}
 		return nil, err
 	}
+	if len(page.Entities) > opts.Count {
+		page.Entities = page.Entities[:opts.Count]
+		page.Next = opts.nextCursor(&page.Entities[opts.Count-1])
+	}
+	return page, nil
+}
+
+// collectionTablePrefix is prefix of tables of collections other than the default one
+const collectionTablePrefix = "collection_"
+
+// withTable returns store of collection table sharing connections of s
+func (s *PostgresStore) withTable(name string) *PostgresStore {
+	return &PostgresStore{
+		DB:       s.DB,
+		table:    pq.QuoteIdentifier(collectionTablePrefix + name),
+		replicas: s.replicas,
+	}
+}
 
-	defer func() {
-		_ = rows.Close()
-	}()
+func (s *PostgresStore) Collection(ctx context.Context, name string) (EntityStore, error) {
+	if name == DefaultCollection {
+		return s, nil
+	}
+	if err := ValidateCollectionName(name); err != nil {
+		return nil, ErrCollectionNotFound
+	}
+	collection := s.withTable(name)
+	exists := false
+	if err := s.DB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", collection.table).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrCollectionNotFound
+	}
+	return collection, nil
+}
 
-	var entities []Entity
+func (s *PostgresStore) Collections(ctx context.Context) ([]string, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT substr(tablename, $1)
+			FROM pg_tables
+			WHERE schemaname = current_schema() AND tablename LIKE $2`,
+		len(collectionTablePrefix)+1, escapeLike(collectionTablePrefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
 
+	names := []string{DefaultCollection}
 	for rows.Next() {
-		var e Entity
-		if err := rows.Scan(&e.Uuid, &e.Data); err != nil {
+		var name string
+		if err := rows.Scan(&name); err != nil {
 			return nil, err
 		}
-		entities = append(entities, e)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, rows.Err()
+}
+
+// CreateCollection creates table with the same structure as the default one
+func (s *PostgresStore) CreateCollection(ctx context.Context, name string) error {
+	if err := ValidateCollectionName(name); err != nil {
+		return err
+	}
+	table := s.withTable(name).table
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	return entities, nil
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", table, DefaultCollection))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P07" { // duplicate_table
+		return ErrCollectionExists
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TRIGGER search_update BEFORE INSERT OR UPDATE OF data ON %s
+			FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(search, 'pg_catalog.simple', data)`, table))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) DropCollection(ctx context.Context, name string) error {
+	if name == DefaultCollection {
+		return ErrDefaultCollection
+	}
+	if err := ValidateCollectionName(name); err != nil {
+		return ErrCollectionNotFound
+	}
+	_, err := s.DB.ExecContext(ctx, "DROP TABLE "+s.withTable(name).table)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P01" { // undefined_table
+		return ErrCollectionNotFound
+	}
+	return err
 }
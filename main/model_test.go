@@ -0,0 +1,434 @@
+package main_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+)
+
+// stubPostgres stands in for PostgreSQL, recording prepared queries and rows inserted in committed
+// transactions. Insert of entity with `failUuid` fails
+type stubPostgres struct {
+	mu        sync.Mutex
+	failUuid  string
+	commits   int
+	committed [][]driver.Value
+	prepared  []string
+}
+
+func (d *stubPostgres) Connect(context.Context) (driver.Conn, error) {
+	return &stubConn{db: d}, nil
+}
+
+func (d *stubPostgres) Driver() driver.Driver {
+	return d
+}
+
+func (d *stubPostgres) Open(string) (driver.Conn, error) {
+	return &stubConn{db: d}, nil
+}
+
+type stubConn struct {
+	db      *stubPostgres
+	pending [][]driver.Value
+}
+
+func (c *stubConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.mu.Lock()
+	c.db.prepared = append(c.db.prepared, query)
+	c.db.mu.Unlock()
+	if end := strings.Index(query, "*/"); strings.HasPrefix(query, "/*") && end > 0 {
+		query = query[end+2:]
+	}
+	if !strings.HasPrefix(strings.TrimSpace(query), "INSERT") {
+		return nil, errors.New("only inserts are supported")
+	}
+	return &stubStmt{conn: c}, nil
+}
+
+func (c *stubConn) Close() error {
+	return nil
+}
+
+func (c *stubConn) Begin() (driver.Tx, error) {
+	c.pending = nil
+	return c, nil
+}
+
+func (c *stubConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.commits++
+	c.db.committed = append(c.db.committed, c.pending...)
+	c.pending = nil
+	return nil
+}
+
+func (c *stubConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type stubStmt struct {
+	conn *stubConn
+}
+
+func (s *stubStmt) Close() error {
+	return nil
+}
+
+func (s *stubStmt) NumInput() int {
+	return -1
+}
+
+func (s *stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if args[0] == s.conn.db.failUuid {
+		return nil, errors.New("duplicate key value violates unique constraint")
+	}
+	s.conn.pending = append(s.conn.pending, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stubStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries are not supported")
+}
+
+func TestPostgresStore_AddEntities(t *testing.T) {
+	stub := &stubPostgres{}
+	db := sql.OpenDB(stub)
+	defer db.Close()
+	store := main.NewPostgresStoreFromDB(db)
+
+	entities := main.GenerateSomeEntities(25, 10)
+	var progress []int
+	opts := main.LoadOptions{
+		ChunkSize: 10,
+		Progress:  func(loaded, total int) { progress = append(progress, loaded) },
+	}
+	checkErr(store.AddEntities(ctx, entities, opts))
+	if stub.commits != 3 || len(stub.committed) != 25 {
+		t.Fatalf("Expected 25 entities in 3 transactions, got %d in %d", len(stub.committed), stub.commits)
+	}
+	row := stub.committed[0]
+	if row[0] != entities[0].Uuid || row[1] != entities[0].Data || row[2] != int64(1) {
+		t.Errorf("Unexpected insert parameters: %v", row)
+	}
+	if !reflect.DeepEqual(progress, []int{10, 20, 25}) {
+		t.Errorf("Unexpected progress: %v", progress)
+	}
+	if entities[24].Version != 1 || entities[24].UpdatedAt.IsZero() {
+		t.Errorf("Version of added entity is not set: %+v", entities[24])
+	}
+
+	// failure keeps committed chunks and is returned instead of exiting
+	stub = &stubPostgres{failUuid: entities[13].Uuid}
+	db = sql.OpenDB(stub)
+	defer db.Close()
+	progress = nil
+	err := main.NewPostgresStoreFromDB(db).AddEntities(ctx, entities, opts)
+	if err == nil || !strings.Contains(err.Error(), entities[13].Uuid) {
+		t.Errorf("Expected insert error of %s, got %v", entities[13].Uuid, err)
+	}
+	if stub.commits != 1 || len(stub.committed) != 10 || !reflect.DeepEqual(progress, []int{10}) {
+		t.Errorf("Expected only the first chunk to be committed, got %d entities, progress %v",
+			len(stub.committed), progress)
+	}
+}
+
+// parseConnString splits libpq connection string to key-value pairs, unquoting values
+func parseConnString(t *testing.T, connString string) map[string]string {
+	params := map[string]string{}
+	for rest := strings.TrimSpace(connString); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			t.Fatalf("Missing value in connection string: %s", rest)
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+		var value strings.Builder
+		if strings.HasPrefix(rest, "'") {
+			i := 1
+			for ; i < len(rest) && rest[i] != '\''; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			if i == len(rest) {
+				t.Fatalf("Unterminated quoted value of %s: %s", key, connString)
+			}
+			rest = rest[i+1:]
+		} else {
+			end := strings.IndexByte(rest, ' ')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value.String()
+	}
+	return params
+}
+
+func TestPostgresConfig_ConnectionString(t *testing.T) {
+	base := main.PostgresConfig{Username: "user", Password: "secret"}
+	withSSL := base
+	withSSL.SSL = &main.SSLConfig{
+		Mode:     "verify-full",
+		RootCert: "/etc/ssl/my certs/root.crt",
+		Cert:     "/etc/ssl/client.crt",
+		Key:      "/etc/ssl/client.key",
+	}
+	escaped := base
+	escaped.Username = "o'brien"
+	escaped.Password = `p@ss 'w\rd`
+	timeouts := base
+	timeouts.ConnectTimeout = 1500 * time.Millisecond
+	timeouts.StatementTimeout = 30 * time.Second
+	shortTimeout := base
+	shortTimeout.ConnectTimeout = 200 * time.Millisecond
+	defaultMode := base
+	defaultMode.SSL = &main.SSLConfig{RootCert: "root.crt"}
+
+	cases := []struct {
+		name     string
+		config   main.PostgresConfig
+		dbURL    string
+		expected map[string]string
+	}{
+		{"defaults", base, "localhost:5432", map[string]string{
+			"host": "localhost", "port": "5432", "user": "user", "password": "secret", "dbname": "entities",
+			"application_name": "too-simple", "sslmode": "disable",
+		}},
+		{"ssl", withSSL, "db.example.com:6432", map[string]string{
+			"host": "db.example.com", "port": "6432", "user": "user", "password": "secret", "dbname": "entities",
+			"application_name": "too-simple", "sslmode": "verify-full", "sslrootcert": "/etc/ssl/my certs/root.crt",
+			"sslcert": "/etc/ssl/client.crt", "sslkey": "/etc/ssl/client.key",
+		}},
+		{"ssl without mode", defaultMode, "localhost:5432", map[string]string{
+			"host": "localhost", "port": "5432", "user": "user", "password": "secret", "dbname": "entities",
+			"application_name": "too-simple", "sslmode": "disable", "sslrootcert": "root.crt",
+		}},
+		{"escaping", escaped, "localhost:5432", map[string]string{
+			"host": "localhost", "port": "5432", "user": "o'brien", "password": `p@ss 'w\rd`, "dbname": "entities",
+			"application_name": "too-simple", "sslmode": "disable",
+		}},
+		{"timeouts", timeouts, "localhost:5432", map[string]string{
+			"host": "localhost", "port": "5432", "user": "user", "password": "secret", "dbname": "entities",
+			"application_name": "too-simple", "sslmode": "disable", "connect_timeout": "2",
+			"statement_timeout": "30000",
+		}},
+		{"short connect timeout", shortTimeout, "localhost:5432", map[string]string{
+			"host": "localhost", "port": "5432", "user": "user", "password": "secret", "dbname": "entities",
+			"application_name": "too-simple", "sslmode": "disable", "connect_timeout": "1",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			connString, err := main.ConnectionString(&c.config, c.dbURL, "entities")
+			checkErr(err)
+			if _, err := pq.NewConnector(connString); err != nil {
+				t.Errorf("Connection string is rejected by driver: %v", err)
+			}
+			if params := parseConnString(t, connString); !reflect.DeepEqual(params, c.expected) {
+				t.Errorf("Unexpected connection parameters of %s:\n%v\nexpected:\n%v", connString, params, c.expected)
+			}
+		})
+	}
+
+	for _, dbURL := range []string{"localhost", "localhost:port", "a:1:2"} {
+		if _, err := main.ConnectionString(&base, dbURL, "entities"); err == nil {
+			t.Errorf("Expected invalid db url %s to be rejected", dbURL)
+		}
+	}
+}
+
+func TestPostgresStore_QueryRequestID(t *testing.T) {
+	stub := &stubPostgres{}
+	db := main.OpenDB(stub)
+	defer db.Close()
+	store := main.NewPostgresStoreFromDB(db)
+
+	entities := main.GenerateSomeEntities(2, 10)
+	checkErr(store.AddEntities(main.WithRequestID(ctx, "req-42"), entities[:1], main.LoadOptions{}))
+	checkErr(store.AddEntities(ctx, entities[1:], main.LoadOptions{}))
+	if len(stub.prepared) != 2 {
+		t.Fatalf("Expected 2 prepared queries, got %v", stub.prepared)
+	}
+	if !strings.HasPrefix(stub.prepared[0], "/* request_id=req-42 */ INSERT") {
+		t.Errorf("Query of request is not tagged: %s", stub.prepared[0])
+	}
+	if strings.HasPrefix(stub.prepared[1], "/*") {
+		t.Errorf("Query without request is tagged: %s", stub.prepared[1])
+	}
+}
+
+// stubStatement is statement executed by scriptedDB
+type stubStatement struct {
+	query string
+	args  []driver.Value
+}
+
+// scriptedDB stands in for PostgreSQL answering queries with `rows`. Statements are kept in `committed`
+// when executed outside transaction or in committed one, statement is rejected if `fail` returns error
+type scriptedDB struct {
+	mu        sync.Mutex
+	fail      func(query string) error
+	rows      func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+	pingErr   error
+	executed  []string
+	committed []stubStatement
+	rollbacks int
+}
+
+func (d *scriptedDB) Connect(context.Context) (driver.Conn, error) {
+	return &scriptedConn{db: d}, nil
+}
+
+func (d *scriptedDB) Driver() driver.Driver {
+	return d
+}
+
+func (d *scriptedDB) Open(string) (driver.Conn, error) {
+	return &scriptedConn{db: d}, nil
+}
+
+func (d *scriptedDB) setPingErr(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pingErr = err
+}
+
+// statements returns committed statements containing `part`
+func (d *scriptedDB) statements(part string) []stubStatement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []stubStatement
+	for _, st := range d.committed {
+		if strings.Contains(st.query, part) {
+			result = append(result, st)
+		}
+	}
+	return result
+}
+
+type scriptedConn struct {
+	db      *scriptedDB
+	inTx    bool
+	pending []stubStatement
+}
+
+func (c *scriptedConn) Prepare(query string) (driver.Stmt, error) {
+	return &scriptedStmt{conn: c, query: query}, nil
+}
+
+func (c *scriptedConn) Close() error {
+	return nil
+}
+
+func (c *scriptedConn) Ping(context.Context) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.db.pingErr
+}
+
+func (c *scriptedConn) Begin() (driver.Tx, error) {
+	c.inTx, c.pending = true, nil
+	return c, nil
+}
+
+func (c *scriptedConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.committed = append(c.db.committed, c.pending...)
+	c.inTx, c.pending = false, nil
+	return nil
+}
+
+func (c *scriptedConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.rollbacks++
+	c.inTx, c.pending = false, nil
+	return nil
+}
+
+type scriptedStmt struct {
+	conn  *scriptedConn
+	query string
+}
+
+func (s *scriptedStmt) Close() error {
+	return nil
+}
+
+func (s *scriptedStmt) NumInput() int {
+	return -1
+}
+
+func (s *scriptedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.executed = append(db.executed, s.query)
+	if db.fail != nil {
+		if err := db.fail(s.query); err != nil {
+			return nil, err
+		}
+	}
+	st := stubStatement{query: s.query, args: args}
+	if s.conn.inTx {
+		s.conn.pending = append(s.conn.pending, st)
+	} else {
+		db.committed = append(db.committed, st)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *scriptedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	db.executed = append(db.executed, s.query)
+	db.mu.Unlock()
+	if db.rows == nil {
+		return nil, errors.New("queries are not supported")
+	}
+	columns, values, err := db.rows(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptedRows{columns: columns, values: values}, nil
+}
+
+type scriptedRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string {
+	return r.columns
+}
+
+func (r *scriptedRows) Close() error {
+	return nil
+}
+
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
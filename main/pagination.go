@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Sort fields and orders of entity lists
+const (
+	SortByUUID = "uuid"
+	SortByData = "data"
+	OrderAsc   = "asc"
+	OrderDesc  = "desc"
+)
+
+// ErrInvalidCursor is returned for malformed cursors or cursors issued for different sorting
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions describes requested page of entity list
+type ListOptions struct {
+	Count  int
+	Filter EntityFilter
+	Sort   string
+	Order  string
+	Cursor string // opaque token returned as EntityPage.Next
+}
+
+// EntityPage is single page of entity list
+type EntityPage struct {
+	Entities []Entity `json:"entities"`
+	Total    int      `json:"total"`
+	Next     string   `json:"next,omitempty"`
+}
+
+// cursorKeyLength limits length of sort key kept in cursor, so cursor fits in URL
+const cursorKeyLength = 128
+
+// cursor points to the last entity of the previous page
+type cursor struct {
+	Sort    string `json:"s"`
+	Order   string `json:"o"`
+	Key     string `json:"k,omitempty"` // value of sort field, if it's not uuid
+	Partial bool   `json:"p,omitempty"` // key is cut to cursorKeyLength characters
+	UUID    string `json:"u"`
+}
+
+// resolveKey returns full sort key of cursor given current data of the entity it points to
+//
+// If the entity is changed so it doesn't start with the key anymore, the key itself is used.
+// It's not greater than any data starting with it, so no entity is skipped
+func (c *cursor) resolveKey(data string) string {
+	if c.Partial && strings.HasPrefix(data, c.Key) {
+		return data
+	}
+	return c.Key
+}
+
+// Validate sets default sorting and checks options are valid
+func (o *ListOptions) Validate() error {
+	if o.Count < 1 {
+		o.Count = DefaultEntityListSize
+	}
+	if o.Sort == "" {
+		o.Sort = SortByUUID
+	}
+	if o.Order == "" {
+		o.Order = OrderAsc
+	}
+	if o.Sort != SortByUUID && o.Sort != SortByData {
+		return fmt.Errorf("invalid sort field: %s, must be one of: %s, %s", o.Sort, SortByUUID, SortByData)
+	}
+	if o.Order != OrderAsc && o.Order != OrderDesc {
+		return fmt.Errorf("invalid order: %s, must be one of: %s, %s", o.Order, OrderAsc, OrderDesc)
+	}
+	if err := o.Filter.Validate(); err != nil {
+		return err
+	}
+	_, err := o.cursor()
+	return err
+}
+
+// cursor decodes cursor of options, nil is returned for the first page
+func (o *ListOptions) cursor() (*cursor, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.UUID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != o.Sort || c.Order != o.Order {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// nextCursor encodes cursor pointing after given entity
+func (o *ListOptions) nextCursor(last *Entity) string {
+	c := cursor{Sort: o.Sort, Order: o.Order, UUID: last.Uuid}
+	if o.Sort == SortByData {
+		c.Key = last.Data
+		if utf8.RuneCountInString(c.Key) > cursorKeyLength {
+			c.Key, c.Partial = string([]rune(c.Key)[:cursorKeyLength]), true
+		}
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sortKey returns value of sort field of entity
+func (o *ListOptions) sortKey(e *Entity) string {
+	if o.Sort == SortByData {
+		return e.Data
+	}
+	return e.Uuid
+}
+
+// less compares entities by sort field, ties are resolved by uuid
+func (o *ListOptions) less(a, b *Entity) bool {
+	ka, kb := o.sortKey(a), o.sortKey(b)
+	if ka == kb {
+		ka, kb = a.Uuid, b.Uuid
+	}
+	if o.Order == OrderDesc {
+		return ka > kb
+	}
+	return ka < kb
+}
+
+// paginate sorts all matching entities and cuts requested page from them
+func (o *ListOptions) paginate(matching []Entity) (*EntityPage, error) {
+	c, err := o.cursor()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return o.less(&matching[i], &matching[j])
+	})
+	start := 0
+	if c != nil {
+		after := &Entity{Uuid: c.UUID, Data: c.Key}
+		if c.Partial {
+			for i := range matching {
+				if matching[i].Uuid == c.UUID {
+					after.Data = c.resolveKey(matching[i].Data)
+					break
+				}
+			}
+		}
+		start = sort.Search(len(matching), func(i int) bool {
+			return o.less(after, &matching[i])
+		})
+	}
+	end := start + o.Count
+	if end > len(matching) {
+		end = len(matching)
+	}
+	page := &EntityPage{Entities: matching[start:end], Total: len(matching)}
+	if end < len(matching) && end > start {
+		page.Next = o.nextCursor(&matching[end-1])
+	}
+	return page, nil
+}
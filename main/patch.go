@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Supported patch media types
+const (
+	MergePatchType = "application/merge-patch+json" // RFC 7386
+	JSONPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// Patch errors
+var (
+	ErrUnsupportedPatch = errors.New("unsupported patch media type")
+	ErrInvalidPatch     = errors.New("invalid patch document")
+	ErrPatchFailed      = errors.New("patch can't be applied")
+	ErrPatchResult      = errors.New("patched entity is invalid")
+)
+
+// patchFunc transforms decoded JSON document
+type patchFunc func(doc interface{}) (interface{}, error)
+
+// patchOperation is single operation of JSON Patch
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// parsePatch parses patch document of given media type
+func parsePatch(contentType string, body []byte) (patchFunc, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, ErrUnsupportedPatch
+	}
+	switch mediaType {
+	case MergePatchType:
+		var patch interface{}
+		if err := decodeJSON(body, &patch); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		return func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, patch), nil
+		}, nil
+	case JSONPatchType:
+		var ops []patchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		values := make([]interface{}, len(ops))
+		for i, op := range ops {
+			if err := op.validate(); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+			if op.Value != nil {
+				if err := decodeJSON(*op.Value, &values[i]); err != nil {
+					return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+				}
+			}
+		}
+		return func(doc interface{}) (interface{}, error) {
+			var err error
+			for i, op := range ops {
+				if doc, err = op.apply(doc, values[i]); err != nil {
+					return nil, fmt.Errorf("%w: operation %d: %v", ErrPatchFailed, i, err)
+				}
+			}
+			return doc, nil
+		}, nil
+	default:
+		return nil, ErrUnsupportedPatch
+	}
+}
+
+// mergePatch applies JSON merge patch to the document
+func mergePatch(doc interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = make(map[string]interface{})
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(docObj, key)
+			continue
+		}
+		docObj[key] = mergePatch(docObj[key], value)
+	}
+	return docObj
+}
+
+func (op *patchOperation) validate() error {
+	if _, err := parsePointer(op.Path); err != nil {
+		return err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("missing value of %s operation", op.Op)
+		}
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return err
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+			return fmt.Errorf("can't move %s to its child %s", op.From, op.Path)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown operation: %s", op.Op)
+	}
+	return nil
+}
+
+func (op *patchOperation) apply(doc interface{}, value interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		doc, moved, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, moved)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		copied, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(copied))
+	default: // test
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, value) {
+			return nil, fmt.Errorf("test of %s failed", op.Path)
+		}
+		return doc, nil
+	}
+}
+
+// parsePointer splits JSON pointer to unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer: %s", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses index of array element, `-` means index after the last element
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index: %s", token)
+	}
+	if index > length || (index == length && !allowEnd) {
+		return 0, fmt.Errorf("array index out of range: %s", token)
+	}
+	return index, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %s not found", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("can't reference %s in scalar value", token)
+		}
+	}
+	return doc, nil
+}
+
+// addValue adds value to the document returning changed document
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parentPath, last := path[:len(path)-1], path[len(path)-1]
+	parent, err := getValue(doc, parentPath)
+	if err != nil {
+		return nil, err
+	}
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return replaceValue(doc, parentPath, node)
+	default:
+		return nil, fmt.Errorf("can't add %s to scalar value", last)
+	}
+}
+
+// removeValue removes value from the document returning changed document and removed value
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parentPath, last := path[:len(path)-1], path[len(path)-1]
+	parent, err := getValue(doc, parentPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("member %s not found", last)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = replaceValue(doc, parentPath, node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("can't remove %s from scalar value", last)
+	}
+}
+
+// replaceValue sets existing value of the document, used for arrays changing their length
+func replaceValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		index, _ := arrayIndex(last, len(node), false)
+		node[index] = value
+	}
+	return doc, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(node))
+		for key, item := range node {
+			result[key] = deepCopy(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(node))
+		for i, item := range node {
+			result[i] = deepCopy(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// jsonEqual compares decoded JSON values, numbers are compared by exact value
+func jsonEqual(a, b interface{}) bool {
+	numA, okA := a.(json.Number)
+	numB, okB := b.(json.Number)
+	if okA && okB {
+		result, ok := compareNumbers(numA, numB)
+		return ok && result == 0
+	}
+	switch nodeA := a.(type) {
+	case map[string]interface{}:
+		nodeB, ok := b.(map[string]interface{})
+		if !ok || len(nodeA) != len(nodeB) {
+			return false
+		}
+		for key, value := range nodeA {
+			other, ok := nodeB[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		nodeB, ok := b.([]interface{})
+		if !ok || len(nodeA) != len(nodeB) {
+			return false
+		}
+		for i := range nodeA {
+			if !jsonEqual(nodeA[i], nodeB[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// patchEntity applies patch to JSON representation of the entity
+//
+// Only `data` and `document` can be changed, patches changing read-only fields are rejected
+func patchEntity(e *Entity, patch patchFunc) error {
+	original, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := decodeJSON(original, &doc); err != nil {
+		return err
+	}
+	if doc, err = patch(doc); err != nil {
+		return err
+	}
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPatchResult, err)
+	}
+	var result Entity
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return fmt.Errorf("%w: %v", ErrPatchResult, err)
+	}
+	if result.Uuid != e.Uuid || result.Version != e.Version || !result.UpdatedAt.Equal(e.UpdatedAt) {
+		return fmt.Errorf("%w: read-only field is changed", ErrPatchResult)
+	}
+	*e = result
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReplicaCheckInterval = 10 * time.Second
+
+// replicaPingTimeout limits health check of single replica, so unreachable replicas don't delay startup
+const replicaPingTimeout = 2 * time.Second
+
+type ctxKey int
+
+const primaryReadKey ctxKey = iota
+
+// WithPrimaryRead marks context, so reads within it are served by primary database
+func WithPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey, true)
+}
+
+func isPrimaryRead(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadKey).(bool)
+	return primary
+}
+
+// replica is read-only PostgreSQL instance
+type replica struct {
+	url     string
+	db      *sql.DB
+	healthy int32
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// setHealthy changes replica state, change caused by request is logged with its ID
+func (r *replica) setHealthy(ctx context.Context, healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&r.healthy, value) != value {
+		if healthy {
+			requestLogger(ctx).Info("Replica is healthy, routing reads to it", "replica", r.url)
+		} else {
+			requestLogger(ctx).Warn("Replica is unhealthy, excluded from reads", "replica", r.url)
+		}
+	}
+}
+
+func (r *replica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaPingTimeout)
+	defer cancel()
+	r.setHealthy(context.Background(), r.db.PingContext(ctx) == nil)
+}
+
+// openReplicas opens connection pools to configured replicas and starts their health checking
+func (s *PostgresStore) openReplicas(config *PostgresConfig) error {
+	for _, url := range config.Replicas {
+		db, err := openPool(config, url)
+		if err != nil {
+			s.closeReplicas()
+			return err
+		}
+		s.replicas = append(s.replicas, &replica{url: url, db: db})
+	}
+	s.startReplicaChecks(config.ReplicaCheckInterval)
+	return nil
+}
+
+// startReplicaChecks checks replicas once and then every `interval` until replicas are closed
+func (s *PostgresStore) startReplicaChecks(interval time.Duration) {
+	if len(s.replicas) == 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	s.checkReplicas()
+	s.stopChan = make(chan struct{})
+	go s.checkReplicasPeriodically(s.stopChan, interval)
+}
+
+// closeReplicas stops health checking and closes connection pools of replicas
+func (s *PostgresStore) closeReplicas() error {
+	if s.stopChan != nil {
+		close(s.stopChan)
+		s.stopChan = nil
+	}
+	var result error
+	for _, r := range s.replicas {
+		if err := r.db.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close stops replica health checking and closes connection pools of primary and replicas.
+// Pools are shared by all collections, so only store of default collection should be closed
+func (s *PostgresStore) Close() error {
+	err := s.closeReplicas()
+	if dbErr := s.DB.Close(); dbErr != nil {
+		return dbErr
+	}
+	return err
+}
+
+// checkReplicas pings all replicas concurrently, waiting for all checks to finish
+func (s *PostgresStore) checkReplicas() {
+	var wg sync.WaitGroup
+	for _, r := range s.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			r.check()
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (s *PostgresStore) checkReplicasPeriodically(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkReplicas()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// replica selects next healthy replica in round-robin order, nil is returned if read must go to primary
+func (s *PostgresStore) replica(ctx context.Context) *replica {
+	if len(s.replicas) == 0 || isPrimaryRead(ctx) {
+		return nil
+	}
+	start := atomic.AddUint32(&s.next, 1)
+	for i := 0; i < len(s.replicas); i++ {
+		r := s.replicas[(int(start)+i)%len(s.replicas)]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// read runs read-only query on replica, falling back to primary if replica connection fails
+func (s *PostgresStore) read(ctx context.Context, query func(db *sql.DB) error) error {
+	r := s.replica(ctx)
+	if r == nil {
+		return query(s.DB)
+	}
+	err := query(r.db)
+	if err != nil && isConnectionError(err) {
+		r.setHealthy(ctx, false)
+		return query(s.DB)
+	}
+	return err
+}
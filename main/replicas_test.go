@@ -0,0 +1,120 @@
+package main_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+)
+
+// entityDB returns database answering every entity query with entity having `name` as data,
+// or with `err` if it's given
+func entityDB(name string, err error) (*scriptedDB, *sql.DB) {
+	db := &scriptedDB{rows: func(_ string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if err != nil {
+			return nil, nil, err
+		}
+		columns := []string{"uuid", "data", "version", "updated_at", "document"}
+		return columns, [][]driver.Value{{args[0], name, int64(1), time.Now(), nil}}, nil
+	}}
+	return db, sql.OpenDB(db)
+}
+
+// readFrom returns data of entity read from store, which is name of database serving the read
+func readFrom(t *testing.T, store *main.PostgresStore) string {
+	e := &main.Entity{Uuid: newTestEntity("").Uuid}
+	if err := store.Get(ctx, e); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return e.Data
+}
+
+// waitReadsFrom waits until reads are served by `name` database after periodic replica checks
+func waitReadsFrom(t *testing.T, store *main.PostgresStore, name string) {
+	deadline := time.Now().Add(time.Second)
+	for readFrom(t, store) != name {
+		if time.Now().After(deadline) {
+			t.Fatalf("Reads are not routed to %s", name)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPostgresStore_ReadRouting(t *testing.T) {
+	primary, primaryDB := entityDB("primary", nil)
+	first, firstDB := entityDB("first", nil)
+	second, secondDB := entityDB("second", nil)
+	store := main.NewPostgresStoreWithReplicas(primaryDB, time.Hour, firstDB, secondDB)
+	defer func() { _ = store.Close() }()
+
+	served := map[string]int{}
+	for i := 0; i < 4; i++ {
+		served[readFrom(t, store)]++
+	}
+	if served["first"] != 2 || served["second"] != 2 {
+		t.Errorf("Reads are not balanced between replicas: %v", served)
+	}
+	if data := readFrom(t, store); countExecuted(primary, "SELECT") != 0 || data == "primary" {
+		t.Error("Read is routed to primary while replicas are healthy")
+	}
+	e := &main.Entity{Uuid: newTestEntity("").Uuid}
+	checkErr(store.Get(main.WithPrimaryRead(ctx), e))
+	if e.Data != "primary" {
+		t.Errorf("Primary read is served by %s", e.Data)
+	}
+	if countExecuted(first, "SELECT")+countExecuted(second, "SELECT") != 5 {
+		t.Error("Unexpected count of reads served by replicas")
+	}
+}
+
+func TestPostgresStore_UnhealthyReplica(t *testing.T) {
+	_, primaryDB := entityDB("primary", nil)
+	first, firstDB := entityDB("first", nil)
+	second, secondDB := entityDB("second", nil)
+	first.setPingErr(errors.New("connection refused"))
+	store := main.NewPostgresStoreWithReplicas(primaryDB, 10*time.Millisecond, firstDB, secondDB)
+	defer func() { _ = store.Close() }()
+
+	for i := 0; i < 3; i++ {
+		if data := readFrom(t, store); data != "second" {
+			t.Errorf("Read is served by %s instead of the only healthy replica", data)
+		}
+	}
+
+	// all replicas are unhealthy, so primary is used
+	second.setPingErr(errors.New("connection refused"))
+	waitReadsFrom(t, store, "primary")
+
+	// recovered replica is used again
+	first.setPingErr(nil)
+	waitReadsFrom(t, store, "first")
+}
+
+func TestPostgresStore_ReplicaFailover(t *testing.T) {
+	_, primaryDB := entityDB("primary", nil)
+	broken, brokenDB := entityDB("broken", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")})
+	store := main.NewPostgresStoreWithReplicas(primaryDB, time.Hour, brokenDB)
+	defer func() { _ = store.Close() }()
+
+	if data := readFrom(t, store); data != "primary" {
+		t.Errorf("Read failed on replica is not retried on primary, served by %s", data)
+	}
+	queries := countExecuted(broken, "SELECT")
+	if data := readFrom(t, store); data != "primary" || countExecuted(broken, "SELECT") != queries {
+		t.Error("Failed replica is not excluded from reads")
+	}
+}
+
+func TestPostgresStore_Close(t *testing.T) {
+	_, primaryDB := entityDB("primary", nil)
+	_, replicaDB := entityDB("replica", nil)
+	store := main.NewPostgresStoreWithReplicas(primaryDB, time.Millisecond, replicaDB)
+	checkErr(store.Close())
+	if primaryDB.Ping() == nil || replicaDB.Ping() == nil {
+		t.Error("Connection pools are not closed")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/twinj/uuid"
+)
+
+// HeaderRequestID identifies request in responses, logs and database queries
+const HeaderRequestID = "X-Request-ID"
+
+// validRequestID limits accepted request IDs, so they are safe to be put into logs and SQL comments
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// WithRequestID returns context of request with given ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns ID of request the context belongs to, empty string outside of requests
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns logger adding ID of the request and its trace to every record
+func requestLogger(ctx context.Context) *Logger {
+	var fields []interface{}
+	if id := RequestID(ctx); id != "" {
+		fields = append(fields, "request_id", id)
+	}
+	if sc, ok := spanContextFrom(ctx); ok && sc.Sampled {
+		fields = append(fields, "trace_id", hex.EncodeToString(sc.TraceID[:]))
+	}
+	if len(fields) == 0 {
+		return logger
+	}
+	return logger.With(fields...)
+}
+
+// requestIDMiddle accepts request ID sent by client or generates new one if it's missing or invalid,
+// the ID is sent back in response header
+func requestIDMiddle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewV4().String()
+		}
+		w.Header().Set(HeaderRequestID, id)
+		h.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// queryComment returns SQL comment with request ID of the context, empty string outside of requests
+//
+// The comment is prepended to queries, so they can be correlated with requests in `pg_stat_activity`
+// and PostgreSQL logs
+func queryComment(ctx context.Context) string {
+	id := RequestID(ctx)
+	if id == "" || !validRequestID.MatchString(id) {
+		return ""
+	}
+	return "/* request_id=" + id + " */ "
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// JSONSchema is compiled JSON Schema
+//
+// Supported keywords are `type`, `enum`, `const`, `properties`, `required`, `additionalProperties`,
+// `items`, `minimum`, `maximum`, `exclusiveMinimum`, `exclusiveMaximum`, `minLength`, `maxLength`,
+// `pattern`, `minItems`, `maxItems`, `allOf`, `anyOf`, `oneOf` and `not` with semantics of draft 2020-12.
+// Schemas with other validation keywords are rejected, annotations and unknown keywords are ignored
+type JSONSchema struct {
+	raw json.RawMessage
+
+	never bool // `false` schema
+
+	types                []string
+	enum                 []interface{}
+	constValue           interface{}
+	hasConst             bool
+	properties           map[string]*JSONSchema
+	required             []string
+	additionalProperties *JSONSchema
+	items                *JSONSchema
+	minimum              json.Number
+	maximum              json.Number
+	exclusiveMinimum     json.Number
+	exclusiveMaximum     json.Number
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	minItems             *int
+	maxItems             *int
+	allOf                []*JSONSchema
+	anyOf                []*JSONSchema
+	oneOf                []*JSONSchema
+	not                  *JSONSchema
+}
+
+// SchemaViolation is single mismatch of validated value and schema
+type SchemaViolation struct {
+	Path    string `json:"path"` // JSON pointer to invalid value
+	Message string `json:"message"`
+}
+
+// SchemaError is returned when entity payload doesn't match collection schema
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = fmt.Sprintf("%s: %s", v.Path, v.Message)
+	}
+	return "entity doesn't match collection schema: " + strings.Join(messages, "; ")
+}
+
+// ParseJSONSchema compiles JSON Schema document
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	var doc interface{}
+	if err := decodeJSON(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	schema, err := compileSchema(doc, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	schema.raw = json.RawMessage(data)
+	return schema, nil
+}
+
+// MarshalJSON returns original schema document
+func (s *JSONSchema) MarshalJSON() ([]byte, error) {
+	return s.raw, nil
+}
+
+// unsupportedKeywords are validation keywords of JSON Schema which are not implemented, schemas using them
+// are rejected instead of being validated partially
+var unsupportedKeywords = []string{
+	"$ref", "$dynamicRef", "$recursiveRef", "additionalItems", "contains", "dependencies", "dependentRequired",
+	"dependentSchemas", "else", "if", "maxContains", "maxProperties", "minContains", "minProperties",
+	"multipleOf", "patternProperties", "prefixItems", "propertyNames", "then", "unevaluatedItems",
+	"unevaluatedProperties", "uniqueItems",
+}
+
+func compileSchema(doc interface{}, path string) (*JSONSchema, error) {
+	switch value := doc.(type) {
+	case bool:
+		return &JSONSchema{never: !value}, nil
+	case map[string]interface{}:
+		c := schemaCompiler{doc: value, path: path}
+		return c.compile()
+	default:
+		return nil, fmt.Errorf("%s: schema must be object or boolean", pointerOrRoot(path))
+	}
+}
+
+// schemaCompiler compiles keywords of single schema object, remembering the first error
+type schemaCompiler struct {
+	doc  map[string]interface{}
+	path string
+	err  error
+}
+
+func (c *schemaCompiler) fail(keyword string, format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf("%s/%s: %s", c.path, keyword, fmt.Sprintf(format, args...))
+	}
+}
+
+func (c *schemaCompiler) schema(keyword string) *JSONSchema {
+	value, ok := c.doc[keyword]
+	if !ok {
+		return nil
+	}
+	schema, err := compileSchema(value, c.path+"/"+keyword)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return schema
+}
+
+func (c *schemaCompiler) schemaList(keyword string) []*JSONSchema {
+	value, ok := c.doc[keyword]
+	if !ok {
+		return nil
+	}
+	items, ok := value.([]interface{})
+	if !ok || len(items) == 0 {
+		c.fail(keyword, "non-empty array is expected")
+		return nil
+	}
+	schemas := make([]*JSONSchema, len(items))
+	for i, item := range items {
+		schema, err := compileSchema(item, fmt.Sprintf("%s/%s/%d", c.path, keyword, i))
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		schemas[i] = schema
+	}
+	return schemas
+}
+
+// number returns numeric keyword value, which is empty if keyword is missing
+func (c *schemaCompiler) number(keyword string) json.Number {
+	value, ok := c.doc[keyword]
+	if !ok {
+		return ""
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		c.fail(keyword, "number is expected")
+		return ""
+	}
+	if _, ok := parseNumber(number); !ok {
+		c.fail(keyword, "number is out of supported range")
+		return ""
+	}
+	return number
+}
+
+// count returns non-negative integer keyword value, too large values are limited to math.MaxInt32
+func (c *schemaCompiler) count(keyword string) *int {
+	number := c.number(keyword)
+	if number == "" {
+		return nil
+	}
+	rat, _ := parseNumber(number)
+	if !rat.IsInt() || rat.Sign() < 0 {
+		c.fail(keyword, "non-negative integer is expected")
+		return nil
+	}
+	count := math.MaxInt32
+	if rat.Num().BitLen() < 32 {
+		count = int(rat.Num().Int64())
+	}
+	return &count
+}
+
+func (c *schemaCompiler) compile() (*JSONSchema, error) {
+	s := &JSONSchema{}
+	for _, keyword := range unsupportedKeywords {
+		if _, ok := c.doc[keyword]; ok {
+			c.fail(keyword, "unsupported keyword")
+		}
+	}
+	if value, ok := c.doc["type"]; ok {
+		switch types := value.(type) {
+		case string:
+			s.types = []string{types}
+		case []interface{}:
+			for _, t := range types {
+				name, _ := t.(string)
+				s.types = append(s.types, name)
+			}
+		default:
+			c.fail("type", "string or array is expected")
+		}
+		for _, t := range s.types {
+			switch t {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				c.fail("type", "unknown type %q", t)
+			}
+		}
+	}
+	if value, ok := c.doc["enum"]; ok {
+		if s.enum, ok = value.([]interface{}); !ok {
+			c.fail("enum", "array is expected")
+		}
+	}
+	s.constValue, s.hasConst = c.doc["const"]
+	if value, ok := c.doc["properties"]; ok {
+		properties, ok := value.(map[string]interface{})
+		if !ok {
+			c.fail("properties", "object is expected")
+		}
+		s.properties = make(map[string]*JSONSchema, len(properties))
+		for name, property := range properties {
+			schema, err := compileSchema(property, c.path+"/properties/"+escapePointer(name))
+			if err != nil && c.err == nil {
+				c.err = err
+			}
+			s.properties[name] = schema
+		}
+	}
+	if value, ok := c.doc["required"]; ok {
+		required, ok := value.([]interface{})
+		if !ok {
+			c.fail("required", "array is expected")
+		}
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				s.required = append(s.required, name)
+			} else {
+				c.fail("required", "array of strings is expected")
+			}
+		}
+	}
+	s.additionalProperties = c.schema("additionalProperties")
+	s.items = c.schema("items")
+	s.minimum = c.number("minimum")
+	s.maximum = c.number("maximum")
+	s.exclusiveMinimum = c.number("exclusiveMinimum")
+	s.exclusiveMaximum = c.number("exclusiveMaximum")
+	s.minLength = c.count("minLength")
+	s.maxLength = c.count("maxLength")
+	s.minItems = c.count("minItems")
+	s.maxItems = c.count("maxItems")
+	if value, ok := c.doc["pattern"]; ok {
+		expr, ok := value.(string)
+		if !ok {
+			c.fail("pattern", "string is expected")
+		}
+		var err error
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			c.fail("pattern", "invalid regular expression: %v", err)
+		}
+	}
+	s.allOf = c.schemaList("allOf")
+	s.anyOf = c.schemaList("anyOf")
+	s.oneOf = c.schemaList("oneOf")
+	s.not = c.schema("not")
+	return s, c.err
+}
+
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+func pointerOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// jsonType returns JSON Schema type name of decoded value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		if number, ok := parseNumber(v); ok && number.IsInt() {
+			return "integer"
+		}
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// Validate checks decoded JSON value, returning all found violations
+func (s *JSONSchema) Validate(value interface{}) []SchemaViolation {
+	var violations []SchemaViolation
+	s.validate(value, "", &violations)
+	return violations
+}
+
+func (s *JSONSchema) validate(value interface{}, path string, violations *[]SchemaViolation) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, SchemaViolation{Path: pointerOrRoot(path), Message: fmt.Sprintf(format, args...)})
+	}
+	if s.never {
+		report("no value is allowed")
+		return
+	}
+	if len(s.types) > 0 {
+		actual := jsonType(value)
+		matched := false
+		for _, t := range s.types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+			}
+		}
+		if !matched {
+			report("%s is expected, got %s", strings.Join(s.types, " or "), actual)
+			return
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if jsonEqual(value, allowed) {
+				found = true
+			}
+		}
+		if !found {
+			report("value is not one of allowed values")
+		}
+	}
+	if s.hasConst && !jsonEqual(value, s.constValue) {
+		report("value must be equal to constant")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		s.validateObject(v, path, violations, report)
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			report("at least %d items are expected", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			report("at most %d items are expected", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				s.items.validate(item, fmt.Sprintf("%s/%d", path, i), violations)
+			}
+		}
+	case json.Number:
+		bounds := []struct {
+			bound   json.Number
+			valid   func(cmp int) bool
+			message string
+		}{
+			{s.minimum, func(cmp int) bool { return cmp >= 0 }, "value must be >= %s"},
+			{s.maximum, func(cmp int) bool { return cmp <= 0 }, "value must be <= %s"},
+			{s.exclusiveMinimum, func(cmp int) bool { return cmp > 0 }, "value must be > %s"},
+			{s.exclusiveMaximum, func(cmp int) bool { return cmp < 0 }, "value must be < %s"},
+		}
+		for _, b := range bounds {
+			if b.bound == "" {
+				continue
+			}
+			cmp, ok := compareNumbers(v, b.bound)
+			if !ok {
+				report("number is out of supported range")
+				break
+			}
+			if !b.valid(cmp) {
+				report(b.message, b.bound)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			report("at least %d characters are expected", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			report("at most %d characters are expected", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			report("value doesn't match pattern %s", s.pattern.String())
+		}
+	}
+
+	for _, schema := range s.allOf {
+		schema.validate(value, path, violations)
+	}
+	if s.anyOf != nil {
+		matched := 0
+		for _, schema := range s.anyOf {
+			if len(schema.Validate(value)) == 0 {
+				matched++
+			}
+		}
+		if matched == 0 {
+			report("value doesn't match any of schemas")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, schema := range s.oneOf {
+			if len(schema.Validate(value)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			report("value must match exactly one schema, matched %d", matched)
+		}
+	}
+	if s.not != nil && len(s.not.Validate(value)) == 0 {
+		report("value must not match schema")
+	}
+}
+
+func (s *JSONSchema) validateObject(object map[string]interface{}, path string, violations *[]SchemaViolation,
+	report func(format string, args ...interface{})) {
+	for _, name := range s.required {
+		if _, ok := object[name]; !ok {
+			report("missing required property %s", name)
+		}
+	}
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names) // violations are reported in stable order
+	for _, name := range names {
+		propertyPath := path + "/" + escapePointer(name)
+		if schema, ok := s.properties[name]; ok {
+			schema.validate(object[name], propertyPath, violations)
+		} else if s.additionalProperties != nil {
+			if s.additionalProperties.never {
+				*violations = append(*violations, SchemaViolation{Path: propertyPath, Message: "unknown property"})
+				continue
+			}
+			s.additionalProperties.validate(object[name], propertyPath, violations)
+		}
+	}
+}
+
+// readOnlyFields are set by server, so they are not validated
+var readOnlyFields = []string{"uuid", "version", "updated_at"}
+
+// schemaRegistry keeps schemas of collections
+type schemaRegistry struct {
+	mu         sync.RWMutex
+	schemas    map[string]*JSONSchema
+	configured map[string]*JSONSchema // schemas from configuration, restored when collection is dropped
+}
+
+func (r *schemaRegistry) get(collection string) *JSONSchema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.schemas[collection]
+}
+
+// set replaces schema of collection, nil schema removes it
+func (r *schemaRegistry) set(collection string, schema *JSONSchema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schemas == nil {
+		r.schemas = make(map[string]*JSONSchema)
+	}
+	if schema == nil {
+		delete(r.schemas, collection)
+		return
+	}
+	r.schemas[collection] = schema
+}
+
+// configure sets schema of collection given in configuration
+func (r *schemaRegistry) configure(collection string, schema *JSONSchema) {
+	r.set(collection, schema)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.configured == nil {
+		r.configured = make(map[string]*JSONSchema)
+	}
+	r.configured[collection] = schema
+}
+
+// reset replaces schema of dropped collection with configured one, so recreated collection doesn't keep
+// schema set for the dropped one
+func (r *schemaRegistry) reset(collection string) {
+	r.mu.RLock()
+	schema := r.configured[collection]
+	r.mu.RUnlock()
+	r.set(collection, schema)
+}
+
+// validatePayload validates JSON entity payload against schema of collection, read-only fields are ignored
+func (r *schemaRegistry) validatePayload(collection string, payload []byte) error {
+	schema := r.get(collection)
+	if schema == nil {
+		return nil
+	}
+	var doc interface{}
+	if err := decodeJSON(payload, &doc); err != nil {
+		return err
+	}
+	if object, ok := doc.(map[string]interface{}); ok {
+		for _, field := range readOnlyFields {
+			delete(object, field)
+		}
+	}
+	if violations := schema.Validate(doc); len(violations) > 0 {
+		return &SchemaError{Violations: violations}
+	}
+	return nil
+}
+
+// validateEntity validates JSON representation of the entity against schema of collection
+func (r *schemaRegistry) validateEntity(collection string, e *Entity) error {
+	if r.get(collection) == nil {
+		return nil
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.validatePayload(collection, payload)
+}
@@ -0,0 +1,372 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["data", "document"],
+	"additionalProperties": false,
+	"properties": {
+		"data": {"type": "string", "minLength": 2, "pattern": "^[a-z ]+$"},
+		"document": {
+			"type": "object",
+			"properties": {
+				"status": {"enum": ["active", "disabled"]},
+				"count": {"type": "integer", "minimum": 0, "exclusiveMaximum": 10},
+				"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+				"owner": {"oneOf": [{"type": "null"}, {"type": "object", "required": ["name"]}]}
+			}
+		}
+	}
+}`
+
+func TestJSONSchema_Validate(t *testing.T) {
+	schema, err := main.ParseJSONSchema([]byte(testSchema))
+	checkErr(err)
+
+	cases := map[string]struct {
+		value string
+		paths []string
+	}{
+		"Valid":            {`{"data": "ok", "document": {"status": "active", "count": 9, "tags": ["a"], "owner": null}}`, nil},
+		"Not object":       {`[]`, []string{"/"}},
+		"Missing required": {`{"data": "ok"}`, []string{"/"}},
+		"Unknown property": {`{"data": "ok", "document": {}, "extra": 1}`, []string{"/extra"}},
+		"Short string":     {`{"data": "o", "document": {}}`, []string{"/data"}},
+		"Pattern mismatch": {`{"data": "OK", "document": {}}`, []string{"/data"}},
+		"Not in enum":      {`{"data": "ok", "document": {"status": "unknown"}}`, []string{"/document/status"}},
+		"Not integer":      {`{"data": "ok", "document": {"count": 1.5}}`, []string{"/document/count"}},
+		"Out of range":     {`{"data": "ok", "document": {"count": 10}}`, []string{"/document/count"}},
+		"Below minimum":    {`{"data": "ok", "document": {"count": -1}}`, []string{"/document/count"}},
+		"Invalid item":     {`{"data": "ok", "document": {"tags": ["a", 1]}}`, []string{"/document/tags/1"}},
+		"Too many items":   {`{"data": "ok", "document": {"tags": ["a", "b", "c"]}}`, []string{"/document/tags"}},
+		"One of mismatch":  {`{"data": "ok", "document": {"owner": {}}}`, []string{"/document/owner"}},
+		"Several errors":   {`{"data": 1, "document": {"count": "1"}}`, []string{"/data", "/document/count"}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var value interface{}
+			decoder := json.NewDecoder(strings.NewReader(c.value))
+			decoder.UseNumber()
+			checkErr(decoder.Decode(&value))
+			violations := schema.Validate(value)
+			if len(violations) != len(c.paths) {
+				t.Fatalf("Expected %d violations, got %v", len(c.paths), violations)
+			}
+			for i, v := range violations {
+				if v.Path != c.paths[i] {
+					t.Errorf("Expected violation at %s, got %s: %s", c.paths[i], v.Path, v.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONSchema_Invalid(t *testing.T) {
+	schemas := []string{
+		`[]`,
+		`{"type": "text"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"properties": {"a": 1}}`,
+		`{"anyOf": []}`,
+		`{"pattern": 1}`,
+		`{"minimum": "1"}`,
+		`{"exclusiveMinimum": true}`,
+		`{"minItems": 1.5}`,
+		`{"maximum": 1e200000}`,
+		`{"items": [{"type": "string"}]}`,
+		`{"$ref": "#/$defs/name"}`,
+		`{"uniqueItems": true}`,
+		`{"properties": {"a": {"patternProperties": {"^x": {}}}}}`,
+		`{"if": {"type": "string"}, "then": {"minLength": 1}}`,
+	}
+	for _, schema := range schemas {
+		if _, err := main.ParseJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("Invalid schema %s is accepted", schema)
+		}
+	}
+}
+
+// schemaConformance contains cases of supported keywords in format of JSON-Schema-Test-Suite,
+// most of them are taken from its draft2020-12 tests
+const schemaConformance = `[
+	{"description": "integer type", "schema": {"type": "integer"}, "tests": [
+		{"description": "integer", "data": 1, "valid": true},
+		{"description": "float with zero fractional part", "data": 1.0, "valid": true},
+		{"description": "float", "data": 1.1, "valid": false},
+		{"description": "string", "data": "1", "valid": false},
+		{"description": "object", "data": {}, "valid": false},
+		{"description": "array", "data": [], "valid": false},
+		{"description": "boolean", "data": true, "valid": false},
+		{"description": "null", "data": null, "valid": false}
+	]},
+	{"description": "number type", "schema": {"type": "number"}, "tests": [
+		{"description": "integer", "data": 1, "valid": true},
+		{"description": "float", "data": 1.1, "valid": true},
+		{"description": "string", "data": "1", "valid": false}
+	]},
+	{"description": "null type", "schema": {"type": "null"}, "tests": [
+		{"description": "null", "data": null, "valid": true},
+		{"description": "zero", "data": 0, "valid": false},
+		{"description": "empty string", "data": "", "valid": false},
+		{"description": "false", "data": false, "valid": false}
+	]},
+	{"description": "multiple types", "schema": {"type": ["integer", "string"]}, "tests": [
+		{"description": "integer", "data": 1, "valid": true},
+		{"description": "string", "data": "foo", "valid": true},
+		{"description": "float", "data": 1.1, "valid": false},
+		{"description": "null", "data": null, "valid": false}
+	]},
+	{"description": "simple enum", "schema": {"enum": [1, 2, 3]}, "tests": [
+		{"description": "member", "data": 1, "valid": true},
+		{"description": "something else", "data": 4, "valid": false}
+	]},
+	{"description": "heterogeneous enum", "schema": {"enum": [6, "foo", [], true, {"foo": 12}]}, "tests": [
+		{"description": "member", "data": [], "valid": true},
+		{"description": "null", "data": null, "valid": false},
+		{"description": "object with other value", "data": {"foo": false}, "valid": false},
+		{"description": "equal object", "data": {"foo": 12}, "valid": true},
+		{"description": "object with extra property", "data": {"foo": 12, "boo": 42}, "valid": false}
+	]},
+	{"description": "enum with false", "schema": {"enum": [false]}, "tests": [
+		{"description": "false", "data": false, "valid": true},
+		{"description": "integer zero", "data": 0, "valid": false},
+		{"description": "float zero", "data": 0.0, "valid": false}
+	]},
+	{"description": "enum with 1", "schema": {"enum": [1]}, "tests": [
+		{"description": "float one", "data": 1.0, "valid": true},
+		{"description": "true", "data": true, "valid": false}
+	]},
+	{"description": "const number", "schema": {"const": 2}, "tests": [
+		{"description": "same value", "data": 2, "valid": true},
+		{"description": "other value", "data": 5, "valid": false},
+		{"description": "other type", "data": "a", "valid": false}
+	]},
+	{"description": "const object", "schema": {"const": {"foo": "bar", "baz": "bax"}}, "tests": [
+		{"description": "same object with other order", "data": {"baz": "bax", "foo": "bar"}, "valid": true},
+		{"description": "other object", "data": {"foo": "bar"}, "valid": false},
+		{"description": "other type", "data": [1, 2], "valid": false}
+	]},
+	{"description": "const null", "schema": {"const": null}, "tests": [
+		{"description": "null", "data": null, "valid": true},
+		{"description": "zero", "data": 0, "valid": false}
+	]},
+	{"description": "const large number", "schema": {"const": 9007199254740992}, "tests": [
+		{"description": "same integer", "data": 9007199254740992, "valid": true},
+		{"description": "integer minus one", "data": 9007199254740991, "valid": false},
+		{"description": "float", "data": 9007199254740992.0, "valid": true}
+	]},
+	{"description": "properties", "schema": {"properties": {"foo": {"type": "integer"}, "bar": {"type": "string"}}}, "tests": [
+		{"description": "both valid", "data": {"foo": 1, "bar": "baz"}, "valid": true},
+		{"description": "one invalid", "data": {"foo": 1, "bar": {}}, "valid": false},
+		{"description": "both invalid", "data": {"foo": [], "bar": {}}, "valid": false},
+		{"description": "other properties", "data": {"quux": []}, "valid": true},
+		{"description": "array", "data": [], "valid": true},
+		{"description": "number", "data": 12, "valid": true}
+	]},
+	{"description": "properties with escaped names", "schema": {"properties": {"foo\nbar": {"type": "number"}, "foo/bar": {"type": "number"}}}, "tests": [
+		{"description": "valid", "data": {"foo\nbar": 1, "foo/bar": 2}, "valid": true},
+		{"description": "invalid", "data": {"foo\nbar": "1"}, "valid": false}
+	]},
+	{"description": "properties with boolean schemas", "schema": {"properties": {"foo": true, "bar": false}}, "tests": [
+		{"description": "no properties", "data": {}, "valid": true},
+		{"description": "allowed property", "data": {"foo": 1}, "valid": true},
+		{"description": "forbidden property", "data": {"bar": 2}, "valid": false}
+	]},
+	{"description": "required", "schema": {"properties": {"foo": {}, "bar": {}}, "required": ["foo"]}, "tests": [
+		{"description": "present", "data": {"foo": 1}, "valid": true},
+		{"description": "missing", "data": {"bar": 1}, "valid": false},
+		{"description": "array", "data": [], "valid": true},
+		{"description": "string", "data": "", "valid": true}
+	]},
+	{"description": "additionalProperties false", "schema": {"properties": {"foo": {}, "bar": {}}, "additionalProperties": false}, "tests": [
+		{"description": "no additional properties", "data": {"foo": 1}, "valid": true},
+		{"description": "additional property", "data": {"foo": 1, "bar": 2, "quux": "boom"}, "valid": false},
+		{"description": "array", "data": [1, 2, 3], "valid": true},
+		{"description": "string", "data": "foobarbaz", "valid": true}
+	]},
+	{"description": "additionalProperties schema", "schema": {"properties": {"foo": {}}, "additionalProperties": {"type": "boolean"}}, "tests": [
+		{"description": "valid additional property", "data": {"foo": 1, "quux": true}, "valid": true},
+		{"description": "invalid additional property", "data": {"foo": 1, "quux": 12}, "valid": false}
+	]},
+	{"description": "additionalProperties without properties", "schema": {"additionalProperties": {"type": "boolean"}}, "tests": [
+		{"description": "valid property", "data": {"foo": true}, "valid": true},
+		{"description": "invalid property", "data": {"foo": 1}, "valid": false}
+	]},
+	{"description": "items", "schema": {"items": {"type": "integer"}}, "tests": [
+		{"description": "valid items", "data": [1, 2, 3], "valid": true},
+		{"description": "invalid item", "data": [1, "x"], "valid": false},
+		{"description": "object", "data": {"foo": "bar"}, "valid": true}
+	]},
+	{"description": "items false", "schema": {"items": false}, "tests": [
+		{"description": "empty array", "data": [], "valid": true},
+		{"description": "any item", "data": [1], "valid": false}
+	]},
+	{"description": "nested items", "schema": {"items": {"items": {"type": "number"}}}, "tests": [
+		{"description": "valid nested array", "data": [[1], [2, 3]], "valid": true},
+		{"description": "invalid nested item", "data": [[1], ["2"]], "valid": false}
+	]},
+	{"description": "minimum", "schema": {"minimum": 1.1}, "tests": [
+		{"description": "above", "data": 2.6, "valid": true},
+		{"description": "boundary", "data": 1.1, "valid": true},
+		{"description": "below", "data": 0.6, "valid": false},
+		{"description": "string", "data": "x", "valid": true}
+	]},
+	{"description": "negative minimum", "schema": {"minimum": -2}, "tests": [
+		{"description": "above", "data": -1, "valid": true},
+		{"description": "boundary float", "data": -2.0, "valid": true},
+		{"description": "below", "data": -2.0001, "valid": false}
+	]},
+	{"description": "maximum", "schema": {"maximum": 3.0}, "tests": [
+		{"description": "below", "data": 2.6, "valid": true},
+		{"description": "boundary", "data": 3, "valid": true},
+		{"description": "above", "data": 3.5, "valid": false},
+		{"description": "string", "data": "x", "valid": true}
+	]},
+	{"description": "exclusiveMinimum", "schema": {"exclusiveMinimum": 1.1}, "tests": [
+		{"description": "above", "data": 1.2, "valid": true},
+		{"description": "boundary", "data": 1.1, "valid": false},
+		{"description": "below", "data": 0.6, "valid": false}
+	]},
+	{"description": "exclusiveMaximum", "schema": {"exclusiveMaximum": 3.0}, "tests": [
+		{"description": "below", "data": 2.2, "valid": true},
+		{"description": "boundary", "data": 3, "valid": false},
+		{"description": "above", "data": 3.5, "valid": false}
+	]},
+	{"description": "exact decimal bounds", "schema": {"exclusiveMaximum": 0.3, "minimum": 18446744073709551615e-20}, "tests": [
+		{"description": "in range", "data": 0.2, "valid": true},
+		{"description": "above by 1e-30", "data": 0.300000000000000000000000000001, "valid": false},
+		{"description": "below by 1e-20", "data": 0.18446744073709551614, "valid": false},
+		{"description": "below by 1e-40", "data": 0.1844674407370955161499999999999999999999, "valid": false}
+	]},
+	{"description": "minLength", "schema": {"minLength": 2}, "tests": [
+		{"description": "longer", "data": "foo", "valid": true},
+		{"description": "exact", "data": "fo", "valid": true},
+		{"description": "shorter", "data": "f", "valid": false},
+		{"description": "number", "data": 1, "valid": true},
+		{"description": "single code point of two UTF-16 units", "data": "\uD83D\uDCA9", "valid": false}
+	]},
+	{"description": "minLength with decimal", "schema": {"minLength": 2.0}, "tests": [
+		{"description": "longer", "data": "foo", "valid": true},
+		{"description": "shorter", "data": "f", "valid": false}
+	]},
+	{"description": "maxLength", "schema": {"maxLength": 2}, "tests": [
+		{"description": "shorter", "data": "f", "valid": true},
+		{"description": "exact", "data": "fo", "valid": true},
+		{"description": "longer", "data": "foo", "valid": false},
+		{"description": "number", "data": 100, "valid": true},
+		{"description": "two code points of two UTF-16 units", "data": "\uD83D\uDCA9\uD83D\uDCA9", "valid": true}
+	]},
+	{"description": "pattern", "schema": {"pattern": "^a*$"}, "tests": [
+		{"description": "matching", "data": "aaa", "valid": true},
+		{"description": "not matching", "data": "abc", "valid": false},
+		{"description": "boolean", "data": true, "valid": true},
+		{"description": "null", "data": null, "valid": true}
+	]},
+	{"description": "pattern is not anchored", "schema": {"pattern": "a+"}, "tests": [
+		{"description": "matching substring", "data": "xxaayy", "valid": true}
+	]},
+	{"description": "minItems", "schema": {"minItems": 1}, "tests": [
+		{"description": "longer", "data": [1, 2], "valid": true},
+		{"description": "exact", "data": [1], "valid": true},
+		{"description": "shorter", "data": [], "valid": false},
+		{"description": "string", "data": "", "valid": true}
+	]},
+	{"description": "maxItems", "schema": {"maxItems": 2}, "tests": [
+		{"description": "shorter", "data": [1], "valid": true},
+		{"description": "exact", "data": [1, 2], "valid": true},
+		{"description": "longer", "data": [1, 2, 3], "valid": false},
+		{"description": "string", "data": "foobar", "valid": true}
+	]},
+	{"description": "allOf", "schema": {"allOf": [
+		{"properties": {"bar": {"type": "integer"}}, "required": ["bar"]},
+		{"properties": {"foo": {"type": "string"}}, "required": ["foo"]}
+	]}, "tests": [
+		{"description": "both match", "data": {"foo": "baz", "bar": 2}, "valid": true},
+		{"description": "mismatch second", "data": {"foo": "baz"}, "valid": false},
+		{"description": "mismatch first", "data": {"bar": 2}, "valid": false},
+		{"description": "wrong type", "data": {"foo": "baz", "bar": "quux"}, "valid": false}
+	]},
+	{"description": "allOf with boolean schemas", "schema": {"allOf": [true, false]}, "tests": [
+		{"description": "any value", "data": "foo", "valid": false}
+	]},
+	{"description": "anyOf", "schema": {"anyOf": [{"type": "integer"}, {"minimum": 2}]}, "tests": [
+		{"description": "first matches", "data": 1, "valid": true},
+		{"description": "second matches", "data": 2.5, "valid": true},
+		{"description": "both match", "data": 3, "valid": true},
+		{"description": "neither matches", "data": 1.5, "valid": false}
+	]},
+	{"description": "anyOf with boolean schemas", "schema": {"anyOf": [false, false]}, "tests": [
+		{"description": "any value", "data": "foo", "valid": false}
+	]},
+	{"description": "oneOf", "schema": {"oneOf": [{"type": "integer"}, {"minimum": 2}]}, "tests": [
+		{"description": "first matches", "data": 1, "valid": true},
+		{"description": "second matches", "data": 2.5, "valid": true},
+		{"description": "both match", "data": 3, "valid": false},
+		{"description": "neither matches", "data": 1.5, "valid": false}
+	]},
+	{"description": "oneOf with boolean schemas", "schema": {"oneOf": [true, false, false]}, "tests": [
+		{"description": "any value", "data": "foo", "valid": true}
+	]},
+	{"description": "not", "schema": {"not": {"type": "integer"}}, "tests": [
+		{"description": "allowed", "data": "foo", "valid": true},
+		{"description": "disallowed", "data": 1, "valid": false}
+	]},
+	{"description": "not false", "schema": {"not": false}, "tests": [
+		{"description": "any value", "data": "foo", "valid": true}
+	]},
+	{"description": "true schema", "schema": true, "tests": [
+		{"description": "number", "data": 1, "valid": true},
+		{"description": "object", "data": {"foo": "bar"}, "valid": true}
+	]},
+	{"description": "false schema", "schema": false, "tests": [
+		{"description": "number", "data": 1, "valid": false},
+		{"description": "null", "data": null, "valid": false}
+	]},
+	{"description": "annotations and unknown keywords", "schema": {
+		"$schema": "https://json-schema.org/draft/2020-12/schema", "$id": "https://example.com/entity",
+		"title": "Entity", "description": "Entity", "default": 1, "examples": [1], "format": "email",
+		"$defs": {"name": {"type": "string"}}, "readOnly": true, "x-custom": 1
+	}, "tests": [
+		{"description": "format is not asserted", "data": "not an email", "valid": true}
+	]}
+]`
+
+type schemaTestGroup struct {
+	Description string          `json:"description"`
+	Schema      json.RawMessage `json:"schema"`
+	Tests       []struct {
+		Description string          `json:"description"`
+		Data        json.RawMessage `json:"data"`
+		Valid       bool            `json:"valid"`
+	} `json:"tests"`
+}
+
+func TestJSONSchema_Conformance(t *testing.T) {
+	var groups []schemaTestGroup
+	checkErr(json.Unmarshal([]byte(schemaConformance), &groups))
+	for _, group := range groups {
+		schema, err := main.ParseJSONSchema(group.Schema)
+		if err != nil {
+			t.Errorf("%s: %v", group.Description, err)
+			continue
+		}
+		for _, c := range group.Tests {
+			var value interface{}
+			decoder := json.NewDecoder(bytes.NewReader(c.Data))
+			decoder.UseNumber()
+			checkErr(decoder.Decode(&value))
+			if violations := schema.Validate(value); (len(violations) == 0) != c.Valid {
+				t.Errorf("%s, %s: expected valid=%v, got violations %v", group.Description, c.Description, c.Valid, violations)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchResult is entity found by full-text search
+type SearchResult struct {
+	Entity
+	Rank float64 `json:"rank"`
+}
+
+// tokenize splits text to lowercase words, the same way PostgreSQL `simple` configuration does for plain words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Limits of PostgreSQL tsvector: positions greater than maxWordPosition are stored as maxWordPosition,
+// only first maxWordPositions positions of every word are kept
+const (
+	maxWordPosition  = 16383
+	maxWordPositions = 256
+)
+
+// rankWeight is weight of word positions in tsvector without explicit weights (weight D of ts_rank)
+const rankWeight = 0.1
+
+// invertedIndex maps words to entities containing them
+type invertedIndex struct {
+	postings map[string]map[string][]int // word -> uuid -> positions of the word, starting from 1
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{postings: make(map[string]map[string][]int)}
+}
+
+func (idx *invertedIndex) add(e *Entity) {
+	for i, word := range tokenize(e.Data) {
+		entities, ok := idx.postings[word]
+		if !ok {
+			entities = make(map[string][]int)
+			idx.postings[word] = entities
+		}
+		position := i + 1
+		if position > maxWordPosition {
+			position = maxWordPosition
+		}
+		positions := entities[e.Uuid]
+		if len(positions) < maxWordPositions && (len(positions) == 0 || positions[len(positions)-1] != position) {
+			entities[e.Uuid] = append(positions, position)
+		}
+	}
+}
+
+func (idx *invertedIndex) remove(e *Entity) {
+	for _, word := range tokenize(e.Data) {
+		entities := idx.postings[word]
+		delete(entities, e.Uuid)
+		if len(entities) == 0 {
+			delete(idx.postings, word)
+		}
+	}
+}
+
+// wordDistanceWeight is weight of word pair depending on distance between words, as in ts_rank
+func wordDistanceWeight(distance int) float64 {
+	if distance > 100 {
+		return 1e-30
+	}
+	return 1.0 / (1.005 + 0.05*math.Exp(float64(distance)/1.5-2))
+}
+
+// rankOccurrences ranks entity by occurrences of query words like ts_rank does for single word queries:
+// every next occurrence of the word adds less to the rank
+func rankOccurrences(positions [][]int) float64 {
+	rank := 0.0
+	for _, wordPositions := range positions {
+		sum := 0.0
+		for j := range wordPositions {
+			sum += rankWeight / float64((j+1)*(j+1))
+		}
+		rank += sum / (math.Pi * math.Pi / 6)
+	}
+	return rank / float64(len(positions))
+}
+
+// rankProximity ranks entity by distances between query words like ts_rank does for queries of several words
+func rankProximity(positions [][]int) float64 {
+	rank := -1.0
+	for i := range positions {
+		for k := 0; k < i; k++ {
+			for _, p := range positions[i] {
+				for _, q := range positions[k] {
+					distance := p - q
+					if distance < 0 {
+						distance = -distance
+					}
+					if distance == 0 {
+						continue
+					}
+					weight := math.Sqrt(rankWeight * rankWeight * wordDistanceWeight(distance))
+					if rank < 0 {
+						rank = weight
+					} else {
+						rank = 1 - (1-rank)*(1-weight)
+					}
+				}
+			}
+		}
+	}
+	if rank < 0 {
+		rank = 1e-20
+	}
+	return rank
+}
+
+// search finds entities containing all words of the query
+//
+// Entities are ranked with the same formulas as PostgreSQL `ts_rank` without normalization,
+// so both backends return results in the same order
+func (idx *invertedIndex) search(query string, count int) []SearchResult {
+	words := uniqueWords(tokenize(query))
+	if len(words) == 0 {
+		return []SearchResult{}
+	}
+	var matching map[string][][]int // uuid -> positions of every query word
+	for _, word := range words {
+		entities := idx.postings[word]
+		next := make(map[string][][]int, len(entities))
+		for id, positions := range entities {
+			if found, ok := matching[id]; ok || matching == nil {
+				next[id] = append(found, positions)
+			}
+		}
+		matching = next
+	}
+
+	results := make([]SearchResult, 0, len(matching))
+	for id, positions := range matching {
+		rank := rankOccurrences(positions)
+		if len(words) > 1 {
+			rank = rankProximity(positions)
+		}
+		// PostgreSQL computes rank as real
+		results = append(results, SearchResult{Entity: Entity{Uuid: id}, Rank: float64(float32(rank))})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank == results[j].Rank {
+			return results[i].Uuid < results[j].Uuid
+		}
+		return results[i].Rank > results[j].Rank
+	})
+	if len(results) > count {
+		results = results[:count]
+	}
+	return results
+}
+
+// uniqueWords removes repeated words keeping order of the first occurrences
+func uniqueWords(words []string) []string {
+	seen := make(map[string]bool, len(words))
+	unique := words[:0]
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			unique = append(unique, word)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// States of initial data loading
+const (
+	SeedingDisabled = "disabled" // no initial data is configured
+	SeedingPending  = "pending"  // waiting for storage
+	SeedingRunning  = "running"
+	SeedingDone     = "done"
+	SeedingFailed   = "failed"
+)
+
+// SeedingStatus is progress of initial data loading
+type SeedingStatus struct {
+	State     string  `json:"state"`
+	Total     int     `json:"total"`
+	Generated int64   `json:"generated"`
+	Inserted  int64   `json:"inserted"`
+	Seed      int64   `json:"seed,omitempty"`
+	Elapsed   float64 `json:"elapsed_seconds"`
+	ETA       float64 `json:"eta_seconds,omitempty"` // estimated by insert rate
+	Error     string  `json:"error,omitempty"`
+}
+
+// seedProgress tracks initial data loading, nil tracker means loading is disabled
+type seedProgress struct {
+	mu        sync.Mutex
+	status    SeedingStatus
+	wait      bool // readiness waits for loading
+	started   time.Time
+	finished  time.Time
+	generator *DataGenerator
+}
+
+func newSeedProgress(initial *InitialData) *seedProgress {
+	if initial == nil {
+		return nil
+	}
+	return &seedProgress{
+		status: SeedingStatus{State: SeedingPending, Total: initial.Count},
+		wait:   initial.WaitForSeeding,
+	}
+}
+
+func (p *seedProgress) start(generator *DataGenerator) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.State = SeedingRunning
+	p.status.Seed = generator.Seed()
+	p.generator = generator
+	p.started = time.Now()
+}
+
+func (p *seedProgress) insert(count int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Inserted += int64(count)
+}
+
+func (p *seedProgress) finish(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.State = SeedingDone
+	if err != nil {
+		p.status.State = SeedingFailed
+		p.status.Error = err.Error()
+	}
+	p.finished = time.Now()
+	if p.started.IsZero() {
+		p.started = p.finished
+	}
+}
+
+// ready reports false while readiness waits for loading
+func (p *seedProgress) ready() bool {
+	if p == nil || !p.wait {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status.State == SeedingDone
+}
+
+// Status returns current progress of initial data loading
+func (p *seedProgress) Status() SeedingStatus {
+	if p == nil {
+		return SeedingStatus{State: SeedingDisabled}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	if p.generator != nil {
+		status.Generated = p.generator.Generated()
+	}
+	if p.started.IsZero() {
+		return status
+	}
+	end := p.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(p.started)
+	status.Elapsed = elapsed.Seconds()
+	if status.State == SeedingRunning && status.Inserted > 0 {
+		remaining := int64(status.Total) - status.Inserted
+		status.ETA = (elapsed * time.Duration(remaining) / time.Duration(status.Inserted)).Seconds()
+	}
+	return status
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+)
+
+// OpenDB opens pool of connections created by the connector, queries executed with request context
+// are prefixed with comment containing request ID and traced with client spans
+func OpenDB(connector driver.Connector) *sql.DB {
+	return sql.OpenDB(instrumentedConnector{connector})
+}
+
+// instrumentedConnector wraps connector of PostgreSQL driver, tagging and tracing queries
+type instrumentedConnector struct {
+	driver.Connector
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn}, nil
+}
+
+// instrumentedConn is connection of instrumentedConnector, optional interfaces are passed to wrapped connection
+type instrumentedConn struct {
+	driver.Conn
+}
+
+// isCopy checks if query is `COPY` statement, which is recognized by the driver by its prefix
+func isCopy(query string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "COPY")
+}
+
+// tagQuery prepends request ID comment to query, `COPY` statements are left as is
+func tagQuery(ctx context.Context, query string) string {
+	comment := queryComment(ctx)
+	if comment == "" || isCopy(query) {
+		return query
+	}
+	return comment + query
+}
+
+// startQuerySpan starts client span of SQL statement, spans are started only inside existing traces,
+// so background work like initial data loading is not traced
+func startQuerySpan(ctx context.Context, operation, query string) *Span {
+	if _, ok := spanContextFrom(ctx); !ok {
+		return nil
+	}
+	if operation == "" {
+		operation = strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	}
+	_, span := startSpan(ctx, operation, spanKindClient)
+	span.SetAttributes("db.system", "postgresql", "db.operation", operation)
+	if query != "" {
+		span.SetAttributes("db.statement", strings.Join(strings.Fields(query), " "))
+	}
+	return span
+}
+
+// endQuerySpan ends span, errors are recorded except for `driver.ErrSkip`, with which span is dropped
+func endQuerySpan(span *Span, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	if err != nil && err != io.EOF && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	span := startQuerySpan(ctx, "PREPARE", query)
+	defer func() { endQuerySpan(span, err) }()
+	tagged := tagQuery(ctx, query)
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, tagged)
+	} else {
+		stmt, err = c.Conn.Prepare(tagged)
+	}
+	if err != nil || isCopy(query) {
+		return stmt, err
+	}
+	return &instrumentedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuerySpan(ctx, "", query)
+	rows, err := queryer.QueryContext(ctx, tagQuery(ctx, query), args)
+	if err != nil {
+		endQuerySpan(span, err)
+		return nil, err
+	}
+	return tracedRows(rows, span), nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuerySpan(ctx, "", query)
+	result, err := execer.ExecContext(ctx, tagQuery(ctx, query), args)
+	endQuerySpan(span, err)
+	return result, err
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (tx driver.Tx, err error) {
+	span := startQuerySpan(ctx, "BEGIN", "")
+	defer func() { endQuerySpan(span, err) }()
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{Tx: tx, ctx: ctx}, nil
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// instrumentedTx traces end of transaction, it keeps context transaction was started with
+type instrumentedTx struct {
+	driver.Tx
+	ctx context.Context
+}
+
+func (tx *instrumentedTx) Commit() (err error) {
+	span := startQuerySpan(tx.ctx, "COMMIT", "")
+	defer func() { endQuerySpan(span, err) }()
+	return tx.Tx.Commit()
+}
+
+func (tx *instrumentedTx) Rollback() (err error) {
+	span := startQuerySpan(tx.ctx, "ROLLBACK", "")
+	defer func() { endQuerySpan(span, err) }()
+	return tx.Tx.Rollback()
+}
+
+// instrumentedStmt traces executions of prepared statement
+type instrumentedStmt struct {
+	driver.Stmt
+	query string
+}
+
+// values converts arguments for drivers without context support, which don't accept named arguments
+func values(args []driver.NamedValue) ([]driver.Value, error) {
+	converted := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("driver does not support the use of named parameters")
+		}
+		converted[i] = arg.Value
+	}
+	return converted, nil
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (result driver.Result, err error) {
+	span := startQuerySpan(ctx, "", s.query)
+	defer func() { endQuerySpan(span, err) }()
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	converted, err := values(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(converted)
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	span := startQuerySpan(ctx, "", s.query)
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var converted []driver.Value
+		if converted, err = values(args); err == nil {
+			rows, err = s.Stmt.Query(converted)
+		}
+	}
+	if err != nil {
+		endQuerySpan(span, err)
+		return nil, err
+	}
+	return tracedRows(rows, span), nil
+}
+
+// spanRows ends span of query when its rows are closed, so span includes reading of results.
+// Column types reported by the driver are not available for rows of traced queries
+type spanRows struct {
+	driver.Rows
+	span *Span
+	err  error
+}
+
+func tracedRows(rows driver.Rows, span *Span) driver.Rows {
+	if span == nil {
+		return rows
+	}
+	return &spanRows{Rows: rows, span: span}
+}
+
+func (r *spanRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *spanRows) Close() error {
+	err := r.Rows.Close()
+	if r.err == nil {
+		r.err = err
+	}
+	endQuerySpan(r.span, r.err)
+	return err
+}
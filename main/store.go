@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// EntityStore is a storage backend for entities
+//
+// All methods return sql.ErrNoRows if the requested entity does not exist.
+// Update, Modify and Delete with non-zero `ifVersion` return ErrVersionMismatch if entity version differs
+type EntityStore interface {
+	// Get fills entity with e.Uuid
+	Get(ctx context.Context, e *Entity) error
+	// List returns page of entities matching the filter
+	List(ctx context.Context, opts ListOptions) (*EntityPage, error)
+	// Search returns up to `count` entities containing all words of the query, most relevant first
+	Search(ctx context.Context, query string, count int) ([]SearchResult, error)
+	// Create stores new entity with version 1
+	Create(ctx context.Context, e *Entity) error
+	// Update replaces data of existing entity, setting e.Version to the new version
+	Update(ctx context.Context, e *Entity, ifVersion int64) error
+	// Modify atomically changes existing entity with `mutate`, filling `e` with the changed entity.
+	// Error returned by `mutate` cancels the change
+	Modify(ctx context.Context, e *Entity, ifVersion int64, mutate func(e *Entity) error) error
+	// Delete removes existing entity
+	Delete(ctx context.Context, e *Entity, ifVersion int64) error
+	// AddEntities loads new entities in chunks, setting their versions. Chunks stored before failure are kept.
+	// Already stored entities are left unchanged, so the same data can be loaded again, e.g. on restart
+	AddEntities(ctx context.Context, entities []Entity, opts LoadOptions) error
+	// BulkCreate stores entities setting their versions, result contains error of every entity
+	BulkCreate(ctx context.Context, entities []Entity, opts BulkOptions) ([]error, error)
+	// BulkDelete removes entities by uuid, result contains error of every uuid
+	BulkDelete(ctx context.Context, uuids []string, opts BulkOptions) ([]error, error)
+	// DeleteMatching removes all entities matching the filter, returning count of removed entities
+	DeleteMatching(ctx context.Context, filter EntityFilter) (int64, error)
+}
+
+// DefaultLoadChunkSize is count of entities stored at once by AddEntities if chunk size is not set
+const DefaultLoadChunkSize = 1000
+
+// LoadOptions controls loading of entities by AddEntities
+type LoadOptions struct {
+	ChunkSize int                     // count of entities stored in single transaction
+	Progress  func(loaded, total int) // called after every stored chunk
+}
+
+// forEachChunk calls `add` for consecutive chunks of `count` entities, reporting progress after each of them
+func (o LoadOptions) forEachChunk(count int, add func(start, end int) error) error {
+	size := o.ChunkSize
+	if size <= 0 {
+		size = DefaultLoadChunkSize
+	}
+	for start := 0; start < count; start += size {
+		end := start + size
+		if end > count {
+			end = count
+		}
+		if err := add(start, end); err != nil {
+			return fmt.Errorf("unable to add entities %d-%d: %w", start, end-1, err)
+		}
+		if o.Progress != nil {
+			o.Progress(end, count)
+		}
+	}
+	return nil
+}
+
+// BulkOptions controls bulk operations
+type BulkOptions struct {
+	Atomic bool // nothing is changed if any item fails
+	Upsert bool // existing entities are replaced by BulkCreate instead of failing with ErrEntityExists
+}
+
+// NewEntityStore creates storage backend according to configuration
+func NewEntityStore(config *Configuration) (EntityStore, error) {
+	switch config.StorageBackend() {
+	case BackendMemory:
+		if config.Memory != nil {
+			switch config.Memory.Eviction {
+			case "", EvictionLRU, EvictionFIFO, EvictionNone:
+			default:
+				return nil, fmt.Errorf("invalid eviction policy: %s", config.Memory.Eviction)
+			}
+		}
+		return NewFakeStore(config.Memory), nil
+	case BackendFile:
+		if config.Storage.File == nil || config.Storage.File.Path == "" {
+			return nil, fmt.Errorf("file storage is selected, but no file path is given")
+		}
+		return NewFileStore(config.Storage.File)
+	case BackendPostgres:
+		if config.Postgres == nil {
+			return nil, fmt.Errorf("no postgres configuration is given, but debug mode is disabled")
+		}
+		return ConnectPostgresStore(config.Postgres)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.StorageBackend())
+	}
+}
+
+// ErrVersionMismatch is returned when conditional change is requested for different entity version
+var ErrVersionMismatch = errors.New("entity version mismatch")
+
+var (
+	// ErrEntityExists is returned by BulkCreate without upsert for already stored entities
+	ErrEntityExists = errors.New("entity already exists")
+	// ErrBulkAborted is returned for items of atomic bulk operation which is cancelled because of other items
+	ErrBulkAborted = errors.New("bulk operation is aborted because of other item failure")
+)
+
+// abortBulk checks if any item of bulk operation failed, marking all other items as aborted
+func abortBulk(errs []error) bool {
+	failed := false
+	for _, err := range errs {
+		if err != nil {
+			failed = true
+			break
+		}
+	}
+	if failed {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = ErrBulkAborted
+			}
+		}
+	}
+	return failed
+}
+
+// ErrStoreUnavailable is returned by DeferredStore until storage is connected
+var ErrStoreUnavailable = errors.New("storage is not available yet")
+
+// DeferredStore is EntityStore which is usable only after underlying storage is connected
+type DeferredStore struct {
+	mu    sync.RWMutex
+	store EntityStore
+}
+
+// Set makes storage usable
+func (d *DeferredStore) Set(store EntityStore) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.store = store
+}
+
+// Ready checks if underlying storage is connected
+func (d *DeferredStore) Ready() bool {
+	_, err := d.get()
+	return err == nil
+}
+
+func (d *DeferredStore) get() (EntityStore, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.store == nil {
+		return nil, ErrStoreUnavailable
+	}
+	return d.store, nil
+}
+
+// Close closes underlying storage if it's already connected
+func (d *DeferredStore) Close() error {
+	store, err := d.get()
+	if err != nil {
+		return nil
+	}
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (d *DeferredStore) Get(ctx context.Context, e *Entity) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	return store.Get(ctx, e)
+}
+
+func (d *DeferredStore) List(ctx context.Context, opts ListOptions) (*EntityPage, error) {
+	store, err := d.get()
+	if err != nil {
+		return nil, err
+	}
+	return store.List(ctx, opts)
+}
+
+func (d *DeferredStore) Search(ctx context.Context, query string, count int) ([]SearchResult, error) {
+	store, err := d.get()
+	if err != nil {
+		return nil, err
+	}
+	return store.Search(ctx, query, count)
+}
+
+func (d *DeferredStore) Create(ctx context.Context, e *Entity) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	return store.Create(ctx, e)
+}
+
+func (d *DeferredStore) Update(ctx context.Context, e *Entity, ifVersion int64) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	return store.Update(ctx, e, ifVersion)
+}
+
+func (d *DeferredStore) Modify(ctx context.Context, e *Entity, ifVersion int64, mutate func(e *Entity) error) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	return store.Modify(ctx, e, ifVersion, mutate)
+}
+
+func (d *DeferredStore) Delete(ctx context.Context, e *Entity, ifVersion int64) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, e, ifVersion)
+}
+
+func (d *DeferredStore) AddEntities(ctx context.Context, entities []Entity, opts LoadOptions) error {
+	store, err := d.get()
+	if err != nil {
+		return err
+	}
+	return store.AddEntities(ctx, entities, opts)
+}
+
+func (d *DeferredStore) BulkCreate(ctx context.Context, entities []Entity, opts BulkOptions) ([]error, error) {
+	store, err := d.get()
+	if err != nil {
+		return nil, err
+	}
+	return store.BulkCreate(ctx, entities, opts)
+}
+
+func (d *DeferredStore) BulkDelete(ctx context.Context, uuids []string, opts BulkOptions) ([]error, error) {
+	store, err := d.get()
+	if err != nil {
+		return nil, err
+	}
+	return store.BulkDelete(ctx, uuids, opts)
+}
+
+func (d *DeferredStore) DeleteMatching(ctx context.Context, filter EntityFilter) (int64, error) {
+	store, err := d.get()
+	if err != nil {
+		return 0, err
+	}
+	return store.DeleteMatching(ctx, filter)
+}
+
+func (d *DeferredStore) collections() (CollectionStore, error) {
+	store, err := d.get()
+	if err != nil {
+		return nil, err
+	}
+	collections, ok := store.(CollectionStore)
+	if !ok {
+		return nil, ErrCollectionsUnsupported
+	}
+	return collections, nil
+}
+
+func (d *DeferredStore) Collection(ctx context.Context, name string) (EntityStore, error) {
+	collections, err := d.collections()
+	if err != nil {
+		return nil, err
+	}
+	return collections.Collection(ctx, name)
+}
+
+func (d *DeferredStore) Collections(ctx context.Context) ([]string, error) {
+	collections, err := d.collections()
+	if err != nil {
+		return nil, err
+	}
+	return collections.Collections(ctx)
+}
+
+func (d *DeferredStore) CreateCollection(ctx context.Context, name string) error {
+	collections, err := d.collections()
+	if err != nil {
+		return err
+	}
+	return collections.CreateCollection(ctx, name)
+}
+
+func (d *DeferredStore) DropCollection(ctx context.Context, name string) error {
+	collections, err := d.collections()
+	if err != nil {
+		return err
+	}
+	return collections.DropCollection(ctx, name)
+}
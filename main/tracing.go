@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeaderTraceparent carries trace context as defined by W3C Trace Context
+const HeaderTraceparent = "traceparent"
+
+// Trace exporters
+const (
+	TraceExporterOTLP   = "otlp"   // OTLP/HTTP with JSON encoding
+	TraceExporterStdout = "stdout" // OTLP JSON lines written to stdout
+	TraceExporterFile   = "file"   // OTLP JSON lines appended to file
+)
+
+const (
+	defaultTraceEndpoint      = "http://localhost:4318/v1/traces"
+	defaultTraceFlushInterval = 5 * time.Second
+	traceExportTimeout        = 10 * time.Second
+	maxExportBatch            = 512
+	maxQueuedSpans            = 4096
+)
+
+// Span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const spanStatusError = 2
+
+// SpanContext identifies span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// parseTraceparent parses `traceparent` header value, values of unknown future versions are accepted
+// if their beginning has format of version 00
+func parseTraceparent(value string) (sc SpanContext, ok bool) {
+	if len(value) < 55 || (len(value) > 55 && (value[:2] == "00" || value[55] != '-')) {
+		return sc, false
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' || value[:2] == "ff" {
+		return sc, false
+	}
+	version, err1 := hex.DecodeString(value[:2])
+	_, err2 := hex.Decode(sc.TraceID[:], []byte(value[3:35]))
+	_, err3 := hex.Decode(sc.SpanID[:], []byte(value[36:52]))
+	flags, err4 := hex.DecodeString(value[53:55])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(version) != 1 {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+type spanContextKey struct{}
+
+// spanContextFrom returns context of current span, which may be span of remote parent
+func spanContextFrom(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Span is timed operation of a trace, methods of nil span do nothing
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []interface{}
+	err        string
+}
+
+// SetAttributes adds key-value pairs to the span
+func (s *Span) SetAttributes(keyvals ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, keyvals...)
+}
+
+// RecordError sets error status of the span
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span, sampled span is queued for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if !ended && s.context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// spanExporter sends batch of spans encoded as OTLP JSON
+type spanExporter interface {
+	export(ctx context.Context, payload []byte) error
+	close() error
+}
+
+// otlpExporter posts spans to OTLP/HTTP endpoint
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error {
+	return nil
+}
+
+// writerExporter writes every batch of spans as a line of OTLP JSON
+type writerExporter struct {
+	out    io.Writer
+	closer io.Closer
+}
+
+func (e *writerExporter) export(_ context.Context, payload []byte) error {
+	_, err := e.out.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *writerExporter) close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// Tracer creates spans and exports them in batches in background
+type Tracer struct {
+	exporter    spanExporter
+	service     string
+	sampleRatio float64
+	interval    time.Duration
+
+	queue   chan *Span
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	tracerMu sync.RWMutex
+	tracer   *Tracer
+)
+
+func currentTracer() *Tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return tracer
+}
+
+// SetupTracing starts export of traces, tracing is disabled if configuration is missing
+//
+// Previously configured tracer is shut down
+func SetupTracing(config *TracingConfig) error {
+	var next *Tracer
+	if config != nil && config.Exporter != "" {
+		sampleRatio := 1.0
+		if config.SampleRatio != nil {
+			sampleRatio = *config.SampleRatio
+			if sampleRatio < 0 || sampleRatio > 1 {
+				return fmt.Errorf("invalid sample ratio %v, it must be from 0 to 1", sampleRatio)
+			}
+		}
+		exporter, err := newSpanExporter(config)
+		if err != nil {
+			return err
+		}
+		next = &Tracer{
+			exporter:    exporter,
+			service:     config.ServiceName,
+			sampleRatio: sampleRatio,
+			interval:    config.FlushInterval,
+			queue:       make(chan *Span, maxQueuedSpans),
+			done:        make(chan struct{}),
+			stopped:     make(chan struct{}),
+		}
+		if next.service == "" {
+			next.service = applicationName
+		}
+		if next.interval <= 0 {
+			next.interval = defaultTraceFlushInterval
+		}
+		go next.run()
+	}
+	tracerMu.Lock()
+	previous := tracer
+	tracer = next
+	tracerMu.Unlock()
+	previous.shutdown()
+	return nil
+}
+
+// ShutdownTracing exports pending spans and stops tracing
+func ShutdownTracing() {
+	_ = SetupTracing(nil)
+}
+
+func newSpanExporter(config *TracingConfig) (spanExporter, error) {
+	switch config.Exporter {
+	case TraceExporterOTLP:
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = defaultTraceEndpoint
+		}
+		return &otlpExporter{
+			endpoint: endpoint,
+			headers:  config.Headers,
+			client:   &http.Client{Timeout: traceExportTimeout},
+		}, nil
+	case TraceExporterStdout:
+		return &writerExporter{out: os.Stdout}, nil
+	case TraceExporterFile:
+		if config.Path == "" {
+			return nil, errors.New("path is required by file trace exporter")
+		}
+		file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, err
+		}
+		return &writerExporter{out: file, closer: file}, nil
+	default:
+		return nil, fmt.Errorf("invalid trace exporter: %s", config.Exporter)
+	}
+}
+
+// StartSpan starts internal span, which is child of the span of given context
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpan(ctx, name, spanKindInternal)
+}
+
+// startSpan starts span of given kind, span is nil if tracing is disabled
+//
+// Span without parent starts new trace, which is sampled according to configured ratio
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent, ok := spanContextFrom(ctx); ok {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.context.TraceID[:])
+		span.context.Sampled = t.sampleRatio >= 1 || mathrand.Float64() < t.sampleRatio
+	}
+	_, _ = rand.Read(span.context.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span.context), span
+}
+
+// enqueue adds ended span to export queue, span is dropped if the queue is full
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	export := func() {
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > maxExportBatch {
+				n = maxExportBatch
+			}
+			t.export(batch[:n])
+			batch = batch[n:]
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= maxExportBatch {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-t.done:
+			batch = append(batch, t.drain()...)
+			export()
+			return
+		}
+	}
+}
+
+// drain returns all queued spans
+func (t *Tracer) drain() []*Span {
+	var spans []*Span
+	for {
+		select {
+		case s := <-t.queue:
+			spans = append(spans, s)
+		default:
+			return spans
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) {
+	payload, err := json.Marshal(t.otlpRequest(spans))
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+		err = t.exporter.export(ctx, payload)
+		cancel()
+	}
+	if err != nil {
+		logger.Warn("Trace export failed", "spans", len(spans), "error", err)
+	}
+}
+
+func (t *Tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	<-t.stopped
+	if err := t.exporter.close(); err != nil {
+		logger.Warn("Can't close trace exporter", "error", err)
+	}
+}
+
+// otlpRequest builds OTLP/JSON `ExportTraceServiceRequest` of the spans
+func (t *Tracer) otlpRequest(spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.otlp()
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]interface{}{"service.name", t.service, "service.version", version}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": applicationName, "version": version},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func (s *Span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.context.TraceID[:]),
+		"spanId":            hex.EncodeToString(s.context.SpanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parent != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		span["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err}
+	}
+	return span
+}
+
+// otlpAttributes encodes key-value pairs as OTLP attributes, 64-bit integers and non-finite doubles
+// are encoded as strings like in protobuf JSON mapping
+func otlpAttributes(keyvals []interface{}) []interface{} {
+	attributes := make([]interface{}, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		var value map[string]interface{}
+		switch v := keyvals[i+1].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+			switch {
+			case math.IsNaN(v):
+				value["doubleValue"] = "NaN"
+			case math.IsInf(v, 1):
+				value["doubleValue"] = "Infinity"
+			case math.IsInf(v, -1):
+				value["doubleValue"] = "-Infinity"
+			}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(logValue(v))}
+		}
+		attributes = append(attributes, map[string]interface{}{"key": fmt.Sprint(keyvals[i]), "value": value})
+	}
+	return attributes
+}
+
+// tracingMiddle traces requests with server spans, continuing trace of `traceparent` header
+func tracingMiddle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get(HeaderTraceparent)); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, parent)
+		}
+		route := requestRoute(r)
+		ctx, span := startSpan(ctx, r.Method+" "+route, spanKindServer)
+		if span == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttributes(
+			"http.method", r.Method,
+			"http.route", route,
+			"http.target", r.URL.RequestURI(),
+			"net.peer.addr", r.RemoteAddr,
+			"request_id", RequestID(ctx),
+		)
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes("http.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			if recorder.err == nil {
+				recorder.err = errors.New(http.StatusText(recorder.status))
+			}
+			span.RecordError(recorder.err)
+		}
+	})
+}
@@ -0,0 +1,431 @@
+package main_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentelekomcloud-infra/simple-exquisite-webserver/main"
+	"github.com/twinj/uuid"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s otlpSpan) attribute(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, value := range a.Value {
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func (r otlpRequest) spans() []otlpSpan {
+	var spans []otlpSpan
+	for _, resource := range r.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			spans = append(spans, scope.Spans...)
+		}
+	}
+	return spans
+}
+
+func TestTracing_RequestSpans(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" ||
+			r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected export request: %s %v", r.URL.Path, r.Header)
+		}
+		checkErr(json.NewDecoder(r.Body).Decode(&request))
+		mu.Lock()
+		spans = append(spans, request.spans()...)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	checkErr(main.SetupTracing(&main.TracingConfig{
+		Exporter: main.TraceExporterOTLP,
+		Endpoint: collector.URL + "/v1/traces",
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}))
+	defer main.ShutdownTracing()
+
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, _ := http.NewRequest("GET", "/entity/"+uuid.NewV4().String(), nil)
+	req.Header.Set(main.HeaderTraceparent, "00-"+traceID+"-"+parentID+"-01")
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set(main.HeaderTraceparent, "00-00000000000000000000000000000000-"+parentID+"-01")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set(main.HeaderTraceparent, "00-"+traceID+"-"+parentID+"-00")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	main.ShutdownTracing()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spans) != 2 {
+		t.Fatalf("Expected spans of 2 sampled requests, got %+v", spans)
+	}
+	entity := spans[0]
+	if entity.Name != "GET /entity/{id}" || entity.Kind != 2 || entity.TraceID != traceID || entity.ParentSpanID != parentID {
+		t.Errorf("Unexpected span of request with traceparent: %+v", entity)
+	}
+	if entity.attribute("http.status_code") != "404" || entity.attribute("http.route") != "/entity/{id}" {
+		t.Errorf("Unexpected span attributes: %+v", entity.Attributes)
+	}
+	if entity.Status != nil {
+		t.Errorf("Client error is recorded as span error")
+	}
+	root := spans[1]
+	if root.Name != "GET /" || root.TraceID == traceID || root.ParentSpanID != "" || len(root.TraceID) != 32 {
+		t.Errorf("Request with invalid traceparent doesn't start new trace: %+v", root)
+	}
+}
+
+func TestTracing_QuerySpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	checkErr(main.SetupTracing(&main.TracingConfig{Exporter: main.TraceExporterFile, Path: path}))
+	defer main.ShutdownTracing()
+
+	stub := &stubPostgres{}
+	db := main.OpenDB(stub)
+	defer db.Close()
+	store := main.NewPostgresStoreFromDB(db)
+	checkErr(store.AddEntities(ctx, main.GenerateSomeEntities(1, 10), main.LoadOptions{})) // not traced
+
+	traced, span := main.StartSpan(ctx, "load")
+	checkErr(store.AddEntities(traced, main.GenerateSomeEntities(2, 10), main.LoadOptions{}))
+	span.End()
+	main.ShutdownTracing()
+
+	file, err := os.Open(path)
+	checkErr(err)
+	defer file.Close()
+	var spans []otlpSpan
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var request otlpRequest
+		checkErr(json.Unmarshal(scanner.Bytes(), &request))
+		spans = append(spans, request.spans()...)
+	}
+	names := make([]string, len(spans))
+	for i, s := range spans {
+		names[i] = s.Name
+	}
+	expected := []string{"BEGIN", "PREPARE", "INSERT", "INSERT", "COMMIT", "load"}
+	if len(spans) != len(expected) {
+		t.Fatalf("Expected spans %v, got %v", expected, names)
+	}
+	load := spans[len(spans)-1]
+	for i, s := range spans[:len(spans)-1] {
+		if s.Name != expected[i] || s.Kind != 3 || s.TraceID != load.TraceID || s.ParentSpanID != load.SpanID {
+			t.Errorf("Unexpected query span: %+v", s)
+		}
+		if s.attribute("db.system") != "postgresql" {
+			t.Errorf("Query span has no db.system attribute: %+v", s.Attributes)
+		}
+	}
+	if statement, _ := spans[2].attribute("db.statement").(string); len(statement) < 6 || statement[:6] != "INSERT" {
+		t.Errorf("Unexpected db.statement: %s", statement)
+	}
+}
+
+func TestTracing_ZeroSampleRatio(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	ratio := 0.0
+	checkErr(main.SetupTracing(&main.TracingConfig{Exporter: main.TraceExporterFile, Path: path, SampleRatio: &ratio}))
+	defer main.ShutdownTracing()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req.Header.Set(main.HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	main.ShutdownTracing()
+
+	data, err := ioutil.ReadFile(path)
+	checkErr(err)
+	var request otlpRequest
+	checkErr(json.Unmarshal(data, &request))
+	if spans := request.spans(); len(spans) != 1 || spans[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected only span of sampled parent trace, got %+v", spans)
+	}
+}
+
+func TestSetupTracing_Invalid(t *testing.T) {
+	negative, excessive := -0.1, 1.5
+	invalid := []*main.TracingConfig{
+		{Exporter: "zipkin"},
+		{Exporter: main.TraceExporterFile},
+		{Exporter: main.TraceExporterFile, Path: filepath.Join(t.TempDir(), "missing", "traces.json")},
+		{Exporter: main.TraceExporterStdout, SampleRatio: &negative},
+		{Exporter: main.TraceExporterStdout, SampleRatio: &excessive},
+	}
+	for _, config := range invalid {
+		if err := main.SetupTracing(config); err == nil {
+			t.Errorf("No error for invalid configuration %+v", config)
+		}
+	}
+}
+
+// Messages of OTLP/JSON `ExportTraceServiceRequest` with all fields defined by opentelemetry-proto v1,
+// decoding with unknown fields disallowed checks exported field names
+type (
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string          `json:"stringValue"`
+		BoolValue   *bool            `json:"boolValue"`
+		IntValue    *string          `json:"intValue"`
+		DoubleValue *json.RawMessage `json:"doubleValue"`
+		ArrayValue  *json.RawMessage `json:"arrayValue"`
+		KvlistValue *json.RawMessage `json:"kvlistValue"`
+		BytesValue  *string          `json:"bytesValue"`
+	}
+	otlpSpecSpan struct {
+		TraceID                string         `json:"traceId"`
+		SpanID                 string         `json:"spanId"`
+		TraceState             string         `json:"traceState"`
+		ParentSpanID           string         `json:"parentSpanId"`
+		Flags                  uint32         `json:"flags"`
+		Name                   string         `json:"name"`
+		Kind                   int            `json:"kind"`
+		StartTimeUnixNano      string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano        string         `json:"endTimeUnixNano"`
+		Attributes             []otlpKeyValue `json:"attributes"`
+		DroppedAttributesCount uint32         `json:"droppedAttributesCount"`
+		Events                 []interface{}  `json:"events"`
+		DroppedEventsCount     uint32         `json:"droppedEventsCount"`
+		Links                  []interface{}  `json:"links"`
+		DroppedLinksCount      uint32         `json:"droppedLinksCount"`
+		Status                 *struct {
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		} `json:"status"`
+	}
+	otlpSpecRequest struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes             []otlpKeyValue `json:"attributes"`
+				DroppedAttributesCount uint32         `json:"droppedAttributesCount"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name                   string         `json:"name"`
+					Version                string         `json:"version"`
+					Attributes             []otlpKeyValue `json:"attributes"`
+					DroppedAttributesCount uint32         `json:"droppedAttributesCount"`
+				} `json:"scope"`
+				Spans     []otlpSpecSpan `json:"spans"`
+				SchemaURL string         `json:"schemaUrl"`
+			} `json:"scopeSpans"`
+			SchemaURL string `json:"schemaUrl"`
+		} `json:"resourceSpans"`
+	}
+)
+
+var (
+	traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spanIDPattern  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// checkAttributes checks every attribute has exactly one value, 64-bit integers are encoded as strings
+// and doubles as numbers or strings of non-finite values, returns values by keys
+func checkAttributes(attributes []otlpKeyValue) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, a := range attributes {
+		set := 0
+		v := a.Value
+		if v.StringValue != nil {
+			set++
+			values[a.Key] = *v.StringValue
+		}
+		if v.BoolValue != nil {
+			set++
+			values[a.Key] = *v.BoolValue
+		}
+		if v.IntValue != nil {
+			set++
+			n, err := strconv.ParseInt(*v.IntValue, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid intValue of %s: %v", a.Key, err)
+			}
+			values[a.Key] = n
+		}
+		if v.DoubleValue != nil {
+			set++
+			var number float64
+			var special string
+			if json.Unmarshal(*v.DoubleValue, &number) == nil {
+				values[a.Key] = number
+			} else if json.Unmarshal(*v.DoubleValue, &special) == nil &&
+				(special == "NaN" || special == "Infinity" || special == "-Infinity") {
+				values[a.Key] = special
+			} else {
+				return nil, fmt.Errorf("invalid doubleValue of %s: %s", a.Key, *v.DoubleValue)
+			}
+		}
+		if v.ArrayValue != nil || v.KvlistValue != nil || v.BytesValue != nil {
+			set++
+		}
+		if a.Key == "" || set != 1 {
+			return nil, fmt.Errorf("attribute %q must have key and exactly one value", a.Key)
+		}
+	}
+	return values, nil
+}
+
+// checkOTLPSpan checks IDs are lowercase hex of non-zero bytes, times are strings of unix nanoseconds,
+// kind and status code are known enum values
+func checkOTLPSpan(s otlpSpecSpan) error {
+	if !traceIDPattern.MatchString(s.TraceID) || s.TraceID == strings.Repeat("0", 32) {
+		return fmt.Errorf("invalid traceId %q", s.TraceID)
+	}
+	if !spanIDPattern.MatchString(s.SpanID) || s.SpanID == strings.Repeat("0", 16) {
+		return fmt.Errorf("invalid spanId %q", s.SpanID)
+	}
+	if s.ParentSpanID != "" && (!spanIDPattern.MatchString(s.ParentSpanID) || s.ParentSpanID == strings.Repeat("0", 16)) {
+		return fmt.Errorf("invalid parentSpanId %q", s.ParentSpanID)
+	}
+	start, err1 := strconv.ParseUint(s.StartTimeUnixNano, 10, 64)
+	end, err2 := strconv.ParseUint(s.EndTimeUnixNano, 10, 64)
+	if err1 != nil || err2 != nil || start == 0 || end < start {
+		return fmt.Errorf("invalid start %q and end %q time", s.StartTimeUnixNano, s.EndTimeUnixNano)
+	}
+	if s.Name == "" || s.Kind < 1 || s.Kind > 5 {
+		return fmt.Errorf("invalid name %q or kind %d", s.Name, s.Kind)
+	}
+	if s.Status != nil && (s.Status.Code < 0 || s.Status.Code > 2) {
+		return fmt.Errorf("invalid status code %d", s.Status.Code)
+	}
+	_, err := checkAttributes(s.Attributes)
+	return err
+}
+
+func TestTracing_OTLPConformance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	checkErr(main.SetupTracing(&main.TracingConfig{Exporter: main.TraceExporterFile, Path: path, ServiceName: "conformance"}))
+	defer main.ShutdownTracing()
+
+	parentCtx, parent := main.StartSpan(ctx, "parent")
+	_, child := main.StartSpan(parentCtx, "child")
+	child.SetAttributes(
+		"string", "value",
+		"bool", true,
+		"int", 42,
+		"int64", int64(math.MaxInt64),
+		"double", 1.5,
+		"nan", math.NaN(),
+		"infinity", math.Inf(1),
+		"negative_infinity", math.Inf(-1),
+	)
+	child.RecordError(errors.New("failure"))
+	child.End()
+	parent.End()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(main.HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	main.ShutdownTracing()
+
+	data, err := ioutil.ReadFile(path)
+	checkErr(err)
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("Expected single exported batch, got %d lines", len(lines))
+	}
+	var request otlpSpecRequest
+	decoder := json.NewDecoder(bytes.NewReader(lines[0]))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		t.Fatalf("Export isn't OTLP/JSON request: %v\n%s", err, lines[0])
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected single resource and scope, got %s", lines[0])
+	}
+	resource, err := checkAttributes(request.ResourceSpans[0].Resource.Attributes)
+	if err != nil {
+		t.Errorf("Invalid resource attributes: %v", err)
+	}
+	if resource["service.name"] != "conformance" || resource["service.version"] == nil {
+		t.Errorf("Unexpected resource attributes: %v", resource)
+	}
+	scope := request.ResourceSpans[0].ScopeSpans[0]
+	if scope.Scope.Name == "" || scope.Scope.Version == "" {
+		t.Errorf("Instrumentation scope has no name and version: %+v", scope.Scope)
+	}
+	spans := map[string]otlpSpecSpan{}
+	for _, s := range scope.Spans {
+		if err := checkOTLPSpan(s); err != nil {
+			t.Errorf("Invalid span %s: %v", s.Name, err)
+		}
+		spans[s.Name] = s
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %s", lines[0])
+	}
+	if spans["child"].TraceID != spans["parent"].TraceID || spans["child"].ParentSpanID != spans["parent"].SpanID ||
+		spans["parent"].ParentSpanID != "" || spans["parent"].Kind != 1 {
+		t.Errorf("Unexpected internal spans: %+v", spans)
+	}
+	if status := spans["child"].Status; status == nil || status.Code != 2 || status.Message != "failure" {
+		t.Errorf("Expected error status of child span, got %+v", status)
+	}
+	if spans["parent"].Status != nil {
+		t.Errorf("Unexpected status of parent span: %+v", spans["parent"].Status)
+	}
+	attributes, _ := checkAttributes(spans["child"].Attributes)
+	expected := map[string]interface{}{
+		"string": "value", "bool": true, "int": int64(42), "int64": int64(math.MaxInt64), "double": 1.5,
+		"nan": "NaN", "infinity": "Infinity", "negative_infinity": "-Infinity",
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("Expected attribute %s to be %v, got %v", key, value, attributes[key])
+		}
+	}
+	server := spans["GET /"]
+	if server.Kind != 2 || server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected server span: %+v", server)
+	}
+}